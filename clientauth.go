@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+)
+
+// clientPolicy is the format of the -https-client-policy file: the client
+// certificates allowed on the https listener, in addition to being signed by
+// -https-listen-ca.
+type clientPolicy struct {
+	Clients []clientRule `json:"clients"`
+}
+
+// clientRule matches a client certificate by every identity field it sets.
+// cn, dns_san and uri_san are path.Match patterns; spki_sha256 is the
+// base64 sha256 of the certificate's SubjectPublicKeyInfo.  Services, if
+// set, are the service names (or patterns) the client may check; "" is the
+// service list or overall server health.
+type clientRule struct {
+	Name       string   `json:"name"`
+	CN         string   `json:"cn"`
+	DNSSAN     string   `json:"dns_san"`
+	URISAN     string   `json:"uri_san"`
+	SPKISHA256 string   `json:"spki_sha256"`
+	Services   []string `json:"services"`
+}
+
+func loadClientPolicy(file string) (*clientPolicy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client policy %s: %v", file, err)
+	}
+	var cp clientPolicy
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, fmt.Errorf("failed to parse client policy %s: %v", file, err)
+	}
+	for i, c := range cp.Clients {
+		if c.CN == "" && c.DNSSAN == "" && c.URISAN == "" && c.SPKISHA256 == "" {
+			return nil, fmt.Errorf("client %d in client policy matches no identity (set cn, dns_san, uri_san or spki_sha256)", i)
+		}
+		for _, p := range append([]string{c.CN, c.DNSSAN, c.URISAN}, c.Services...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q for client %d in client policy", p, i)
+			}
+		}
+		if c.SPKISHA256 != "" && !probe.ValidSPKIPin(c.SPKISHA256) {
+			return nil, fmt.Errorf("invalid spki_sha256 %q for client %d in client policy", c.SPKISHA256, i)
+		}
+	}
+	return &cp, nil
+}
+
+func matchAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if ok, _ := path.Match(pattern, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func certURIs(cert *x509.Certificate) []string {
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	return uris
+}
+
+func (c *clientRule) matches(cert *x509.Certificate) bool {
+	if c.CN != "" && !matchAny(c.CN, []string{cert.Subject.CommonName}) {
+		return false
+	}
+	if c.DNSSAN != "" && !matchAny(c.DNSSAN, cert.DNSNames) {
+		return false
+	}
+	if c.URISAN != "" && !matchAny(c.URISAN, certURIs(cert)) {
+		return false
+	}
+	return c.SPKISHA256 == "" || c.SPKISHA256 == probe.SPKISHA256(cert)
+}
+
+func (c *clientRule) allows(services []string) bool {
+	if c.Services == nil {
+		return true
+	}
+	for _, s := range services {
+		allowed := false
+		for _, p := range c.Services {
+			if ok, _ := path.Match(p, s); ok {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// authorize returns the first rule that matches cert and allows it to check
+// services, or nil.
+func (cp *clientPolicy) authorize(cert *x509.Certificate, services []string) *clientRule {
+	for i := range cp.Clients {
+		c := &cp.Clients[i]
+		if c.matches(cert) && c.allows(services) {
+			return c
+		}
+	}
+	return nil
+}
+
+// authorizeClient applies -https-client-policy to a request for services of
+// target u.  A denied request is audit logged and answered with a 403.
+func (u *upstream) authorizeClient(w http.ResponseWriter, r *http.Request, services []string, format string) bool {
+	if clientAuth == nil {
+		return true
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		if c := clientAuth.authorize(cert, services); c != nil {
+			logger.Debug("client authorized", slog.String("client", c.Name), slog.String("cn", cert.Subject.CommonName), slog.Any("services", services))
+			return true
+		}
+	}
+
+	attrs := []any{
+		slog.String("target", u.name),
+		slog.String("path", r.URL.Path),
+		slog.Any("services", services),
+		slog.String("remote_addr", r.RemoteAddr),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		attrs = append(attrs,
+			slog.String("cn", cert.Subject.CommonName),
+			slog.Any("dns_sans", cert.DNSNames),
+			slog.Any("uri_sans", certURIs(cert)),
+			slog.String("spki_sha256", probe.SPKISHA256(cert)),
+			slog.String("serial", cert.SerialNumber.String()))
+	}
+	rejectedRequests.WithLabelValues(u.name, limitClient).Inc()
+	logger.Warn("audit: client certificate not authorized", attrs...)
+	u.writeRejection(w, http.StatusForbidden, "ClientForbidden", "ClientForbidden", limitClient, format)
+	return false
+}
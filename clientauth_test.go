@@ -0,0 +1,231 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// clientCert returns a self-signed client certificate; only the identity
+// matters to the client policy, -https-listen-ca is checked by crypto/tls.
+func clientCert(t *testing.T, cn string, dnsNames []string, uri string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if uri != "" {
+		u, _ := url.Parse(uri)
+		tmpl.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// withClientPolicy sets -https-client-policy to the policy in data until
+// the test ends.
+func withClientPolicy(t *testing.T, data string) {
+	t.Helper()
+	cp, err := loadClientPolicy(writeFile(t, "clients.json", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := clientAuth
+	clientAuth = cp
+	t.Cleanup(func() { clientAuth = saved })
+}
+
+// captureLogs sends logs to the returned buffer until the test ends.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	saved := logger
+	logger = slog.New(slog.NewTextHandler(&buf, nil))
+	t.Cleanup(func() { logger = saved })
+	return &buf
+}
+
+// getAs serves a GET of target with h over a TLS connection that presented
+// cert, or none if cert is nil.
+func getAs(h http.HandlerFunc, target string, cert *x509.Certificate) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.TLS = &tls.ConnectionState{}
+	if cert != nil {
+		r.TLS.PeerCertificates = []*x509.Certificate{cert}
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestLoadClientPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"malformed", `{"clients": [`, "failed to parse"},
+		{"no identity", `{"clients": [{"name": "any", "services": ["echo"]}]}`, "matches no identity"},
+		{"bad pattern", `{"clients": [{"cn": "[a-"}]}`, "invalid pattern"},
+		{"bad service pattern", `{"clients": [{"cn": "lb", "services": ["[x"]}]}`, "invalid pattern"},
+		{"bad spki", `{"clients": [{"spki_sha256": "abc"}]}`, "invalid spki_sha256"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := loadClientPolicy(writeFile(t, "clients.json", tc.data)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("loadClientPolicy() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := loadClientPolicy("/nonexistent/clients.json"); err == nil {
+		t.Errorf("loadClientPolicy() of a missing file succeeded")
+	}
+}
+
+func TestClientRuleMatches(t *testing.T) {
+	cert := clientCert(t, "lb-1.example.com", []string{"lb-1.example.com"}, "spiffe://example.com/ns/lb/sa/probe")
+	for _, tc := range []struct {
+		name string
+		rule clientRule
+		want bool
+	}{
+		{"cn", clientRule{CN: "lb-1.example.com"}, true},
+		{"cn wildcard", clientRule{CN: "*.example.com"}, true},
+		{"cn mismatch", clientRule{CN: "lb-2.example.com"}, false},
+		{"dns san", clientRule{DNSSAN: "lb-?.example.com"}, true},
+		{"uri san wildcard", clientRule{URISAN: "spiffe://example.com/ns/lb/sa/*"}, true},
+		// * does not match /
+		{"uri san across segments", clientRule{URISAN: "spiffe://example.com/*"}, false},
+		{"spki", clientRule{SPKISHA256: probe.SPKISHA256(cert)}, true},
+		{"every field must match", clientRule{CN: "*.example.com", DNSSAN: "other"}, false},
+	} {
+		if got := tc.rule.matches(cert); got != tc.want {
+			t.Errorf("%s: matches() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestClientPolicyHandler(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo.v1", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("admin", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+	withClientPolicy(t, `{"clients": [
+		{"name": "lb", "cn": "*.lb.example.com", "services": ["echo.*"]},
+		{"name": "ops", "cn": "ops", "services": ["", "admin"]},
+		{"name": "root", "uri_san": "spiffe://example.com/admin"}
+	]}`)
+	lb := clientCert(t, "node-1.lb.example.com", nil, "")
+	ops := clientCert(t, "ops", nil, "")
+	root := clientCert(t, "root", nil, "spiffe://example.com/admin")
+	stranger := clientCert(t, "stranger", nil, "")
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		cert   *x509.Certificate
+		want   int
+	}{
+		{"allowed by wildcard", "/?serviceName=echo.v1", lb, http.StatusOK},
+		{"service not allowed", "/?serviceName=admin", lb, http.StatusForbidden},
+		{"list not allowed", "/", lb, http.StatusForbidden},
+		{"group member not allowed", "/?serviceName=echo.v1&serviceName=admin", lb, http.StatusForbidden},
+		{"list allowed by empty name", "/", ops, http.StatusOK},
+		{"named service", "/?serviceName=admin", ops, http.StatusOK},
+		{"any service", "/?serviceName=admin&serviceName=echo.v1", root, http.StatusOK},
+		{"unknown client", "/?serviceName=echo.v1", stranger, http.StatusForbidden},
+		{"no certificate", "/?serviceName=echo.v1", nil, http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			w := getAs(u.healthHandler, tc.target, tc.cert)
+			if w.Code != tc.want {
+				t.Fatalf("GET %s = %d %q, want %d", tc.target, w.Code, w.Body.String(), tc.want)
+			}
+			denied := tc.want == http.StatusForbidden
+			if denied && w.Header().Get(probeErrorReasonHeader) != limitClient {
+				t.Errorf("GET %s reason = %q, want %q", tc.target, w.Header().Get(probeErrorReasonHeader), limitClient)
+			}
+			if audited := strings.Contains(logs.String(), "audit: client certificate not authorized"); audited != denied {
+				t.Errorf("GET %s audit logged = %v, want %v", tc.target, audited, denied)
+			}
+			if denied && tc.cert != nil && !strings.Contains(logs.String(), probe.SPKISHA256(tc.cert)) {
+				t.Errorf("audit log %q lacks the certificate's spki hash", logs.String())
+			}
+		})
+	}
+}
+
+func TestClientPolicyWatch(t *testing.T) {
+	_, u := newPolledUpstream(t, "echo")
+	withClientPolicy(t, `{"clients": [{"cn": "lb", "services": ["echo"]}, {"cn": "other", "services": ["admin"]}]}`)
+
+	if w := getAs(u.watchHandler, "/watch?serviceName=echo", clientCert(t, "other", nil, "")); w.Code != http.StatusForbidden {
+		t.Errorf("GET /watch by a client not allowed echo = %d, want 403", w.Code)
+	}
+	if w := getAs(u.watchHandler, "/watch?serviceName=echo", nil); w.Code != http.StatusForbidden {
+		t.Errorf("GET /watch without a certificate = %d, want 403", w.Code)
+	}
+
+	lb := clientCert(t, "lb", nil, "")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{lb}}
+		u.watchHandler(w, r)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?serviceName=echo", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /watch by an allowed client = %d, want 200", res.StatusCode)
+	}
+	if data := readEvent(t, bufio.NewScanner(res.Body)); !strings.Contains(data, `"status":"SERVING"`) {
+		t.Errorf("first event = %s, want SERVING", data)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Limits that reject a request, as the limit label of
+// grpc_health_check_rejected_requests.  limitPolicy is the service name
+// policy of -allow-services and -deny-services, limitClient the client
+// certificate policy of -https-client-policy.
+const (
+	limitConcurrency = "concurrency"
+	limitStreams     = "streams"
+	limitIP          = "ip"
+	limitService     = "service"
+	limitPolicy      = "policy"
+	limitClient      = "client_policy"
+)
+
+// maxBuckets is the number of token buckets kept per limit; the least
+// recently used bucket is dropped to make room for a new one.
+const maxBuckets = 10000
+
+var rejectedRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "grpc_health_check_rejected_requests",
+		Help: "health check requests rejected by -max-concurrent-probes, -max-watch-streams, a rate limit, the service name policy or the client certificate policy, partitioned by target and limit (concurrency, streams, ip, service, policy or client_policy).",
+	},
+	[]string{"target", "limit"},
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets is a set of token buckets sharing the same rate and burst,
+// keyed by client address or service.
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets *probe.LRU[*bucket]
+}
+
+func newTokenBuckets(rate float64, burst int) *tokenBuckets {
+	return &tokenBuckets{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: probe.NewLRU[*bucket](maxBuckets),
+	}
+}
+
+// allow takes a token from the bucket of key.  If the bucket is empty, it
+// returns false and the time until the next token.
+func (tb *tokenBuckets) allow(key string, now time.Time) (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	b, ok := tb.buckets.Get(key)
+	if !ok {
+		b = &bucket{tokens: tb.burst, last: now}
+		tb.buckets.Add(key, b)
+	}
+	b.tokens = math.Min(tb.burst, b.tokens+now.Sub(b.last).Seconds()*tb.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / tb.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limiter guards the health check handlers against clients that would
+// otherwise turn every request into an upstream rpc.  A nil field disables
+// the respective limit.
+type limiter struct {
+	// sem holds a token for every upstream health check in progress.
+	sem chan struct{}
+	// streams holds a token for every open watch stream.
+	streams  chan struct{}
+	ip       *tokenBuckets
+	services *tokenBuckets
+}
+
+// admit applies the rate limits to a request of r for services of target
+// u.  It writes a 429 response and returns false if the request is
+// rejected.
+func (l *limiter) admit(w http.ResponseWriter, r *http.Request, u *upstream, services []string, format string) bool {
+	now := time.Now()
+	if l.ip != nil {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if ok, wait := l.ip.allow(ip, now); !ok {
+			l.reject(w, u, limitIP, wait, format, slog.String("client", ip))
+			return false
+		}
+	}
+	if l.services != nil {
+		for _, s := range services {
+			if ok, wait := l.services.allow(u.name+"/"+s, now); !ok {
+				l.reject(w, u, limitService, wait, format, slog.String("service_name", s))
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// acquire takes a token of sem.  It returns a function that gives the
+// token back, or nil if sem is full.
+func acquire(sem chan struct{}) func() {
+	if sem == nil {
+		return func() {}
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }
+	default:
+		return nil
+	}
+}
+
+func (l *limiter) reject(w http.ResponseWriter, u *upstream, limit string, wait time.Duration, format string, attrs ...any) {
+	rejectedRequests.WithLabelValues(u.name, limit).Inc()
+	logger.Warn("request rejected", append([]any{slog.String("target", u.name), slog.String("limit", limit)}, attrs...)...)
+
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+	u.writeRejection(w, http.StatusTooManyRequests, "RateLimited", "RateLimited", limit, format)
+}
+
+// limitedChecker holds a -max-concurrent-probes token for every check that
+// reaches the upstream and fails with probe.ErrCheckRejected if there is
+// none left.  Services answered from memory by tracker (polled or watched)
+// and results served by a Cache above it do not take a token.
+type limitedChecker struct {
+	checker probe.Checker
+	tracker interface{ Tracks(string) bool }
+	sem     chan struct{}
+}
+
+func (c *limitedChecker) Check(ctx context.Context, serviceName string) (*probe.Result, error) {
+	if c.tracker == nil || !c.tracker.Tracks(serviceName) {
+		release := acquire(c.sem)
+		if release == nil {
+			return &probe.Result{
+				Service: serviceName,
+				Status:  healthpb.HealthCheckResponse_UNKNOWN,
+				Time:    time.Now(),
+			}, probe.ErrCheckRejected
+		}
+		defer release()
+	}
+	return c.checker.Check(ctx, serviceName)
+}
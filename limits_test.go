@@ -0,0 +1,212 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// withLimits replaces the global limits until the test ends.
+func withLimits(t *testing.T, l *limiter) {
+	t.Helper()
+	saved := limits
+	limits = l
+	t.Cleanup(func() { limits = saved })
+}
+
+// fill takes every token of sem until the test ends.
+func fill(t *testing.T, sem chan struct{}) {
+	t.Helper()
+	for range cap(sem) {
+		sem <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for range cap(sem) {
+			<-sem
+		}
+	})
+}
+
+func TestTokenBuckets(t *testing.T) {
+	tb := newTokenBuckets(2, 3)
+	now := time.Now()
+	for i := range 3 {
+		if ok, _ := tb.allow("a", now); !ok {
+			t.Fatalf("request %d within the burst rejected", i)
+		}
+	}
+	ok, wait := tb.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("request over the burst = %v, %v, want rejected with 500ms to wait", ok, wait)
+	}
+	if ok, _ := tb.allow("b", now); !ok {
+		t.Errorf("another key shares the bucket")
+	}
+	if ok, _ := tb.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("request after a refill rejected")
+	}
+}
+
+func TestTokenBucketsEvictLeastRecentlyUsed(t *testing.T) {
+	tb := newTokenBuckets(1, 1)
+	now := time.Now()
+	// empty the bucket of "a", then touch it again after all others
+	tb.allow("a", now)
+	for i := range maxBuckets - 1 {
+		tb.allow(fmt.Sprint(i), now)
+	}
+	tb.allow("a", now)
+	tb.allow("new", now)
+	if n := tb.buckets.Len(); n != maxBuckets {
+		t.Fatalf("%d buckets kept, want %d", n, maxBuckets)
+	}
+	if _, ok := tb.buckets.Get("0"); ok {
+		t.Errorf("least recently used bucket was not evicted")
+	}
+	if ok, _ := tb.allow("a", now); ok {
+		t.Errorf("the empty bucket of a recently used key was evicted")
+	}
+}
+
+func TestLimitedChecker(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	c := &limitedChecker{
+		checker: statusCheckerFunc(healthpb.HealthCheckResponse_SERVING),
+		tracker: trackerFunc(func(s string) bool { return s == "polled" }),
+		sem:     sem,
+	}
+	if _, err := c.Check(context.Background(), "echo"); err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if len(sem) != 0 {
+		t.Errorf("Check() did not give its token back")
+	}
+	fill(t, sem)
+	if res, err := c.Check(context.Background(), "echo"); !errors.Is(err, probe.ErrCheckRejected) || res == nil {
+		t.Errorf("Check() with no token left = %v, %v, want ErrCheckRejected", res, err)
+	}
+	if _, err := c.Check(context.Background(), "polled"); err != nil {
+		t.Errorf("Check() of a polled service = %v, want no token needed", err)
+	}
+}
+
+type statusCheckerFunc healthpb.HealthCheckResponse_ServingStatus
+
+func (s statusCheckerFunc) Check(ctx context.Context, serviceName string) (*probe.Result, error) {
+	return &probe.Result{Service: serviceName, Status: healthpb.HealthCheckResponse_ServingStatus(s), Time: time.Now()}, nil
+}
+
+type trackerFunc func(string) bool
+
+func (f trackerFunc) Tracks(s string) bool { return f(s) }
+
+func TestConcurrencyLimitHandler(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("other", healthpb.HealthCheckResponse_SERVING)
+	sem := make(chan struct{}, 1)
+	withLimits(t, &limiter{sem: sem})
+	u := newTestUpstream(t, "default", addr)
+	u.checker = probe.NewCache(u.prober, &limitedChecker{checker: u.checker, sem: sem}, probe.CacheConfig{PositiveTTL: time.Minute})
+
+	if w := get(u.healthHandler, "/?serviceName=echo"); w.Code != http.StatusOK {
+		t.Fatalf("GET echo = %d %q, want 200", w.Code, w.Body.String())
+	}
+	fill(t, sem)
+	if w := get(u.healthHandler, "/?serviceName=echo"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != probe.CacheHit {
+		t.Errorf("cached GET echo with no slot left = %d %s, want a 200 HIT", w.Code, w.Header().Get("X-Cache"))
+	}
+	for _, target := range []string{"/?serviceName=other", "/", "/?serviceName=echo&serviceName=other", "/?serviceName=other&format=json", "/?serviceName=echo&serviceName=other&format=json"} {
+		w := get(u.healthHandler, target)
+		if w.Code != http.StatusTooManyRequests || w.Header().Get(probeErrorReasonHeader) != limitConcurrency || w.Header().Get("Retry-After") == "" {
+			t.Errorf("GET %s with no slot left = %d reason %q, want 429 concurrency", target, w.Code, w.Header().Get(probeErrorReasonHeader))
+		}
+		want := "text/plain; charset=utf-8"
+		if strings.HasSuffix(target, "format=json") {
+			want = "application/json"
+		}
+		if ct := w.Header().Get("Content-Type"); ct != want {
+			t.Errorf("GET %s with no slot left Content-Type = %q, want %q", target, ct, want)
+		}
+	}
+	// the rejection must not be cached
+	<-sem
+	if w := get(u.healthHandler, "/?serviceName=other"); w.Code != http.StatusOK || w.Header().Get("X-Cache") != probe.CacheMiss {
+		t.Errorf("GET other with a free slot = %d %s, want a 200 MISS", w.Code, w.Header().Get("X-Cache"))
+	}
+	sem <- struct{}{}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	withLimits(t, &limiter{ip: newTokenBuckets(0.001, 1), services: newTokenBuckets(0.001, 2)})
+	u := newTestUpstream(t, "default", addr)
+
+	if w := get(u.healthHandler, "/?serviceName=echo"); w.Code != http.StatusOK {
+		t.Fatalf("first GET = %d, want 200", w.Code)
+	}
+	if w := get(u.healthHandler, "/?serviceName=echo"); w.Code != http.StatusTooManyRequests || w.Header().Get(probeErrorReasonHeader) != limitIP {
+		t.Errorf("second GET from the same address = %d reason %q, want 429 ip", w.Code, w.Header().Get(probeErrorReasonHeader))
+	}
+	w := get(u.healthHandler, "/?serviceName=echo", "X-Forwarded-For", "192.0.2.1")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("GET with X-Forwarded-For = %d, want the header ignored", w.Code)
+	}
+}
+
+func TestWatchStreamLimit(t *testing.T) {
+	_, u := newPolledUpstream(t, "echo")
+	streams := make(chan struct{}, 1)
+	withLimits(t, &limiter{streams: streams, sem: make(chan struct{}, 1)})
+	fill(t, limits.sem)
+	fill(t, streams)
+
+	w := get(u.watchHandler, "/watch?serviceName=echo")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get(probeErrorReasonHeader) != limitStreams {
+		t.Errorf("GET /watch with no stream left = %d reason %q, want 429 streams", w.Code, w.Header().Get(probeErrorReasonHeader))
+	}
+	<-streams
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/watch?serviceName=echo", nil)
+	done := make(chan struct{})
+	go func() {
+		u.watchHandler(httptest.NewRecorder(), r)
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(streams) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(streams) != 1 {
+		t.Errorf("open stream holds %d tokens, want 1", len(streams))
+	}
+	cancel()
+	<-done
+	if len(streams) != 0 {
+		t.Errorf("closed stream did not give its token back")
+	}
+	streams <- struct{}{}
+}
@@ -16,25 +16,25 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"log/slog"
 
 	"github.com/gorilla/mux"
+	"github.com/salrashid123/grpc_health_proxy/probe"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
-	"google.golang.org/grpc/status"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -58,64 +58,106 @@ type ProbeConfig struct {
 	flGrpcTLSClientCert     string
 	flGrpcTLSClientKey      string
 	flGrpcSNIServerName     string
+	flGrpcSPIFFEID          string
+	flGrpcURISAN            string
+	flGrpcSANRegex          string
+	flGrpcSPKIPins          string
+	flGrpcSPKIPinsFile      string
 	flHTTPSTLSServerCert    string
 	flHTTPSTLSServerKey     string
 	flHTTPSTLSVerifyCA      string
 	flHTTPSTLSVerifyClient  bool
+	flTLSReloadInterval     time.Duration
+	flHTTPSClientPolicy     string
+	flHTTPSCRL              string
+	flHTTPSOCSP             bool
+	flHTTPSOCSPResponder    string
+	flGrpcCRL               string
+	flGrpcOCSP              bool
+	flGrpcOCSPResponder     string
+	flOCSPTimeout           time.Duration
+	flOCSPCacheTTL          time.Duration
+	flRevocationFailMode    string
+	flPollInterval          time.Duration
+	flPollServices          string
+	flPollMaxStaleness      time.Duration
+	flWatch                 bool
+	flWatchServices         string
+	flWatchFallbackInterval time.Duration
+	flWatchMaxStaleness     time.Duration
+	flHTTPWatchPath         string
+	flHTTPWatchHeartbeat    time.Duration
+	flHTTPWatchHistory      int
+	flTargetsConfig         string
+	flHTTPTargetsPath       string
+	flServiceGroups         stringSliceFlag
+	flListFilterPrefix      string
+	flListFilterRegex       string
+	flListMode              string
+	flHTTPStatusMap         string
+	flHTTPErrorDetail       bool
+	flRetryMaxAttempts      int
+	flRetryInitialBackoff   time.Duration
+	flRetryMaxBackoff       time.Duration
+	flRetryCodes            string
+	flRetryDeadline         time.Duration
+	flCoalesce              bool
+	flCacheTTL              time.Duration
+	flCacheNegativeTTL      time.Duration
+	flRise                  int
+	flFall                  int
+	flServiceThresholds     stringSliceFlag
+	flMaxTrackedServices    int
+	flMaxConcurrentProbes   int
+	flMaxWatchStreams       int
+	flRateLimitPerIP        float64
+	flRateLimitPerIPBurst   int
+	flRateLimitPerService   float64
+	flRateLimitServiceBurst int
+	flIgnoreServiceParam    bool
+	flAllowServices         string
+	flAllowServicesRegex    string
+	flDenyServices          string
+	flDenyServicesRegex     string
 	flLogTarget             string
 	flJSONLog               bool
 	flDebug                 bool
 }
 
 var (
-	cfg  = &ProbeConfig{}
-	opts = []grpc.DialOption{}
+	cfg             = &ProbeConfig{}
+	listFilter      func(string) bool
+	statusMapping   *statusMap
+	thresholds      *probe.HysteresisConfig
+	retryPolicy     probe.RetryPolicy
+	limits          = &limiter{}
+	servicesPolicy  *servicePolicy
+	clientAuth      *clientPolicy
+	grpcSPKIPins    []string
+	pollServices    map[string]time.Duration
+	watchServices   []string
+	defaultUpstream *upstream
+	feed            *probe.Feed
 
 	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Name: "grpc_health_check_seconds",
 		Help: "Duration of HTTP requests.",
 	}, []string{"path"})
 
-	serviceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
-		Name: "grpc_health_check_service_duration_seconds",
-		Help: "Duration of HTTP requests per service.",
-	}, []string{"service_name"})
-
-	grpcReqs = promauto.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "grpc_health_check_service_requests",
-			Help: "backend status, partitioned by status code and service_name.",
-		},
-		[]string{"code", "service_name"},
-	)
-
-	logger *slog.Logger
+	logger = slog.Default()
 )
 
-type GrpcProbeError struct {
-	Code    int
-	Message string
-}
+// stringSliceFlag is a flag.Value that accumulates repeated flags.
+type stringSliceFlag []string
 
-func NewGrpcProbeError(code int, message string) *GrpcProbeError {
-	return &GrpcProbeError{
-		Code:    code,
-		Message: message,
-	}
-}
-func (e *GrpcProbeError) Error() string {
-	return e.Message
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, " ")
 }
 
-const (
-	StatusConnectionFailure = 1
-	StatusRPCFailure        = 2
-	StatusServiceNotFound   = 3
-	StatusUnimplemented     = 4
-	StatusUnhealthy         = 5
-
-	listServiceMetric = "listServiceRequest"
-)
+func (f *stringSliceFlag) Set(v string) error {
+	*f = append(*f, v)
+	return nil
+}
 
 func prometheusMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -128,8 +170,19 @@ func prometheusMiddleware(next http.Handler) http.Handler {
 }
 
 func init() {
-	flag.StringVar(&cfg.flGrpcServerAddr, "grpcaddr", "", "(required) tcp host:port to connect")
-	flag.StringVar(&cfg.flServiceName, "service-name", "", "service name to check.  If specified, server will ignore ?serviceName= request parameter")
+	flag.StringVar(&cfg.flGrpcServerAddr, "grpcaddr", "", "(required unless -targets-config is set) tcp host:port to connect")
+	flag.StringVar(&cfg.flTargetsConfig, "targets-config", "", "json file of additional named upstream targets, each served on -http-targets-path")
+	flag.StringVar(&cfg.flHTTPTargetsPath, "http-targets-path", "/targets/{target}/healthz", "(with -targets-config) path template to listen for per-target healthcheck traffic; must contain {target}")
+	flag.StringVar(&cfg.flServiceName, "service-name", "", "service name to check when the request has no ?serviceName= parameter (see -ignore-service-name-param)")
+	flag.BoolVar(&cfg.flIgnoreServiceParam, "ignore-service-name-param", false, "(with -service-name) ignore the ?serviceName= request parameter and always check -service-name")
+	flag.StringVar(&cfg.flAllowServices, "allow-services", "", "comma separated service names callers may check with ?serviceName= (default: any)")
+	flag.StringVar(&cfg.flAllowServicesRegex, "allow-services-regex", "", "regex matching the whole service names callers may check with ?serviceName= (default: any)")
+	flag.StringVar(&cfg.flDenyServices, "deny-services", "", "comma separated service names callers may not check with ?serviceName=")
+	flag.StringVar(&cfg.flDenyServicesRegex, "deny-services-regex", "", "regex matching the whole service names callers may not check with ?serviceName=")
+	flag.Var(&cfg.flServiceGroups, "service-group", "group of services checked together with ?group=name, as name=policy:service1,!service2 where policy is all, any or quorum=N and ! marks a critical service (repeatable)")
+	flag.StringVar(&cfg.flListMode, "list-mode", "list", "how to check the server when no service name is given: list (Health/List), overall (Check with an empty service name) or auto (List, falling back to overall if List is unimplemented)")
+	flag.StringVar(&cfg.flListFilterPrefix, "list-filter-prefix", "", "when listing services, only services with this name prefix count toward the overall verdict")
+	flag.StringVar(&cfg.flListFilterRegex, "list-filter-regex", "", "when listing services, only services matching this regex count toward the overall verdict")
 	flag.StringVar(&cfg.flUserAgent, "user-agent", "grpc_health_proxy", "user-agent header value of health check requests")
 	flag.BoolVar(&cfg.flRunCli, "runcli", false, "execute healthCheck via CLI; will not start webserver")
 	// settings for HTTPS listener
@@ -137,13 +190,57 @@ func init() {
 	flag.StringVar(&cfg.flMetricsHTTPListenAddr, "metrics-http-listen-addr", "localhost:9000", "http host:port for metrics endpoint (default: localhost:9000")
 	flag.StringVar(&cfg.flMetricsHTTPPath, "metrics-http-path", "/metrics", "http path metrics endpoint (default:  /metrics")
 	flag.StringVar(&cfg.flHTTPListenPath, "http-listen-path", "/", "path to listen for healthcheck traffic (default '/')")
+	flag.StringVar(&cfg.flHTTPWatchPath, "http-watch-path", "", "(with -watch or -poll-interval) path to stream status transitions as Server-Sent Events (default: disabled)")
+	flag.DurationVar(&cfg.flHTTPWatchHeartbeat, "http-watch-heartbeat", 15*time.Second, "interval to send heartbeats on Server-Sent Event streams")
+	flag.IntVar(&cfg.flHTTPWatchHistory, "http-watch-history", 100, "number of status transitions retained for resuming Server-Sent Event streams")
+	flag.StringVar(&cfg.flHTTPStatusMap, "http-status-map", "", "json file mapping serving statuses and probe errors to http status codes, bodies and headers (default: 200 SERVING, 503 NOT_SERVING/UNKNOWN, 404 SERVICE_UNKNOWN)")
+	flag.BoolVar(&cfg.flHTTPErrorDetail, "http-error-detail", false, "include the underlying dial, TLS handshake or rpc error text as detail in error responses; it can reveal upstream addresses and certificate details to http clients")
 	flag.StringVar(&cfg.flHTTPSTLSServerCert, "https-listen-cert", "", "TLS Server certificate to for HTTP listner")
 	flag.StringVar(&cfg.flHTTPSTLSServerKey, "https-listen-key", "", "TLS Server certificate key to for HTTP listner")
 	flag.StringVar(&cfg.flHTTPSTLSVerifyCA, "https-listen-ca", "", "Use CA to verify client requests against CA")
 	flag.BoolVar(&cfg.flHTTPSTLSVerifyClient, "https-listen-verify", false, "Verify client certificate provided to the HTTP listner")
+	flag.StringVar(&cfg.flHTTPSClientPolicy, "https-client-policy", "", "(with -https-listen-verify) json file of client certificate identities allowed on the https listener and the services each may check (default: any certificate signed by -https-listen-ca)")
+	flag.DurationVar(&cfg.flTLSReloadInterval, "tls-reload-interval", 0, "check the https-listen-* and grpc-* certificate, pin and CRL files for changes on this interval and use the new ones without a restart (default: 0, disabled)")
+	flag.StringVar(&cfg.flHTTPSCRL, "https-listen-crl", "", "(with -https-listen-verify) comma separated CRL files to check client certificates against")
+	flag.BoolVar(&cfg.flHTTPSOCSP, "https-listen-ocsp", false, "(with -https-listen-verify) check client certificates with OCSP")
+	flag.StringVar(&cfg.flHTTPSOCSPResponder, "https-listen-ocsp-responder", "", "(with -https-listen-verify) OCSP responder url for client certificates instead of the one in the certificate (implies -https-listen-ocsp)")
+	flag.DurationVar(&cfg.flOCSPTimeout, "ocsp-timeout", 5*time.Second, "timeout of an OCSP request")
+	flag.DurationVar(&cfg.flOCSPCacheTTL, "ocsp-cache-ttl", time.Hour, "how long an OCSP response is used, at most until its next update")
+	flag.StringVar(&cfg.flRevocationFailMode, "revocation-fail-mode", "soft", "accept (soft) or reject (hard) a certificate whose revocation status cannot be determined")
 	// timeouts
 	flag.DurationVar(&cfg.flConnTimeout, "connect-timeout", time.Second, "timeout for establishing connection")
 	flag.DurationVar(&cfg.flRPCTimeout, "rpc-timeout", time.Second, "timeout for health check rpc")
+	// retries
+	flag.IntVar(&cfg.flRetryMaxAttempts, "retry-max-attempts", 1, "number of health rpc attempts per probe, including retries of retryable failures (default: 1, no retries)")
+	flag.DurationVar(&cfg.flRetryInitialBackoff, "retry-initial-backoff", 100*time.Millisecond, "(with -retry-max-attempts) delay before the first retry; doubles on every retry")
+	flag.DurationVar(&cfg.flRetryMaxBackoff, "retry-max-backoff", time.Second, "(with -retry-max-attempts) maximum delay between retries")
+	flag.StringVar(&cfg.flRetryCodes, "retry-codes", "UNAVAILABLE,DEADLINE_EXCEEDED", "(with -retry-max-attempts) comma separated retryable gRPC status codes")
+	flag.DurationVar(&cfg.flRetryDeadline, "retry-deadline", 0, "(with -retry-max-attempts) overall deadline of a probe including retries (default: 0, -connect-timeout plus -rpc-timeout)")
+	// background polling
+	flag.DurationVar(&cfg.flPollInterval, "poll-interval", 0, "poll services in the background on this interval and answer http requests from the cached result (default: 0, disabled)")
+	flag.StringVar(&cfg.flPollServices, "poll-services", "", "(with -poll-interval) comma separated services to poll, each optionally as name=interval (default: -service-name)")
+	flag.DurationVar(&cfg.flPollMaxStaleness, "poll-max-staleness", 0, "(with -poll-interval) report cached results older than this as UNKNOWN (default: 0, no limit)")
+	// watch streams
+	flag.BoolVar(&cfg.flWatch, "watch", false, "track services with grpc.health.v1.Health/Watch streams and answer http requests from the latest pushed status")
+	flag.StringVar(&cfg.flWatchServices, "watch-services", "", "(with -watch) comma separated services to watch (default: -service-name)")
+	flag.DurationVar(&cfg.flWatchFallbackInterval, "watch-fallback-interval", 5*time.Second, "(with -watch) interval to poll Check on if the server does not implement Watch")
+	flag.DurationVar(&cfg.flWatchMaxStaleness, "watch-max-staleness", 0, "(with -watch) keep serving the last status for this long after a watch stream is lost (default: 0, report the failure immediately)")
+	// coalescing and caching
+	flag.BoolVar(&cfg.flCoalesce, "coalesce", false, "share one in-flight health check between concurrent requests for the same target and service")
+	flag.DurationVar(&cfg.flCacheTTL, "cache-ttl", 0, "reuse SERVING results for this long (default: 0, disabled)")
+	flag.DurationVar(&cfg.flCacheNegativeTTL, "cache-negative-ttl", 0, "reuse results other than SERVING, including errors, for this long (default: 0, disabled)")
+	// hysteresis
+	flag.IntVar(&cfg.flRise, "rise", 1, "number of consecutive healthy results required to mark an unhealthy service healthy again")
+	flag.IntVar(&cfg.flFall, "fall", 1, "number of consecutive unhealthy results required to mark a healthy service unhealthy")
+	flag.Var(&cfg.flServiceThresholds, "service-thresholds", "rise and fall thresholds of one service, as service=rise:fall (repeatable)")
+	flag.IntVar(&cfg.flMaxTrackedServices, "max-tracked-services", 1000, "maximum number of services per target whose cached result or hysteresis state is kept; the least recently checked is dropped")
+
+	flag.IntVar(&cfg.flMaxConcurrentProbes, "max-concurrent-probes", 0, "maximum number of upstream health checks made at once for http requests; further requests get 429 (default: 0, no limit)")
+	flag.IntVar(&cfg.flMaxWatchStreams, "max-watch-streams", 0, "(with -http-watch-path) maximum number of open watch streams; further requests get 429 (default: 0, no limit)")
+	flag.Float64Var(&cfg.flRateLimitPerIP, "rate-limit-per-ip", 0, "health check requests per second allowed from one client address; further requests get 429 (default: 0, no limit)")
+	flag.IntVar(&cfg.flRateLimitPerIPBurst, "rate-limit-per-ip-burst", 10, "(with -rate-limit-per-ip) number of requests a client address may make at once")
+	flag.Float64Var(&cfg.flRateLimitPerService, "rate-limit-per-service", 0, "health check requests per second allowed for one service of a target; further requests get 429 (default: 0, no limit)")
+	flag.IntVar(&cfg.flRateLimitServiceBurst, "rate-limit-per-service-burst", 10, "(with -rate-limit-per-service) number of requests for a service allowed at once")
 	// tls settings
 	flag.BoolVar(&cfg.flGrpcTLS, "grpctls", false, "use TLS for upstream gRPC(default: false, INSECURE plaintext transport)")
 	flag.BoolVar(&cfg.flGrpcTLSNoVerify, "grpc-tls-no-verify", false, "(with -tls) don't verify the certificate (INSECURE) presented by the server (default: false)")
@@ -151,11 +248,24 @@ func init() {
 	flag.StringVar(&cfg.flGrpcTLSClientCert, "grpc-client-cert", "", "(with -grpctls, optional) client certificate for authenticating to the server (requires -tls-client-key)")
 	flag.StringVar(&cfg.flGrpcTLSClientKey, "grpc-client-key", "", "(with -grpctls) client private key for authenticating to the server (requires -tls-client-cert)")
 	flag.StringVar(&cfg.flGrpcSNIServerName, "grpc-sni-server-name", "", "(with -grpctls) override the hostname used to verify the gRPC server certificate")
+	flag.StringVar(&cfg.flGrpcSPIFFEID, "grpc-spiffe-id", "", "(with -grpctls) verify the gRPC server certificate is the X509-SVID of this SPIFFE ID instead of verifying the hostname")
+	flag.StringVar(&cfg.flGrpcURISAN, "grpc-uri-san", "", "(with -grpctls) verify the gRPC server certificate carries this URI SAN instead of verifying the hostname")
+	flag.StringVar(&cfg.flGrpcSANRegex, "grpc-san-regex", "", "(with -grpctls) verify the gRPC server certificate carries a DNS or URI SAN matching this regex in full instead of verifying the hostname")
+	flag.StringVar(&cfg.flGrpcSPKIPins, "grpc-spki-pins", "", "(with -grpctls) comma separated base64 sha256 hashes of public keys (SPKI); a certificate of the gRPC server's chain must match one (alone with -grpc-tls-no-verify: the server certificate must)")
+	flag.StringVar(&cfg.flGrpcSPKIPinsFile, "grpc-spki-pins-file", "", "(with -grpctls) file of SPKI pins like -grpc-spki-pins, one per line; reloaded with -tls-reload-interval")
+	flag.StringVar(&cfg.flGrpcCRL, "grpc-crl", "", "(with -grpctls) comma separated CRL files to check the gRPC server certificate against")
+	flag.BoolVar(&cfg.flGrpcOCSP, "grpc-ocsp", false, "(with -grpctls) check the gRPC server certificate with OCSP")
+	flag.StringVar(&cfg.flGrpcOCSPResponder, "grpc-ocsp-responder", "", "(with -grpctls) OCSP responder url for the gRPC server certificate instead of the one in the certificate (implies -grpc-ocsp)")
 
 	flag.StringVar(&cfg.flLogTarget, "logTarget", "", "log to file target (default stdout)")
 	flag.BoolVar(&cfg.flJSONLog, "jsonLog", false, "enable json logging")
 	flag.BoolVar(&cfg.flDebug, "debug", false, "enable debug logging")
+}
 
+// configure parses and validates the flags and sets up logging.  It is
+// called from main rather than init so that tests can set up the handlers
+// without a command line.
+func configure() {
 	flag.Parse()
 
 	mlogTarget := os.Stdout // default
@@ -188,17 +298,51 @@ func init() {
 		os.Exit(-1)
 	}
 
-	if cfg.flGrpcServerAddr == "" {
+	if cfg.flGrpcServerAddr == "" && cfg.flTargetsConfig == "" {
 		argError("-grpcaddr not specified")
 	}
+	if cfg.flGrpcServerAddr == "" && (cfg.flWatch || cfg.flPollInterval > 0) {
+		argError("-watch and -poll-interval require -grpcaddr")
+	}
+	if cfg.flListMode != "list" && cfg.flListMode != "overall" && cfg.flListMode != "auto" {
+		argError("-list-mode must be one of list, overall or auto", slog.Any("list-mode", cfg.flListMode))
+	}
+	if cfg.flListFilterPrefix != "" && cfg.flListFilterRegex != "" {
+		argError("cannot specify both -list-filter-prefix and -list-filter-regex")
+	}
+	if cfg.flListFilterPrefix != "" {
+		listFilter = func(s string) bool { return strings.HasPrefix(s, cfg.flListFilterPrefix) }
+	}
+	if cfg.flListFilterRegex != "" {
+		re, err := regexp.Compile(cfg.flListFilterRegex)
+		if err != nil {
+			argError("invalid -list-filter-regex", slog.String("", err.Error()))
+		}
+		listFilter = re.MatchString
+	}
+	var err error
+	if statusMapping, err = loadStatusMap(cfg.flHTTPStatusMap); err != nil {
+		argError("invalid -http-status-map", slog.String("", err.Error()))
+	}
+	for _, g := range cfg.flServiceGroups {
+		if _, err := probe.ParseGroup(g); err != nil {
+			argError("invalid -service-group", slog.String("", err.Error()))
+		}
+	}
+	if cfg.flTargetsConfig != "" && cfg.flRunCli {
+		argError("cannot specify -targets-config with -runcli")
+	}
+	if cfg.flTargetsConfig != "" && !strings.Contains(cfg.flHTTPTargetsPath, "{target}") {
+		argError("-http-targets-path must contain {target}")
+	}
 	if !cfg.flRunCli && cfg.flHTTPListenAddr == "" {
 		argError("-http-listen-addr not specified")
 	}
 	if cfg.flConnTimeout <= 0 {
-		argError("-connect-timeout must be greater than zero (specified: %v)", cfg.flConnTimeout)
+		argError("-connect-timeout must be greater than zero", slog.Any("connect-timeout", cfg.flConnTimeout))
 	}
 	if cfg.flRPCTimeout <= 0 {
-		argError("-rpc-timeout must be greater than zero (specified: %v)", cfg.flRPCTimeout)
+		argError("-rpc-timeout must be greater than zero", slog.Any("rpc-timeout", cfg.flRPCTimeout))
 	}
 	if !cfg.flGrpcTLS && cfg.flGrpcTLSNoVerify {
 		argError("specified -grpc-tls-no-verify without specifying -grpctls")
@@ -224,344 +368,936 @@ func init() {
 	if cfg.flGrpcTLSNoVerify && cfg.flGrpcSNIServerName != "" {
 		argError("cannot specify -grpc-sni-server-name with -grpc-tls-no-verify (server name would not be used)")
 	}
+	identities := 0
+	for _, s := range []string{cfg.flGrpcSPIFFEID, cfg.flGrpcURISAN, cfg.flGrpcSANRegex} {
+		if s != "" {
+			identities++
+		}
+	}
+	if identities > 0 && !cfg.flGrpcTLS {
+		argError("specified -grpc-spiffe-id, -grpc-uri-san or -grpc-san-regex without specifying -grpctls")
+	}
+	if identities > 0 && cfg.flGrpcTLSNoVerify {
+		argError("cannot specify -grpc-spiffe-id, -grpc-uri-san or -grpc-san-regex with -grpc-tls-no-verify (identity would not be verified)")
+	}
+	if identities > 1 {
+		argError("specify only one of -grpc-spiffe-id, -grpc-uri-san and -grpc-san-regex")
+	}
+	if cfg.flGrpcSPIFFEID != "" && !strings.HasPrefix(cfg.flGrpcSPIFFEID, "spiffe://") {
+		argError("-grpc-spiffe-id must start with spiffe://", slog.Any("grpc-spiffe-id", cfg.flGrpcSPIFFEID))
+	}
+	if cfg.flGrpcSANRegex != "" {
+		if _, err := regexp.Compile(cfg.flGrpcSANRegex); err != nil {
+			argError("invalid -grpc-san-regex", slog.String("", err.Error()))
+		}
+	}
+	if (cfg.flGrpcSPKIPins != "" || cfg.flGrpcSPKIPinsFile != "") && !cfg.flGrpcTLS {
+		argError("specified -grpc-spki-pins or -grpc-spki-pins-file without specifying -grpctls")
+	}
+	for _, pin := range strings.Split(cfg.flGrpcSPKIPins, ",") {
+		if pin = strings.TrimSpace(pin); pin == "" {
+			continue
+		}
+		if !probe.ValidSPKIPin(pin) {
+			argError("invalid -grpc-spki-pins: must be base64 sha256 hashes", slog.String("pin", pin))
+		}
+		grpcSPKIPins = append(grpcSPKIPins, pin)
+	}
 	if (cfg.flHTTPSTLSServerCert == "" && cfg.flHTTPSTLSServerKey != "") || (cfg.flHTTPSTLSServerCert != "" && cfg.flHTTPSTLSServerKey == "") {
 		argError("must specify both -https-listen-cert and -https-listen-key")
 	}
+	if cfg.flPollInterval < 0 {
+		argError("-poll-interval must not be negative", slog.Any("poll-interval", cfg.flPollInterval))
+	}
+	if cfg.flPollInterval == 0 && (cfg.flPollServices != "" || cfg.flPollMaxStaleness != 0) {
+		argError("specified -poll-services or -poll-max-staleness without specifying -poll-interval")
+	}
+	if cfg.flPollInterval > 0 && cfg.flPollServices == "" && cfg.flServiceName == "" {
+		argError("-poll-interval requires -poll-services or -service-name")
+	}
+	if cfg.flPollInterval > 0 {
+		var err error
+		if pollServices, err = parsePollServices(cfg.flPollServices, cfg.flServiceName, cfg.flPollInterval); err != nil {
+			argError("invalid -poll-services", slog.String("", err.Error()))
+		}
+	}
+	if cfg.flPollInterval > 0 && cfg.flRunCli {
+		argError("cannot specify -poll-interval with -runcli")
+	}
+	if cfg.flWatch && cfg.flPollInterval > 0 {
+		argError("cannot specify both -watch and -poll-interval")
+	}
+	if !cfg.flWatch && cfg.flWatchServices != "" {
+		argError("specified -watch-services without specifying -watch")
+	}
+	if cfg.flWatch && cfg.flWatchServices == "" && cfg.flServiceName == "" {
+		argError("-watch requires -watch-services or -service-name")
+	}
+	if cfg.flWatch {
+		watchServices = []string{cfg.flServiceName}
+		if cfg.flWatchServices != "" {
+			var err error
+			if watchServices, err = parseServiceNames(cfg.flWatchServices); err != nil {
+				argError("invalid -watch-services", slog.String("", err.Error()))
+			}
+		}
+	}
+	if cfg.flWatch && cfg.flRunCli {
+		argError("cannot specify -watch with -runcli")
+	}
+	if cfg.flWatchFallbackInterval <= 0 {
+		argError("-watch-fallback-interval must be greater than zero", slog.Any("watch-fallback-interval", cfg.flWatchFallbackInterval))
+	}
+	if cfg.flHTTPWatchPath != "" && !cfg.flWatch && cfg.flPollInterval == 0 {
+		argError("-http-watch-path requires -watch or -poll-interval")
+	}
+	if cfg.flHTTPWatchPath != "" && cfg.flHTTPWatchPath == cfg.flHTTPListenPath {
+		argError("-http-watch-path must differ from -http-listen-path")
+	}
+	if cfg.flHTTPWatchHeartbeat <= 0 {
+		argError("-http-watch-heartbeat must be greater than zero", slog.Any("http-watch-heartbeat", cfg.flHTTPWatchHeartbeat))
+	}
+	if cfg.flHTTPWatchHistory <= 0 {
+		argError("-http-watch-history must be greater than zero", slog.Any("http-watch-history", cfg.flHTTPWatchHistory))
+	}
+	if cfg.flRetryMaxAttempts <= 0 {
+		argError("-retry-max-attempts must be greater than zero", slog.Any("retry-max-attempts", cfg.flRetryMaxAttempts))
+	}
+	if cfg.flRetryInitialBackoff <= 0 || cfg.flRetryMaxBackoff < cfg.flRetryInitialBackoff {
+		argError("-retry-initial-backoff must be greater than zero and not exceed -retry-max-backoff", slog.Any("retry-initial-backoff", cfg.flRetryInitialBackoff), slog.Any("retry-max-backoff", cfg.flRetryMaxBackoff))
+	}
+	if cfg.flRetryDeadline < 0 {
+		argError("-retry-deadline must not be negative", slog.Any("retry-deadline", cfg.flRetryDeadline))
+	}
+	retryPolicy = probe.RetryPolicy{
+		MaxAttempts:    cfg.flRetryMaxAttempts,
+		InitialBackoff: cfg.flRetryInitialBackoff,
+		MaxBackoff:     cfg.flRetryMaxBackoff,
+		Deadline:       cfg.flRetryDeadline,
+	}
+	for _, name := range strings.Split(cfg.flRetryCodes, ",") {
+		code, ok := parseGrpcCode(strings.TrimSpace(name))
+		if !ok {
+			argError("invalid -retry-codes: unknown gRPC status code", slog.String("code", name))
+		}
+		retryPolicy.Codes = append(retryPolicy.Codes, code)
+	}
+	if cfg.flCacheTTL < 0 || cfg.flCacheNegativeTTL < 0 {
+		argError("-cache-ttl and -cache-negative-ttl must not be negative", slog.Any("cache-ttl", cfg.flCacheTTL), slog.Any("cache-negative-ttl", cfg.flCacheNegativeTTL))
+	}
+	if cfg.flRise <= 0 || cfg.flFall <= 0 {
+		argError("-rise and -fall must be greater than zero", slog.Any("rise", cfg.flRise), slog.Any("fall", cfg.flFall))
+	}
+	if cfg.flMaxTrackedServices <= 0 {
+		argError("-max-tracked-services must be greater than zero", slog.Any("max-tracked-services", cfg.flMaxTrackedServices))
+	}
+	if cfg.flRise > 1 || cfg.flFall > 1 || len(cfg.flServiceThresholds) > 0 {
+		thresholds = &probe.HysteresisConfig{
+			Default:     probe.Thresholds{Rise: cfg.flRise, Fall: cfg.flFall},
+			Services:    map[string]probe.Thresholds{},
+			MaxServices: cfg.flMaxTrackedServices,
+		}
+		for _, spec := range cfg.flServiceThresholds {
+			name, t, err := probe.ParseThresholds(spec)
+			if err != nil {
+				argError("invalid -service-thresholds", slog.String("", err.Error()))
+			}
+			thresholds.Services[name] = t
+		}
+	}
+	if thresholds != nil && cfg.flRunCli {
+		argError("cannot specify -rise, -fall or -service-thresholds with -runcli")
+	}
+	if thresholds != nil && cfg.flWatch {
+		argError("cannot specify -rise, -fall or -service-thresholds with -watch (watch streams only push status changes)")
+	}
+	if cfg.flIgnoreServiceParam && cfg.flServiceName == "" && cfg.flTargetsConfig == "" {
+		argError("-ignore-service-name-param requires -service-name")
+	}
+	if servicesPolicy, err = newServicePolicy(cfg.flAllowServices, cfg.flAllowServicesRegex, cfg.flDenyServices, cfg.flDenyServicesRegex); err != nil {
+		argError("invalid service name policy", slog.String("", err.Error()))
+	}
+	if cfg.flMaxConcurrentProbes < 0 {
+		argError("-max-concurrent-probes must not be negative", slog.Any("max-concurrent-probes", cfg.flMaxConcurrentProbes))
+	}
+	if cfg.flMaxWatchStreams < 0 {
+		argError("-max-watch-streams must not be negative", slog.Any("max-watch-streams", cfg.flMaxWatchStreams))
+	}
+	if cfg.flRateLimitPerIP < 0 || cfg.flRateLimitPerService < 0 {
+		argError("-rate-limit-per-ip and -rate-limit-per-service must not be negative", slog.Any("rate-limit-per-ip", cfg.flRateLimitPerIP), slog.Any("rate-limit-per-service", cfg.flRateLimitPerService))
+	}
+	if cfg.flRateLimitPerIPBurst <= 0 || cfg.flRateLimitServiceBurst <= 0 {
+		argError("-rate-limit-per-ip-burst and -rate-limit-per-service-burst must be greater than zero", slog.Any("rate-limit-per-ip-burst", cfg.flRateLimitPerIPBurst), slog.Any("rate-limit-per-service-burst", cfg.flRateLimitServiceBurst))
+	}
+	if cfg.flRunCli && (cfg.flMaxConcurrentProbes > 0 || cfg.flRateLimitPerIP > 0 || cfg.flRateLimitPerService > 0) {
+		argError("cannot specify -max-concurrent-probes, -rate-limit-per-ip or -rate-limit-per-service with -runcli")
+	}
+	if cfg.flMaxConcurrentProbes > 0 {
+		limits.sem = make(chan struct{}, cfg.flMaxConcurrentProbes)
+	}
+	if cfg.flMaxWatchStreams > 0 {
+		limits.streams = make(chan struct{}, cfg.flMaxWatchStreams)
+	}
+	if cfg.flRateLimitPerIP > 0 {
+		limits.ip = newTokenBuckets(cfg.flRateLimitPerIP, cfg.flRateLimitPerIPBurst)
+	}
+	if cfg.flRateLimitPerService > 0 {
+		limits.services = newTokenBuckets(cfg.flRateLimitPerService, cfg.flRateLimitServiceBurst)
+	}
+	if cfg.flHTTPSClientPolicy != "" {
+		if !cfg.flHTTPSTLSVerifyClient {
+			argError("specified -https-client-policy without specifying -https-listen-verify")
+		}
+		if clientAuth, err = loadClientPolicy(cfg.flHTTPSClientPolicy); err != nil {
+			argError("invalid -https-client-policy", slog.String("", err.Error()))
+		}
+	}
+	if cfg.flTLSReloadInterval < 0 {
+		argError("-tls-reload-interval must not be negative", slog.Any("tls-reload-interval", cfg.flTLSReloadInterval))
+	}
 	if cfg.flHTTPSTLSVerifyCA == "" && cfg.flHTTPSTLSVerifyClient {
 		argError("cannot specify -https-listen-ca if https-listen-verify is set (you need a trust CA for client certificate https auth)")
 	}
+	if (cfg.flHTTPSCRL != "" || cfg.flHTTPSOCSP || cfg.flHTTPSOCSPResponder != "") && !cfg.flHTTPSTLSVerifyClient {
+		argError("specified -https-listen-crl, -https-listen-ocsp or -https-listen-ocsp-responder without specifying -https-listen-verify")
+	}
+	if (cfg.flGrpcCRL != "" || cfg.flGrpcOCSP || cfg.flGrpcOCSPResponder != "") && (!cfg.flGrpcTLS || cfg.flGrpcTLSNoVerify) {
+		argError("-grpc-crl, -grpc-ocsp and -grpc-ocsp-responder require -grpctls without -grpc-tls-no-verify")
+	}
+	for _, responder := range []string{cfg.flHTTPSOCSPResponder, cfg.flGrpcOCSPResponder} {
+		if !validOCSPResponder(responder) {
+			argError("invalid OCSP responder url, must be http(s)", slog.String("url", responder))
+		}
+	}
+	if cfg.flOCSPTimeout <= 0 || cfg.flOCSPCacheTTL < 0 {
+		argError("-ocsp-timeout must be greater than zero and -ocsp-cache-ttl not negative", slog.Any("ocsp-timeout", cfg.flOCSPTimeout), slog.Any("ocsp-cache-ttl", cfg.flOCSPCacheTTL))
+	}
+	if cfg.flRevocationFailMode != "soft" && cfg.flRevocationFailMode != "hard" {
+		argError("-revocation-fail-mode must be soft or hard", slog.Any("revocation-fail-mode", cfg.flRevocationFailMode))
+	}
 
 	logger.Info("parsed options:")
 	logger.Info(">", slog.String("addr", cfg.flGrpcServerAddr), slog.Duration("conn_timeout", cfg.flConnTimeout), slog.Duration("rpc_timeout", cfg.flRPCTimeout))
 	logger.Info(">", slog.Bool("grpctls", cfg.flGrpcTLS))
 	logger.Info(">", slog.String("http-listen-addr", cfg.flHTTPListenAddr))
 	logger.Info(">", slog.String("http-listen-path", cfg.flHTTPListenPath))
+	logger.Info(">", slog.String("http-watch-path", cfg.flHTTPWatchPath))
+	logger.Info(">", slog.String("http-status-map", cfg.flHTTPStatusMap))
+	logger.Info(">", slog.Bool("http-error-detail", cfg.flHTTPErrorDetail))
+	logger.Info(">", slog.Any("service-group", []string(cfg.flServiceGroups)))
+	logger.Info(">", slog.String("list-mode", cfg.flListMode))
+	logger.Info(">", slog.String("list-filter-prefix", cfg.flListFilterPrefix), slog.String("list-filter-regex", cfg.flListFilterRegex))
+	logger.Info(">", slog.String("targets-config", cfg.flTargetsConfig), slog.String("http-targets-path", cfg.flHTTPTargetsPath))
+	logger.Info(">", slog.Duration("poll-interval", cfg.flPollInterval), slog.String("poll-services", cfg.flPollServices), slog.Duration("poll-max-staleness", cfg.flPollMaxStaleness))
+	logger.Info(">", slog.Int("retry-max-attempts", cfg.flRetryMaxAttempts), slog.Duration("retry-initial-backoff", cfg.flRetryInitialBackoff), slog.Duration("retry-max-backoff", cfg.flRetryMaxBackoff), slog.String("retry-codes", cfg.flRetryCodes), slog.Duration("retry-deadline", cfg.flRetryDeadline))
+	logger.Info(">", slog.Bool("coalesce", cfg.flCoalesce), slog.Duration("cache-ttl", cfg.flCacheTTL), slog.Duration("cache-negative-ttl", cfg.flCacheNegativeTTL))
+	logger.Info(">", slog.Int("rise", cfg.flRise), slog.Int("fall", cfg.flFall), slog.Any("service-thresholds", []string(cfg.flServiceThresholds)), slog.Int("max-tracked-services", cfg.flMaxTrackedServices))
+	logger.Info(">", slog.Bool("ignore-service-name-param", cfg.flIgnoreServiceParam), slog.String("allow-services", cfg.flAllowServices), slog.String("allow-services-regex", cfg.flAllowServicesRegex), slog.String("deny-services", cfg.flDenyServices), slog.String("deny-services-regex", cfg.flDenyServicesRegex))
+	logger.Info(">", slog.Int("max-concurrent-probes", cfg.flMaxConcurrentProbes), slog.Int("max-watch-streams", cfg.flMaxWatchStreams), slog.Float64("rate-limit-per-ip", cfg.flRateLimitPerIP), slog.Int("rate-limit-per-ip-burst", cfg.flRateLimitPerIPBurst), slog.Float64("rate-limit-per-service", cfg.flRateLimitPerService), slog.Int("rate-limit-per-service-burst", cfg.flRateLimitServiceBurst))
+	logger.Info(">", slog.Bool("watch", cfg.flWatch), slog.String("watch-services", cfg.flWatchServices), slog.Duration("watch-fallback-interval", cfg.flWatchFallbackInterval), slog.Duration("watch-max-staleness", cfg.flWatchMaxStaleness))
 
 	logger.Info(">", slog.String("https-listen-cert", cfg.flHTTPSTLSServerCert))
 	logger.Info(">", slog.String("https-listen-key", cfg.flHTTPSTLSServerKey))
 	logger.Info(">", slog.Bool("https-listen-verify", cfg.flHTTPSTLSVerifyClient))
 	logger.Info(">", slog.String("https-listen-ca", cfg.flHTTPSTLSVerifyCA))
+	logger.Info(">", slog.String("https-client-policy", cfg.flHTTPSClientPolicy))
+	logger.Info(">", slog.Duration("tls-reload-interval", cfg.flTLSReloadInterval))
+	logger.Info(">", slog.String("https-listen-crl", cfg.flHTTPSCRL), slog.Bool("https-listen-ocsp", cfg.flHTTPSOCSP), slog.String("https-listen-ocsp-responder", cfg.flHTTPSOCSPResponder))
+	logger.Info(">", slog.String("grpc-crl", cfg.flGrpcCRL), slog.Bool("grpc-ocsp", cfg.flGrpcOCSP), slog.String("grpc-ocsp-responder", cfg.flGrpcOCSPResponder))
+	logger.Info(">", slog.Duration("ocsp-timeout", cfg.flOCSPTimeout), slog.Duration("ocsp-cache-ttl", cfg.flOCSPCacheTTL), slog.String("revocation-fail-mode", cfg.flRevocationFailMode))
 	logger.Info(">", slog.Bool("grpc-tls-no-verify", cfg.flGrpcTLSNoVerify))
 	logger.Info(">", slog.String("grpc-ca-cert", cfg.flGrpcTLSCACert))
 	logger.Info(">", slog.String("grpc-client-cert", cfg.flGrpcTLSClientCert))
 	logger.Info(">", slog.String("grpc-client-key", cfg.flGrpcTLSClientKey))
 	logger.Info(">", slog.String("grpc-sni-server-name", cfg.flGrpcSNIServerName))
+	logger.Info(">", slog.String("grpc-spiffe-id", cfg.flGrpcSPIFFEID), slog.String("grpc-uri-san", cfg.flGrpcURISAN), slog.String("grpc-san-regex", cfg.flGrpcSANRegex))
+	logger.Info(">", slog.String("grpc-spki-pins", cfg.flGrpcSPKIPins), slog.String("grpc-spki-pins-file", cfg.flGrpcSPKIPinsFile))
 }
 
-func buildGrpcCredentials() (credentials.TransportCredentials, error) {
-	var tlsCfg tls.Config
-
-	if cfg.flGrpcTLSClientCert != "" && cfg.flGrpcTLSClientKey != "" {
-		keyPair, err := tls.LoadX509KeyPair(cfg.flGrpcTLSClientCert, cfg.flGrpcTLSClientKey)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load tls client cert/key pair. error=%v", err)
-		}
-		tlsCfg.Certificates = []tls.Certificate{keyPair}
+// revocationConfig returns the revocation checking of crlFiles and OCSP with
+// the shared -ocsp-* and -revocation-fail-mode settings.
+func revocationConfig(crlFiles []string, ocsp bool, responder string) probe.RevocationConfig {
+	return probe.RevocationConfig{
+		CRLFiles:      crlFiles,
+		OCSP:          ocsp,
+		OCSPResponder: responder,
+		OCSPTimeout:   cfg.flOCSPTimeout,
+		OCSPCacheTTL:  cfg.flOCSPCacheTTL,
+		HardFail:      cfg.flRevocationFailMode == "hard",
 	}
+}
 
-	if cfg.flGrpcTLSNoVerify {
-		tlsCfg.InsecureSkipVerify = true
-	} else if cfg.flGrpcTLSCACert != "" {
-		rootCAs := x509.NewCertPool()
-		pem, err := os.ReadFile(cfg.flGrpcTLSCACert)
-		if err != nil {
-			return nil, fmt.Errorf("failed to load root CA certificates from file (%s) error=%v", cfg.flGrpcTLSCACert, err)
-		}
-		if !rootCAs.AppendCertsFromPEM(pem) {
-			return nil, fmt.Errorf("no root CA certs parsed from file %s", cfg.flGrpcTLSCACert)
-		}
-		tlsCfg.RootCAs = rootCAs
+// listenerTLSConfig returns the tls.Config of the https listener, serving
+// the certificate of certs and, if verifyClient is set, requiring a client
+// certificate issued by its CA bundle.
+func listenerTLSConfig(certs *probe.CertReloader, verifyClient bool, revocation *probe.RevocationChecker) *tls.Config {
+	// ListenAndServeTLS only adds h2 to a clone of the config, which
+	// GetConfigForClient below would not see
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
 	}
-	if cfg.flGrpcSNIServerName != "" {
-		tlsCfg.ServerName = cfg.flGrpcSNIServerName
+	if !verifyClient {
+		return tlsConfig
+	}
+	// pick up a reloaded CA bundle for every handshake
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := tlsConfig.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = certs.CertPool()
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		if revocation != nil {
+			c.VerifyConnection = revocation.VerifyConnection
+		}
+		return c, nil
 	}
-	return credentials.NewTLS(&tlsCfg), nil
+	return tlsConfig
 }
 
-func checkService(ctx context.Context, serviceName string) (healthpb.HealthCheckResponse_ServingStatus, error) {
-
-	timer := prometheus.NewTimer(serviceDuration.WithLabelValues(serviceName))
-	defer timer.ObserveDuration()
+// validOCSPResponder reports whether responder is empty or an http(s) url.
+func validOCSPResponder(responder string) bool {
+	u, err := url.Parse(responder)
+	return responder == "" || (err == nil && (u.Scheme == "http" || u.Scheme == "https"))
+}
 
-	logger.Info("establishing connection")
-	connStart := time.Now()
-	conn, err := grpc.NewClient(cfg.flGrpcServerAddr, opts...)
-	if err != nil {
-		if err == context.DeadlineExceeded {
-			logger.Warn("timeout: failed to connect service %s within %s", cfg.flGrpcServerAddr, cfg.flConnTimeout)
-		} else {
-			logger.Warn("error: failed to connect service at %s: %+v", cfg.flGrpcServerAddr, err)
+// splitFiles splits a comma separated list of files.
+func splitFiles(list string) []string {
+	var files []string
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, f)
 		}
-		return healthpb.HealthCheckResponse_UNKNOWN, NewGrpcProbeError(StatusConnectionFailure, "StatusConnectionFailure")
 	}
-	connDuration := time.Since(connStart)
-	defer conn.Close()
-	logger.Info("connection established", slog.Duration("duration", connDuration))
-
-	rpcStart := time.Now()
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, cfg.flRPCTimeout)
-	defer rpcCancel()
-
-	logger.Info("Running HealthCheck for service:", slog.String("service_name", serviceName))
+	return files
+}
 
-	resp, err := healthpb.NewHealthClient(conn).Check(rpcCtx, &healthpb.HealthCheckRequest{Service: serviceName})
-	if err != nil {
-		// first handle and return gRPC-level errors
-		if stat, ok := status.FromError(err); ok && stat.Code() == codes.Unimplemented {
-			defer grpcReqs.WithLabelValues(codes.Unimplemented.String(), serviceName).Inc()
-			logger.Warn("error: this server does not implement the grpc health protocol (grpc.health.v1.Health)")
-			return healthpb.HealthCheckResponse_UNKNOWN, NewGrpcProbeError(StatusUnimplemented, "StatusUnimplemented")
-		} else if stat, ok := status.FromError(err); ok && stat.Code() == codes.DeadlineExceeded {
-			defer grpcReqs.WithLabelValues(codes.DeadlineExceeded.String(), serviceName).Inc()
-			logger.Warn("error timeout: health rpc did not complete within ", slog.Duration("rpc_timeout", cfg.flRPCTimeout))
-			return healthpb.HealthCheckResponse_UNKNOWN, NewGrpcProbeError(StatusRPCFailure, "StatusRPCFailure")
-		} else if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
-			defer grpcReqs.WithLabelValues(codes.NotFound.String(), serviceName).Inc()
-			// wrap a grpC NOT_FOUND as grpcProbeError.
-			// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
-			// if the service name is not registerered, the server returns a NOT_FOUND GPRPC status.
-			// the Check for a not found should "return nil, status.Error(codes.NotFound, "unknown service")"
-			logger.Warn("error Service Not Found ", slog.String("", err.Error()))
-			return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, NewGrpcProbeError(StatusServiceNotFound, "StatusServiceNotFound")
-		} else {
-			defer grpcReqs.WithLabelValues(codes.Unknown.String(), serviceName).Inc()
-			logger.Warn("error: health rpc failed: ", slog.String("", err.Error()))
-		}
-	} else {
-		defer grpcReqs.WithLabelValues(resp.GetStatus().String(), serviceName).Inc()
+// listServices checks the server as a whole according to -list-mode.
+func listServices(ctx context.Context, p *probe.Prober) (*probe.ListResult, error) {
+	switch cfg.flListMode {
+	case "overall":
+		return p.Overall(ctx)
+	case "auto":
+		return p.ListOrOverall(ctx)
+	default:
+		return p.List(ctx)
 	}
-	rpcDuration := time.Since(rpcStart)
-	// otherwise, retrurn gRPC-HC status
-	logger.Info("time elapsed", slog.Duration("connect", connDuration), slog.Duration("rpc", rpcDuration))
+}
 
-	return resp.GetStatus(), nil
+// listStatuses is the text (and -runcli) response for a list of services,
+// in the grpc.health.v1 List shape with the status enum names of protojson.
+type listStatuses struct {
+	Statuses map[string]listStatus `json:"statuses"`
 }
 
-func listService(ctx context.Context) (healthpb.HealthListResponse, error) {
+type listStatus struct {
+	Status string `json:"status"`
+}
 
-	timer := prometheus.NewTimer(serviceDuration.WithLabelValues(listServiceMetric))
-	defer timer.ObserveDuration()
+// listResponse renders a probe.ListResult as a listStatuses.
+func listResponse(res *probe.ListResult) *listStatuses {
+	resp := &listStatuses{
+		Statuses: map[string]listStatus{},
+	}
+	for s, st := range res.Statuses {
+		resp.Statuses[s] = listStatus{Status: st.String()}
+	}
+	return resp
+}
 
-	logger.Info("establishing connection")
-	connStart := time.Now()
+// parseServiceNames splits a comma separated list of service names,
+// trimming the spaces around each one.  Empty names are rejected: "" is the
+// overall server health, not a service.
+func parseServiceNames(list string) ([]string, error) {
+	var names []string
+	for _, entry := range strings.Split(list, ",") {
+		name := strings.TrimSpace(entry)
+		if name == "" {
+			return nil, fmt.Errorf("empty service name in %q", list)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
 
-	conn, err := grpc.NewClient(cfg.flGrpcServerAddr, opts...)
+// parsePollServices parses -poll-services ("a,b=5s") into a map of service
+// name to poll interval.  Services without an interval use defaultInterval;
+// an empty list polls only defaultService.
+func parsePollServices(list string, defaultService string, defaultInterval time.Duration) (map[string]time.Duration, error) {
+	services := map[string]time.Duration{}
+	if list == "" {
+		services[defaultService] = defaultInterval
+		return services, nil
+	}
+	entries, err := parseServiceNames(list)
 	if err != nil {
-		if err == context.DeadlineExceeded {
-			logger.Warn("timeout: failed to connect service %s within %s", cfg.flGrpcServerAddr, cfg.flConnTimeout)
-		} else {
-			logger.Warn("error: failed to connect service at %s: %+v", cfg.flGrpcServerAddr, err)
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, interval, found := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("empty service name in %q", list)
+		}
+		services[name] = defaultInterval
+		if found {
+			d, err := time.ParseDuration(strings.TrimSpace(interval))
+			if err != nil {
+				return nil, fmt.Errorf("invalid interval for service %s: %v", name, err)
+			}
+			if d <= 0 {
+				return nil, fmt.Errorf("interval for service %s must be greater than zero (specified: %v)", name, d)
+			}
+			services[name] = d
 		}
-		return healthpb.HealthListResponse{}, NewGrpcProbeError(StatusConnectionFailure, "StatusConnectionFailure")
 	}
-	connDuration := time.Since(connStart)
-	defer conn.Close()
-	logger.Info("connection established", slog.Duration("duration", connDuration))
+	return services, nil
+}
 
-	rpcStart := time.Now()
-	rpcCtx, rpcCancel := context.WithTimeout(ctx, cfg.flRPCTimeout)
-	defer rpcCancel()
+// writeProbeError writes the -http-status-map response for a
+// *probe.GrpcProbeError.
+func writeProbeError(w http.ResponseWriter, serviceName string, st healthpb.HealthCheckResponse_ServingStatus, err error) {
+	logger.Error("HealtCheck Probe Error:", slog.String("", err.Error()))
+	pe, ok := err.(*probe.GrpcProbeError)
+	if !ok {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	statusMapping.writeError(w, serviceName, st, pe)
+}
 
-	logger.Info("Running ListServices")
+// runCLI checks -service-name, or lists the services if it is empty, once
+// and returns the exit code: 0 if healthy, else that of the probe error.
+func runCLI(prober *probe.Prober) int {
+	if cfg.flServiceName == "" {
+		res, err := listServices(context.Background(), prober)
+		if err != nil {
+			return probeExitCode(err)
+		}
 
-	resp, err := healthpb.NewHealthClient(conn).List(rpcCtx, &healthpb.HealthListRequest{})
-	if err != nil {
-		// first handle and return gRPC-level errors
-		if stat, ok := status.FromError(err); ok && stat.Code() == codes.Unimplemented {
-			defer grpcReqs.WithLabelValues(codes.Unimplemented.String(), listServiceMetric).Inc()
-			logger.Warn("error: this server does not implement the grpc health protocol list services (grpc.health.v1.Health)")
-			return healthpb.HealthListResponse{}, NewGrpcProbeError(StatusUnimplemented, "StatusUnimplemented")
-		} else if stat, ok := status.FromError(err); ok && stat.Code() == codes.DeadlineExceeded {
-			defer grpcReqs.WithLabelValues(codes.DeadlineExceeded.String(), listServiceMetric).Inc()
-			logger.Warn("error timeout: health rpc did not complete within ", slog.Duration("rpc_timeout", cfg.flRPCTimeout))
-			return healthpb.HealthListResponse{}, NewGrpcProbeError(StatusRPCFailure, "StatusRPCFailure")
-		} else if stat, ok := status.FromError(err); ok && stat.Code() == codes.NotFound {
-			defer grpcReqs.WithLabelValues(codes.NotFound.String(), listServiceMetric).Inc()
-			logger.Warn("error Service Not Found ", slog.String("", err.Error()))
-			return healthpb.HealthListResponse{}, NewGrpcProbeError(StatusServiceNotFound, "StatusServiceNotFound")
-		} else {
-			defer grpcReqs.WithLabelValues(codes.Unknown.String(), listServiceMetric).Inc()
-			logger.Warn("error: health rpc failed: ", slog.String("", err.Error()))
+		jsonData, err := json.Marshal(listResponse(res))
+		if err != nil {
+			return probe.StatusRPCFailure
 		}
-	} else {
-		for s, r := range resp.Statuses {
-			defer grpcReqs.WithLabelValues(r.GetStatus().String(), s).Inc()
+		if !res.Healthy(listFilter) {
+			logger.Error("HealtCheck Probe Error: one or more services are not SERVING", slog.String("statuses", string(jsonData)))
+			return probe.StatusUnhealthy
 		}
+		logger.Info(string(jsonData))
+		return 0
 	}
-	rpcDuration := time.Since(rpcStart)
-	// otherwise, retrurn gRPC-HC status
-	logger.Info("time elapsed", slog.Duration("connect", connDuration), slog.Duration("rpc", rpcDuration))
 
-	return *resp, nil
+	res, err := prober.Check(context.Background(), cfg.flServiceName)
+	if err != nil {
+		return probeExitCode(err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		logger.Error("HealtCheck Probe Error", slog.String("service_name", cfg.flServiceName), slog.String("status", res.Status.String()))
+		return probe.StatusUnhealthy
+	}
+	logger.Info("HealthCheck", slog.String("service_name", cfg.flServiceName), slog.String("status", res.Status.String()))
+	return 0
 }
 
-func healthHandler(w http.ResponseWriter, r *http.Request) {
+// probeExitCode logs a failed probe and returns the exit code of its
+// *probe.GrpcProbeError.
+func probeExitCode(err error) int {
+	logger.Error("HealtCheck Probe Error: ", slog.String("", err.Error()))
+	pe, ok := err.(*probe.GrpcProbeError)
+	if !ok {
+		return probe.StatusUnhealthy
+	}
+	if pe.Reason != "" {
+		logger.Error("probe failure", slog.String("reason", pe.Reason), slog.String("detail", pe.Detail()))
+	}
+	return pe.Code
+}
 
+// requestServiceName returns the service a request is for: the
+// ?serviceName= parameter, or the upstream's default service name if it is
+// absent.
+func (u *upstream) requestServiceName(r *http.Request) string {
 	var serviceName string
-	if cfg.flServiceName != "" {
-		serviceName = cfg.flServiceName
+	if u.serviceName != "" {
+		serviceName = u.serviceName
 	}
-	keys, ok := r.URL.Query()["serviceName"]
-	if ok && len(keys[0]) > 0 {
+	keys := u.serviceNameParams(r)
+	if len(keys) > 0 && len(keys[0]) > 0 {
 		serviceName = keys[0]
 	}
+	return serviceName
+}
+
+// serviceNameParams returns the ?serviceName= parameters of a request, or
+// nil if they are ignored with -ignore-service-name-param.
+func (u *upstream) serviceNameParams(r *http.Request) []string {
+	if cfg.flIgnoreServiceParam && u.serviceName != "" {
+		return nil
+	}
+	return r.URL.Query()["serviceName"]
+}
+
+// requestServices returns the services a request checks, for the
+// per-service rate limit.
+func (u *upstream) requestServices(r *http.Request) []string {
+	q := r.URL.Query()
+	if q.Has("group") {
+		var services []string
+		if g, ok := u.groups[q.Get("group")]; ok {
+			for _, m := range g.Members {
+				services = append(services, m.Service)
+			}
+		}
+		return services
+	}
+	if params := u.serviceNameParams(r); len(params) > 1 {
+		return params
+	}
+	return []string{u.requestServiceName(r)}
+}
+
+func (u *upstream) healthHandler(w http.ResponseWriter, r *http.Request) {
+
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !u.authorizeClient(w, r, u.requestServices(r), format) {
+		return
+	}
+	for _, s := range u.serviceNameParams(r) {
+		if s != "" && !servicesPolicy.allowed(s) {
+			rejectedRequests.WithLabelValues(u.name, limitPolicy).Inc()
+			logger.Warn("request rejected", slog.String("target", u.name), slog.String("limit", limitPolicy), slog.String("service_name", s))
+			u.writeRejection(w, http.StatusForbidden, fmt.Sprintf("%s ServiceForbidden", s), "ServiceForbidden", limitPolicy, format)
+			return
+		}
+	}
+	if !limits.admit(w, r, u, u.requestServices(r), format) {
+		return
+	}
+
+	q := r.URL.Query()
+	if q.Has("group") || len(u.serviceNameParams(r)) > 1 {
+		u.groupHandler(w, r)
+		return
+	}
+
+	serviceName := u.requestServiceName(r)
 
 	if serviceName == "" {
 
-		resp, err := listService(r.Context())
+		release := acquire(limits.sem)
+		if release == nil {
+			limits.reject(w, u, limitConcurrency, time.Second, format)
+			return
+		}
+		res, err := listServices(r.Context(), u.prober)
+		release()
+		servicesPolicy.filterList(res)
+		setServerTiming(w, res.Duration, res.Timing)
+		setAttempts(w, res.Attempts)
+		if format == formatJSON {
+			if err != nil {
+				logger.Error("HealtCheck Probe Error:", slog.String("", err.Error()))
+			}
+			u.writeListJSON(w, res, err)
+			return
+		}
 		// first handle errors derived from gRPC-codes
 		if err != nil {
-			if pe, ok := err.(*GrpcProbeError); ok {
-				logger.Error("HealtCheck Probe Error:", slog.String("", pe.Error()))
-				switch pe.Code {
-				case StatusConnectionFailure:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				case StatusRPCFailure:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				case StatusUnimplemented:
-					http.Error(w, err.Error(), http.StatusNotImplemented)
-				case StatusServiceNotFound:
-					http.Error(w, fmt.Sprintf("%s ServiceNotFound", cfg.flServiceName), http.StatusNotFound)
-				default:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				}
-				return
-			}
+			writeProbeError(w, serviceName, healthpb.HealthCheckResponse_UNKNOWN, err)
+			return
 		}
-		jsonData, err := json.Marshal(resp)
+		jsonData, err := json.Marshal(listResponse(res))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		// the full map is always returned; the status code reflects the
+		// services selected by -list-filter-*
+		w.Header().Set("Content-Type", "application/json")
+		if !res.Healthy(listFilter) {
+			logger.Warn("list: one or more services are not SERVING", slog.String("target", u.name))
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
 		fmt.Fprintf(w, "%s", string(jsonData))
 	} else {
-		resp, err := checkService(r.Context(), serviceName)
+		res, err := u.checker.Check(r.Context(), serviceName)
+		if errors.Is(err, probe.ErrCheckRejected) {
+			limits.reject(w, u, limitConcurrency, time.Second, format)
+			return
+		}
+		setServerTiming(w, res.Duration, res.Timing)
+		setAttempts(w, res.Attempts)
+		setCache(w, res)
+		setHysteresisState(w, res.Hysteresis)
+		if format == formatJSON {
+			if err != nil {
+				logger.Error("HealtCheck Probe Error:", slog.String("", err.Error()))
+			}
+			u.writeCheckJSON(w, serviceName, res, err)
+			return
+		}
 		// first handle errors derived from gRPC-codes
 		if err != nil {
-			if pe, ok := err.(*GrpcProbeError); ok {
-				logger.Error("HealtCheck Probe Error:", slog.String("", pe.Error()))
-				switch pe.Code {
-				case StatusConnectionFailure:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				case StatusRPCFailure:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				case StatusUnimplemented:
-					http.Error(w, err.Error(), http.StatusNotImplemented)
-				case StatusServiceNotFound:
-					http.Error(w, fmt.Sprintf("%s ServiceNotFound", cfg.flServiceName), http.StatusNotFound)
-				default:
-					http.Error(w, err.Error(), http.StatusBadGateway)
-				}
-				return
-			}
+			writeProbeError(w, serviceName, res.Status, err)
+			return
 		}
 
 		// then grpc-hc codes
-		logger.Info("check ", slog.String("service_name", cfg.flServiceName), slog.String("response", resp.String()))
-		switch resp {
-		case healthpb.HealthCheckResponse_SERVING:
-			fmt.Fprintf(w, "%s %v", cfg.flServiceName, resp)
-		case healthpb.HealthCheckResponse_NOT_SERVING:
-			http.Error(w, fmt.Sprintf("%s %v", cfg.flServiceName, resp.String()), http.StatusBadGateway)
-		case healthpb.HealthCheckResponse_UNKNOWN:
-			http.Error(w, fmt.Sprintf("%s %v", cfg.flServiceName, resp.String()), http.StatusBadGateway)
-		case healthpb.HealthCheckResponse_SERVICE_UNKNOWN:
-			http.Error(w, fmt.Sprintf("%s %v", cfg.flServiceName, resp.String()), http.StatusNotFound)
+		logger.Info("check ", slog.String("target", u.name), slog.String("service_name", serviceName), slog.String("response", res.Status.String()))
+		statusMapping.writeStatus(w, serviceName, res.Status)
+	}
+}
+
+// groupResponse is the body of an aggregate health check.
+type groupResponse struct {
+	Group    string                 `json:"group,omitempty"`
+	Policy   string                 `json:"policy"`
+	Healthy  bool                   `json:"healthy"`
+	Services []groupServiceResponse `json:"services"`
+}
+
+type groupServiceResponse struct {
+	Service  string `json:"service"`
+	Status   string `json:"status"`
+	Critical bool   `json:"critical,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// groupHandler checks several services at once, either a configured
+// -service-group (?group=name) or an ad-hoc list
+// (?serviceName=a&serviceName=b&policy=quorum=1&critical=a), and responds
+// 200 if the policy is satisfied and 503 otherwise.
+func (u *upstream) groupHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+
+	var g *probe.Group
+	if q.Has("group") {
+		var ok bool
+		if g, ok = u.groups[q.Get("group")]; !ok {
+			u.writeRequestError(w, http.StatusNotFound, fmt.Sprintf("%s GroupNotFound", q.Get("group")), "GroupNotFound", format)
+			return
+		}
+	} else {
+		policy, err := probe.ParsePolicy(q.Get("policy"))
+		if err != nil {
+			u.writeRequestError(w, http.StatusBadRequest, err.Error(), "InvalidGroup", format)
+			return
+		}
+		critical := map[string]bool{}
+		for _, c := range q["critical"] {
+			critical[c] = true
+		}
+		g = &probe.Group{Policy: policy}
+		for _, s := range u.serviceNameParams(r) {
+			if s == "" {
+				continue
+			}
+			g.Members = append(g.Members, probe.GroupMember{Service: s, Critical: critical[s]})
+		}
+		if len(g.Members) == 0 {
+			u.writeRequestError(w, http.StatusBadRequest, "no services specified", "InvalidGroup", format)
+			return
+		}
+		if policy.Mode == probe.PolicyQuorum && policy.Quorum > len(g.Members) {
+			u.writeRequestError(w, http.StatusBadRequest, fmt.Sprintf("quorum %d exceeds the %d services specified", policy.Quorum, len(g.Members)), "InvalidGroup", format)
+			return
+		}
+	}
+
+	gr := probe.CheckGroup(r.Context(), u.checker, g)
+	for _, m := range gr.Members {
+		if errors.Is(m.Err, probe.ErrCheckRejected) {
+			limits.reject(w, u, limitConcurrency, time.Second, format)
+			return
+		}
+	}
+	resp := groupResponse{
+		Group:   g.Name,
+		Policy:  g.Policy.String(),
+		Healthy: gr.Healthy,
+	}
+	for _, m := range gr.Members {
+		sr := groupServiceResponse{
+			Service:  m.Service,
+			Status:   m.Result.Status.String(),
+			Critical: m.Critical,
 		}
+		if m.Err != nil {
+			sr.Error = m.Err.Error()
+		}
+		resp.Services = append(resp.Services, sr)
+	}
+	logger.Info("group check ", slog.String("target", u.name), slog.String("group", g.Name), slog.String("policy", g.Policy.String()), slog.Bool("healthy", gr.Healthy))
+
+	jsonData, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !gr.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(jsonData)
+}
+
+// watchEvent is the data payload of a Server-Sent Event on -http-watch-path.
+type watchEvent struct {
+	Service string    `json:"service"`
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func writeWatchEvent(w http.ResponseWriter, ev probe.Event) error {
+	data, err := json.Marshal(watchEvent{
+		Service: ev.Service,
+		Status:  ev.Status.String(),
+		Time:    ev.Time,
+		Error:   ev.Error,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", ev.ID, data)
+	return err
+}
+
+// watchHandler streams status transitions of a tracked service as
+// Server-Sent Events.  Clients resume with the standard Last-Event-ID header
+// (or ?lastEventId=) and receive the transitions they missed.  Only the
+// -grpcaddr upstream is polled or watched, so ?target= naming any other
+// upstream is rejected.
+func (u *upstream) watchHandler(w http.ResponseWriter, r *http.Request) {
+
+	if t := r.URL.Query().Get("target"); t != "" && t != u.name {
+		http.Error(w, fmt.Sprintf("%s is not watched or polled: watch streams are only available for the -grpcaddr upstream", t), http.StatusBadRequest)
+		return
+	}
+	serviceName := u.requestServiceName(r)
+	if !u.authorizeClient(w, r, []string{serviceName}, formatText) {
+		return
+	}
+	if serviceName == "" || !u.tracker.Tracks(serviceName) {
+		http.Error(w, fmt.Sprintf("%s is not watched or polled", serviceName), http.StatusNotFound)
+		return
+	}
+	release := acquire(limits.streams)
+	if release == nil {
+		limits.reject(w, u, limitStreams, time.Second, formatText)
+		return
+	}
+	defer release()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid Last-Event-ID %q", lastEventID), http.StatusBadRequest)
+			return
+		}
+	}
+
+	replay, events, cancel := feed.Subscribe(serviceName, lastID)
+	defer cancel()
+	logger.Info("watch stream opened", slog.String("service_name", serviceName), slog.Uint64("last_event_id", lastID), slog.String("remote_addr", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range replay {
+		if err := writeWatchEvent(w, ev); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(cfg.flHTTPWatchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			logger.Info("watch stream closed", slog.String("service_name", serviceName), slog.String("remote_addr", r.RemoteAddr))
+			return
+		case ev, ok := <-events:
+			if !ok {
+				logger.Warn("watch stream subscriber fell behind, closing", slog.String("service_name", serviceName), slog.String("remote_addr", r.RemoteAddr))
+				return
+			}
+			if err := writeWatchEvent(w, ev); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
 	}
 }
 
 func main() {
 
-	opts = append(opts, grpc.WithUserAgent(cfg.flUserAgent))
-	if cfg.flGrpcTLS {
-		creds, err := buildGrpcCredentials()
+	configure()
+
+	if cfg.flGrpcServerAddr != "" {
+		p, err := probe.NewProber(probe.Config{
+			Addr:               cfg.flGrpcServerAddr,
+			UserAgent:          cfg.flUserAgent,
+			ConnTimeout:        cfg.flConnTimeout,
+			RPCTimeout:         cfg.flRPCTimeout,
+			TLS:                cfg.flGrpcTLS,
+			TLSNoVerify:        cfg.flGrpcTLSNoVerify,
+			TLSCACert:          cfg.flGrpcTLSCACert,
+			TLSClientCert:      cfg.flGrpcTLSClientCert,
+			TLSClientKey:       cfg.flGrpcTLSClientKey,
+			TLSServerName:      cfg.flGrpcSNIServerName,
+			TLSSPIFFEID:        cfg.flGrpcSPIFFEID,
+			TLSURISAN:          cfg.flGrpcURISAN,
+			TLSSANRegex:        cfg.flGrpcSANRegex,
+			TLSPins:            grpcSPKIPins,
+			TLSPinsFile:        cfg.flGrpcSPKIPinsFile,
+			Revocation:         revocationConfig(splitFiles(cfg.flGrpcCRL), cfg.flGrpcOCSP, cfg.flGrpcOCSPResponder),
+			TLSReloadInterval:  cfg.flTLSReloadInterval,
+			Retry:              retryPolicy,
+			KnownServices:      configuredServices(),
+			KnownServicesRegex: servicesPolicy.allowRegex,
+			Logger:             logger,
+		})
 		if err != nil {
-			logger.Error("failed to initialize tls credentials", slog.String("", err.Error()))
+			logger.Error("failed to initialize prober", slog.String("", err.Error()))
 			os.Exit(-1)
 		}
-		opts = append(opts, grpc.WithTransportCredentials(creds))
-	} else {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		defer p.Close()
+		defaultUpstream = &upstream{
+			name:        p.Name(),
+			serviceName: cfg.flServiceName,
+			prober:      p,
+			checker:     p,
+			groups:      map[string]*probe.Group{},
+		}
+		for _, spec := range cfg.flServiceGroups {
+			g, _ := probe.ParseGroup(spec)
+			defaultUpstream.groups[g.Name] = g
+		}
 	}
 
 	if cfg.flRunCli {
-		if cfg.flServiceName == "" {
-			resp, err := listService(context.Background())
-			if err != nil {
-				if pe, ok := err.(*GrpcProbeError); ok {
-					logger.Error("HealtCheck Probe Error: ", slog.String("", pe.Error()))
-					switch pe.Code {
-					case StatusConnectionFailure:
-						os.Exit(StatusConnectionFailure)
-					case StatusRPCFailure:
-						os.Exit(StatusRPCFailure)
-					case StatusUnimplemented:
-						os.Exit(StatusUnimplemented)
-					case StatusServiceNotFound:
-						os.Exit(StatusServiceNotFound)
-					default:
-						os.Exit(StatusUnhealthy)
-					}
-				}
-			}
+		if code := runCLI(defaultUpstream.prober); code != 0 {
+			os.Exit(code)
+		}
+	} else {
 
-			jsonData, err := json.Marshal(resp)
+		var targets []*upstream
+		if cfg.flTargetsConfig != "" {
+			var err error
+			targets, err = loadTargets(cfg.flTargetsConfig)
 			if err != nil {
-				os.Exit(StatusRPCFailure)
+				logger.Error("failed to load -targets-config", slog.String("", err.Error()))
+				os.Exit(-1)
 			}
-			logger.Info(string(jsonData))
+			for _, t := range targets {
+				defer t.prober.Close()
+			}
+		}
 
-		} else {
-			resp, err := checkService(context.Background(), cfg.flServiceName)
-			if err != nil {
-				if pe, ok := err.(*GrpcProbeError); ok {
-					logger.Error("HealtCheck Probe Error: ", slog.String("", pe.Error()))
-					switch pe.Code {
-					case StatusConnectionFailure:
-						os.Exit(StatusConnectionFailure)
-					case StatusRPCFailure:
-						os.Exit(StatusRPCFailure)
-					case StatusUnimplemented:
-						os.Exit(StatusUnimplemented)
-					case StatusServiceNotFound:
-						os.Exit(StatusServiceNotFound)
-					default:
-						os.Exit(StatusUnhealthy)
-					}
-				}
+		if cfg.flHTTPWatchPath != "" {
+			feed = probe.NewFeed(cfg.flHTTPWatchHistory)
+		}
+		if cfg.flPollInterval > 0 {
+			poller := probe.NewPoller(defaultUpstream.prober, probe.PollConfig{
+				Services:     pollServices,
+				MaxStaleness: cfg.flPollMaxStaleness,
+				Feed:         feed,
+			})
+			poller.Start(context.Background())
+			defaultUpstream.checker = poller
+			defaultUpstream.tracker = poller
+		}
+		if cfg.flWatch {
+			watcher := probe.NewWatcher(defaultUpstream.prober, probe.WatchConfig{
+				Services:         watchServices,
+				MaxStaleness:     cfg.flWatchMaxStaleness,
+				FallbackInterval: cfg.flWatchFallbackInterval,
+				Feed:             feed,
+			})
+			watcher.Start(context.Background())
+			defaultUpstream.checker = watcher
+			defaultUpstream.tracker = watcher
+		}
+		for _, u := range append([]*upstream{defaultUpstream}, targets...) {
+			if u == nil {
+				continue
+			}
+			if limits.sem != nil {
+				u.checker = &limitedChecker{checker: u.checker, tracker: u.tracker, sem: limits.sem}
 			}
-			if resp != healthpb.HealthCheckResponse_SERVING {
-				logger.Error("HealtCheck Probe Error: service %s failed with reason: %v", cfg.flServiceName, resp.String())
-				os.Exit(StatusUnhealthy)
-			} else {
-				logger.Info("%s %s", cfg.flServiceName, resp.String())
+			if cfg.flCoalesce || cfg.flCacheTTL > 0 || cfg.flCacheNegativeTTL > 0 {
+				cache := probe.NewCache(u.prober, u.checker, probe.CacheConfig{
+					Coalesce:    cfg.flCoalesce,
+					PositiveTTL: cfg.flCacheTTL,
+					NegativeTTL: cfg.flCacheNegativeTTL,
+					MaxEntries:  cfg.flMaxTrackedServices,
+				})
+				cache.Start(context.Background())
+				u.checker = cache
+			}
+			if thresholds != nil {
+				u.checker = probe.NewHysteresis(u.prober, u.checker, *thresholds)
 			}
 		}
 
-	} else {
-
 		tlsConfig := &tls.Config{}
-		if cfg.flHTTPSTLSVerifyClient {
-			caCert, err := os.ReadFile(cfg.flHTTPSTLSVerifyCA)
+		if cfg.flHTTPSTLSServerCert != "" && cfg.flHTTPSTLSServerKey != "" {
+			caFile := ""
+			if cfg.flHTTPSTLSVerifyClient {
+				caFile = cfg.flHTTPSTLSVerifyCA
+			}
+			certs, err := probe.NewCertReloader("listener", cfg.flHTTPSTLSServerCert, cfg.flHTTPSTLSServerKey, caFile, splitFiles(cfg.flHTTPSCRL), logger)
 			if err != nil {
-				logger.Error("Error reading ca", slog.String("", err.Error()))
+				logger.Error("Error loading https listener certificates", slog.String("", err.Error()))
 				os.Exit(-1)
 			}
-			caCertPool := x509.NewCertPool()
-			if !caCertPool.AppendCertsFromPEM(caCert) {
-				logger.Error("Unable to add https server root CA certs")
-				os.Exit(-1)
+			if cfg.flTLSReloadInterval > 0 {
+				certs.Start(context.Background(), cfg.flTLSReloadInterval)
 			}
-
-			tlsConfig = &tls.Config{
-				ClientCAs:  caCertPool,
-				ClientAuth: tls.RequireAndVerifyClientCert,
+			var revocation *probe.RevocationChecker
+			if cfg.flHTTPSTLSVerifyClient {
+				revocation = probe.NewRevocationChecker(revocationConfig(splitFiles(cfg.flHTTPSCRL), cfg.flHTTPSOCSP, cfg.flHTTPSOCSPResponder), certs)
 			}
+			tlsConfig = listenerTLSConfig(certs, cfg.flHTTPSTLSVerifyClient, revocation)
 		}
 
 		r := mux.NewRouter()
 		r.Use(prometheusMiddleware)
-		r.Path(cfg.flHTTPListenPath).HandlerFunc(healthHandler)
+		if defaultUpstream != nil {
+			r.Path(cfg.flHTTPListenPath).HandlerFunc(defaultUpstream.healthHandler)
+		}
+		if cfg.flHTTPWatchPath != "" {
+			r.Path(cfg.flHTTPWatchPath).HandlerFunc(defaultUpstream.watchHandler)
+		}
+		if len(targets) > 0 {
+			r.Path(cfg.flHTTPTargetsPath).HandlerFunc(targetsHandler(targets))
+		}
 
 		go func() {
 			http.Handle(cfg.flMetricsHTTPPath, promhttp.Handler())
@@ -580,7 +1316,8 @@ func main() {
 
 		var err error
 		if cfg.flHTTPSTLSServerCert != "" && cfg.flHTTPSTLSServerKey != "" {
-			err = srv.ListenAndServeTLS(cfg.flHTTPSTLSServerCert, cfg.flHTTPSTLSServerKey)
+			// the certificate comes from tlsConfig.GetCertificate
+			err = srv.ListenAndServeTLS("", "")
 		} else {
 			err = srv.ListenAndServe()
 		}
@@ -0,0 +1,504 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestMain(m *testing.M) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	var err error
+	if statusMapping, err = loadStatusMap(""); err != nil {
+		panic(err)
+	}
+	if servicesPolicy, err = newServicePolicy("", "", "", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// startHealthServer serves the grpc health service on a local port until
+// the test ends.
+func startHealthServer(t *testing.T) (*health.Server, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return hs, lis.Addr().String()
+}
+
+// newTestUpstream returns an upstream named name that checks addr live.
+func newTestUpstream(t *testing.T, name, addr string) *upstream {
+	t.Helper()
+	p, err := probe.NewProber(probe.Config{
+		Name:        name,
+		Addr:        addr,
+		ConnTimeout: 2 * time.Second,
+		RPCTimeout:  2 * time.Second,
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return &upstream{name: name, prober: p, checker: p, groups: map[string]*probe.Group{}}
+}
+
+// get serves a GET of target with h and returns the recorded response.
+func get(h http.HandlerFunc, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// newPolledUpstream returns an upstream whose service is polled and
+// published to the global feed.
+func newPolledUpstream(t *testing.T, service string) (*health.Server, *upstream) {
+	t.Helper()
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus(service, healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+	feed = probe.NewFeed(10)
+	poller := probe.NewPoller(u.prober, probe.PollConfig{
+		Services: map[string]time.Duration{service: 10 * time.Millisecond},
+		Feed:     feed,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	poller.Start(ctx)
+	u.checker, u.tracker = poller, poller
+	return hs, u
+}
+
+// readEvent reads the data line of the next Server-Sent Event.
+func readEvent(t *testing.T, sc *bufio.Scanner) string {
+	t.Helper()
+	for sc.Scan() {
+		if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok {
+			return data
+		}
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+	return ""
+}
+
+func TestWatchHandlerStreamsTransitions(t *testing.T) {
+	hs, u := newPolledUpstream(t, "echo")
+	srv := httptest.NewServer(http.HandlerFunc(u.watchHandler))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?serviceName=echo", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	sc := bufio.NewScanner(res.Body)
+	if data := readEvent(t, sc); !strings.Contains(data, `"status":"SERVING"`) {
+		t.Errorf("first event = %s, want SERVING", data)
+	}
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if data := readEvent(t, sc); !strings.Contains(data, `"status":"NOT_SERVING"`) {
+		t.Errorf("second event = %s, want NOT_SERVING", data)
+	}
+}
+
+func TestWatchHandlerRejects(t *testing.T) {
+	_, u := newPolledUpstream(t, "echo")
+	for _, tc := range []struct {
+		name   string
+		target string
+		header []string
+		want   int
+	}{
+		{"untracked service", "/watch?serviceName=other", nil, http.StatusNotFound},
+		{"no service", "/watch", nil, http.StatusNotFound},
+		{"other target", "/watch?serviceName=echo&target=backend", nil, http.StatusBadRequest},
+		{"bad last event id", "/watch?serviceName=echo", []string{"Last-Event-ID", "x"}, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := get(u.watchHandler, tc.target, tc.header...); w.Code != tc.want {
+				t.Errorf("GET %s = %d %q, want %d", tc.target, w.Code, w.Body.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestGroupHandler(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("a", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("b", healthpb.HealthCheckResponse_NOT_SERVING)
+	u := newTestUpstream(t, "default", addr)
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"all", "/group?serviceName=a&serviceName=b", http.StatusServiceUnavailable},
+		{"quorum", "/group?serviceName=a&serviceName=b&policy=quorum=1", http.StatusOK},
+		{"critical", "/group?serviceName=a&serviceName=b&policy=any&critical=b", http.StatusServiceUnavailable},
+		{"quorum of all services", "/group?serviceName=a&serviceName=b&policy=quorum=2", http.StatusServiceUnavailable},
+		{"quorum above the services", "/group?serviceName=a&serviceName=b&policy=quorum=3", http.StatusBadRequest},
+		{"bad policy", "/group?serviceName=a&policy=most", http.StatusBadRequest},
+		{"no services", "/group?policy=any", http.StatusBadRequest},
+		{"unknown group", "/group?group=missing", http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := get(u.groupHandler, tc.target); w.Code != tc.want {
+				t.Errorf("GET %s = %d %q, want %d", tc.target, w.Code, w.Body.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestGroupHandlerFormats(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("a", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		header []string
+		code   int
+		ct     string
+		want   string
+	}{
+		{"text rejection", "/group?group=missing", nil, http.StatusNotFound, "text/plain; charset=utf-8", "missing GroupNotFound\n"},
+		{"explicit text rejection", "/group?group=missing&format=text", []string{"Accept", "application/json"}, http.StatusNotFound, "text/plain; charset=utf-8", "missing GroupNotFound\n"},
+		{"json rejection", "/group?group=missing&format=json", nil, http.StatusNotFound, "application/json", `"class":"GroupNotFound"`},
+		{"accept rejection", "/group?policy=any", []string{"Accept", "application/json"}, http.StatusBadRequest, "application/json", `"detail":"no services specified"`},
+		{"unknown format", "/group?serviceName=a&serviceName=b&format=xml", nil, http.StatusBadRequest, "text/plain; charset=utf-8", "unknown format"},
+		{"group result", "/group?serviceName=a&serviceName=a", nil, http.StatusOK, "application/json", `"healthy":true`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := get(u.groupHandler, tc.target, tc.header...)
+			if w.Code != tc.code || w.Header().Get("Content-Type") != tc.ct || !strings.Contains(w.Body.String(), tc.want) {
+				t.Errorf("GET %s = %d %q %q, want %d %q containing %q", tc.target, w.Code, w.Header().Get("Content-Type"), w.Body.String(), tc.code, tc.ct, tc.want)
+			}
+		})
+	}
+}
+
+func TestHealthHandlerList(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+
+	w := get(u.healthHandler, "/")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET / = %d %q, want 200", w.Code, w.Body.String())
+	}
+	if got, want := w.Body.String(), `{"statuses":{"":{"status":"SERVING"},"echo":{"status":"SERVING"}}}`; got != want {
+		t.Errorf("GET / body = %s, want %s", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("GET / Content-Type = %q, want application/json", ct)
+	}
+
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	w = get(u.healthHandler, "/")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"echo":{"status":"NOT_SERVING"}`) {
+		t.Errorf("GET / = %d %s, want 503 listing echo NOT_SERVING", w.Code, w.Body.String())
+	}
+}
+
+func TestHealthHandlerJSON(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+
+	for _, tc := range []struct {
+		name   string
+		target string
+		header []string
+		want   string
+	}{
+		{"check", "/?serviceName=echo&format=json", nil, `"status":"SERVING"`},
+		{"accept", "/?serviceName=echo", []string{"Accept", "application/json"}, `"service":"echo"`},
+		{"list", "/?format=json", nil, `"services":{"":"SERVING","echo":"SERVING"}`},
+		{"not found", "/?serviceName=missing&format=json", nil, `"class":"StatusServiceNotFound"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := get(u.healthHandler, tc.target, tc.header...)
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("GET %s Content-Type = %q, want application/json", tc.target, ct)
+			}
+			if body := w.Body.String(); !strings.Contains(body, `"version":"v1"`) || !strings.Contains(body, tc.want) {
+				t.Errorf("GET %s body = %s, want %s", tc.target, body, tc.want)
+			}
+		})
+	}
+
+	if w := get(u.healthHandler, "/?format=xml"); w.Code != http.StatusBadRequest {
+		t.Errorf("GET /?format=xml = %d, want 400", w.Code)
+	}
+	if w := get(u.healthHandler, "/?serviceName=echo"); w.Body.String() != "echo SERVING" {
+		t.Errorf("GET /?serviceName=echo = %q, want plain text", w.Body.String())
+	}
+}
+
+// unusedAddr returns a local address nothing listens on.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestRunCLIExitCodes(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("down", healthpb.HealthCheckResponse_NOT_SERVING)
+	saved := cfg.flServiceName
+	t.Cleanup(func() { cfg.flServiceName = saved })
+
+	for _, tc := range []struct {
+		name    string
+		pc      probe.Config
+		service string
+		want    int
+	}{
+		{"serving", probe.Config{Addr: addr}, "echo", 0},
+		{"not serving", probe.Config{Addr: addr}, "down", probe.StatusUnhealthy},
+		{"not found", probe.Config{Addr: addr}, "missing", probe.StatusServiceNotFound},
+		{"list", probe.Config{Addr: addr}, "", probe.StatusUnhealthy},
+		{"dns failure", probe.Config{Addr: "dns:///grpc-health-proxy-test.invalid:50051"}, "echo", probe.StatusDNSFailure},
+		{"tcp failure", probe.Config{Addr: unusedAddr(t)}, "echo", probe.StatusTCPFailure},
+		{"tcp failure listing", probe.Config{Addr: unusedAddr(t)}, "", probe.StatusTCPFailure},
+		{"tls failure", probe.Config{Addr: addr, TLS: true, TLSNoVerify: true}, "echo", probe.StatusTLSFailure},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.pc.ConnTimeout, tc.pc.RPCTimeout, tc.pc.Logger = 500*time.Millisecond, 2*time.Second, logger
+			p, err := probe.NewProber(tc.pc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			cfg.flServiceName = tc.service
+			if got := runCLI(p); got != tc.want {
+				t.Errorf("runCLI() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseServiceNames(t *testing.T) {
+	for _, tc := range []struct {
+		list    string
+		want    []string
+		wantErr bool
+	}{
+		{"a", []string{"a"}, false},
+		{"a, b", []string{"a", "b"}, false},
+		{" a ,b ", []string{"a", "b"}, false},
+		{"a,", nil, true},
+		{"a,,b", nil, true},
+		{" ", nil, true},
+	} {
+		got, err := parseServiceNames(tc.list)
+		if (err != nil) != tc.wantErr || !slices.Equal(got, tc.want) {
+			t.Errorf("parseServiceNames(%q) = %q, %v, want %q, error %v", tc.list, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParsePollServices(t *testing.T) {
+	got, err := parsePollServices("a, b = 5s", "default", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["a"] != time.Second || got["b"] != 5*time.Second {
+		t.Errorf("parsePollServices() = %v, want a=1s and b=5s", got)
+	}
+	for _, list := range []string{"a,", "=5s", "a=x", "a=-1s"} {
+		if _, err := parsePollServices(list, "default", time.Second); err == nil {
+			t.Errorf("parsePollServices(%q) succeeded, want an error", list)
+		}
+	}
+}
+
+// withListMode sets -list-mode and the -list-filter-prefix filter until the
+// test ends.
+func withListMode(t *testing.T, mode, prefix string) {
+	t.Helper()
+	savedMode, savedFilter := cfg.flListMode, listFilter
+	t.Cleanup(func() { cfg.flListMode, listFilter = savedMode, savedFilter })
+	cfg.flListMode, listFilter = mode, nil
+	if prefix != "" {
+		listFilter = func(s string) bool { return strings.HasPrefix(s, prefix) }
+	}
+}
+
+func TestListFilterCountsOverallHealth(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+	saved := cfg.flServiceName
+	t.Cleanup(func() { cfg.flServiceName = saved })
+	cfg.flServiceName = ""
+
+	for _, mode := range []string{"overall", "auto"} {
+		t.Run(mode, func(t *testing.T) {
+			withListMode(t, mode, "echo")
+			if w := get(u.healthHandler, "/"); w.Code != http.StatusServiceUnavailable {
+				t.Errorf("GET / = %d %s, want 503 for a NOT_SERVING server", w.Code, w.Body.String())
+			}
+			if w := get(u.healthHandler, "/?format=json"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"healthy":false`) {
+				t.Errorf("GET /?format=json = %d %s, want 503 and unhealthy", w.Code, w.Body.String())
+			}
+			if got := runCLI(u.prober); got != probe.StatusUnhealthy {
+				t.Errorf("runCLI() = %d, want %d", got, probe.StatusUnhealthy)
+			}
+		})
+	}
+}
+
+func TestListFilterVerdict(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo.EchoServer", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("other.OtherServer", healthpb.HealthCheckResponse_SERVING)
+	u := newTestUpstream(t, "default", addr)
+	saved := cfg.flServiceName
+	t.Cleanup(func() { cfg.flServiceName = saved })
+	cfg.flServiceName = ""
+
+	for _, tc := range []struct {
+		name   string
+		filter func(string) bool
+		code   int
+		exit   int
+	}{
+		{"prefix selecting the NOT_SERVING service", func(s string) bool { return strings.HasPrefix(s, "echo.") }, http.StatusServiceUnavailable, probe.StatusUnhealthy},
+		{"prefix excluding it", func(s string) bool { return strings.HasPrefix(s, "other.") }, http.StatusOK, 0},
+		{"regex selecting the NOT_SERVING service", regexp.MustCompile(`^echo\.Echo`).MatchString, http.StatusServiceUnavailable, probe.StatusUnhealthy},
+		{"regex excluding it", regexp.MustCompile(`^other\.`).MatchString, http.StatusOK, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withListMode(t, "list", "")
+			listFilter = tc.filter
+			w := get(u.healthHandler, "/")
+			if w.Code != tc.code || !strings.Contains(w.Body.String(), `"echo.EchoServer":{"status":"NOT_SERVING"}`) {
+				t.Errorf("GET / = %d %s, want %d with the full list", w.Code, w.Body.String(), tc.code)
+			}
+			if got := runCLI(u.prober); got != tc.exit {
+				t.Errorf("runCLI() = %d, want %d", got, tc.exit)
+			}
+		})
+	}
+}
+
+func TestListenerNegotiatesHTTP2(t *testing.T) {
+	const certs = "example/certs/"
+	ca, err := os.ReadFile(certs + "CA_crt.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	client, err := tls.LoadX509KeyPair(certs+"client_crt.pem", certs+"client_key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verifyClient := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verify client %v", verifyClient), func(t *testing.T) {
+			cr, err := probe.NewCertReloader("listener", certs+"http_server_crt.pem", certs+"http_server_key.pem", certs+"CA_crt.pem", nil, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv := &http.Server{
+				TLSConfig: listenerTLSConfig(cr, verifyClient, nil),
+				Handler:   http.NotFoundHandler(),
+				ErrorLog:  log.New(io.Discard, "", 0),
+			}
+			go srv.ServeTLS(lis, "", "")
+			t.Cleanup(func() { srv.Close() })
+
+			conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{
+				ServerName:   "http.domain.com",
+				RootCAs:      roots,
+				Certificates: []tls.Certificate{client},
+				NextProtos:   []string{"h2", "http/1.1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+				t.Errorf("negotiated protocol = %q, want h2", p)
+			}
+			if !verifyClient {
+				return
+			}
+			// with TLS 1.3 a missing client certificate fails the first read
+			anon, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{ServerName: "http.domain.com", RootCAs: roots})
+			if err == nil {
+				defer anon.Close()
+				_, err = anon.Read(make([]byte, 1))
+			}
+			if err == nil {
+				t.Errorf("connection without a client certificate succeeded")
+			}
+		})
+	}
+}
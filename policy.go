@@ -0,0 +1,116 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+)
+
+// servicePolicy restricts the service names callers may ask for with
+// ?serviceName=.  A name is allowed unless it is denied, and, if an allow
+// list is given, only if it is on it.
+type servicePolicy struct {
+	allow      map[string]bool
+	allowRegex *regexp.Regexp
+	deny       map[string]bool
+	denyRegex  *regexp.Regexp
+}
+
+func newServicePolicy(allow, allowRegex, deny, denyRegex string) (*servicePolicy, error) {
+	sp := &servicePolicy{
+		allow: splitServices(allow),
+		deny:  splitServices(deny),
+	}
+	// the whole name must match, or echo would allow evil.echo.x and a
+	// deny pattern could be dodged the same way
+	var err error
+	if allowRegex != "" {
+		if sp.allowRegex, err = regexp.Compile(`^(?:` + allowRegex + `)$`); err != nil {
+			return nil, fmt.Errorf("invalid -allow-services-regex: %v", err)
+		}
+	}
+	if denyRegex != "" {
+		if sp.denyRegex, err = regexp.Compile(`^(?:` + denyRegex + `)$`); err != nil {
+			return nil, fmt.Errorf("invalid -deny-services-regex: %v", err)
+		}
+	}
+	return sp, nil
+}
+
+func splitServices(list string) map[string]bool {
+	services := map[string]bool{}
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			services[s] = true
+		}
+	}
+	return services
+}
+
+func (sp *servicePolicy) restricts() bool {
+	return len(sp.allow) > 0 || sp.allowRegex != nil
+}
+
+// allowed reports whether callers may ask for serviceName.
+func (sp *servicePolicy) allowed(serviceName string) bool {
+	if sp.deny[serviceName] || (sp.denyRegex != nil && sp.denyRegex.MatchString(serviceName)) {
+		return false
+	}
+	if !sp.restricts() {
+		return true
+	}
+	return sp.allow[serviceName] || (sp.allowRegex != nil && sp.allowRegex.MatchString(serviceName))
+}
+
+// filterList drops the services callers may not ask for from a List, so the
+// list cannot be used to find them.
+func (sp *servicePolicy) filterList(res *probe.ListResult) {
+	for s := range res.Statuses {
+		// "" is the overall server health of -list-mode overall
+		if s != "" && !sp.allowed(s) {
+			delete(res.Statuses, s)
+		}
+	}
+}
+
+// configuredServices returns the services named on the command line and in
+// -allow-services; they (and the names matching -allow-services-regex) are
+// labelled by name in metrics, any other name as probe.UnknownServiceLabel.
+func configuredServices() []string {
+	services := []string{cfg.flServiceName}
+	for s := range pollServices {
+		services = append(services, s)
+	}
+	services = append(services, watchServices...)
+	for _, spec := range cfg.flServiceGroups {
+		if g, err := probe.ParseGroup(spec); err == nil {
+			for _, m := range g.Members {
+				services = append(services, m.Service)
+			}
+		}
+	}
+	if thresholds != nil {
+		for s := range thresholds.Services {
+			services = append(services, s)
+		}
+	}
+	for s := range servicesPolicy.allow {
+		services = append(services, s)
+	}
+	return services
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// withServicePolicy replaces the global service policy until the test ends.
+func withServicePolicy(t *testing.T, allow, allowRegex, deny, denyRegex string) *servicePolicy {
+	t.Helper()
+	sp, err := newServicePolicy(allow, allowRegex, deny, denyRegex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := servicesPolicy
+	servicesPolicy = sp
+	t.Cleanup(func() { servicesPolicy = saved })
+	return sp
+}
+
+func TestServicePolicyAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name                               string
+		allow, allowRegex, deny, denyRegex string
+		want                               map[string]bool
+	}{
+		{"open", "", "", "", "", map[string]bool{"echo": true, "any": true}},
+		{"allow list", "echo,foo", "", "", "", map[string]bool{"echo": true, "foo": true, "bar": false}},
+		{"allow regex", "", `echo\..*`, "", "", map[string]bool{"echo.v1": true, "echo": false}},
+		{"allow regex matches whole names", "", `echo`, "", "", map[string]bool{"echo": true, "evil.echo.x": false, "echo.x": false, "x.echo": false}},
+		{"allow regex alternatives", "", `echo|foo`, "", "", map[string]bool{"echo": true, "foo": true, "echofoo": false}},
+		{"allow list with spaces", " echo , foo ", "", "", "", map[string]bool{"echo": true, "foo": true, " echo ": false}},
+		{"deny list", "", "", "admin", "", map[string]bool{"admin": false, "echo": true}},
+		{"deny wins", "echo,admin", "", "admin", "", map[string]bool{"admin": false, "echo": true}},
+		{"deny regex", "", `.*`, "", `internal\..*`, map[string]bool{"internal.x": false, "echo": true}},
+		{"deny regex matches whole names", "", "", "", `admin`, map[string]bool{"admin": false, "x.admin": true, "admin.x": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sp, err := newServicePolicy(tc.allow, tc.allowRegex, tc.deny, tc.denyRegex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for s, want := range tc.want {
+				if got := sp.allowed(s); got != want {
+					t.Errorf("allowed(%q) = %v, want %v", s, got, want)
+				}
+			}
+		})
+	}
+	for _, bad := range [][2]string{{"(", ""}, {"", "("}} {
+		if _, err := newServicePolicy("", bad[0], "", bad[1]); err == nil {
+			t.Errorf("newServicePolicy() with regexes %q accepted", bad)
+		}
+	}
+}
+
+func TestServicePolicyFilterList(t *testing.T) {
+	sp, _ := newServicePolicy("echo", "", "", "")
+	res := &probe.ListResult{Statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"":       healthpb.HealthCheckResponse_SERVING,
+		"echo":   healthpb.HealthCheckResponse_SERVING,
+		"hidden": healthpb.HealthCheckResponse_NOT_SERVING,
+	}}
+	sp.filterList(res)
+	if _, ok := res.Statuses["hidden"]; ok || len(res.Statuses) != 2 {
+		t.Errorf("filterList() = %v, want the overall status and echo", res.Statuses)
+	}
+}
+
+func TestConfiguredServices(t *testing.T) {
+	withServicePolicy(t, "allowed", "", "", "")
+	saved, savedPoll, savedWatch := *cfg, pollServices, watchServices
+	t.Cleanup(func() { *cfg, pollServices, watchServices = saved, savedPoll, savedWatch })
+	cfg.flServiceName = "default"
+	cfg.flPollServices = "polled=5s, other"
+	cfg.flWatchServices = "watched, second"
+	cfg.flServiceGroups = stringSliceFlag{"web=all:member"}
+	var err error
+	if pollServices, err = parsePollServices(cfg.flPollServices, cfg.flServiceName, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if watchServices, err = parseServiceNames(cfg.flWatchServices); err != nil {
+		t.Fatal(err)
+	}
+
+	got := configuredServices()
+	for _, s := range []string{"default", "polled", "other", "watched", "second", "member", "allowed"} {
+		if !slices.Contains(got, s) {
+			t.Errorf("configuredServices() = %v, want %s in it", got, s)
+		}
+	}
+	for _, s := range got {
+		if s != strings.TrimSpace(s) {
+			t.Errorf("configuredServices() = %q, want names without spaces", got)
+		}
+	}
+}
+
+func TestHealthHandlerPolicy(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("hidden", healthpb.HealthCheckResponse_SERVING)
+	withServicePolicy(t, "echo", "", "", "")
+	u := newTestUpstream(t, "default", addr)
+
+	for target, want := range map[string]int{
+		"/?serviceName=echo":                      http.StatusOK,
+		"/?serviceName=hidden":                    http.StatusForbidden,
+		"/?serviceName=echo&serviceName=hidden":   http.StatusForbidden,
+		"/?serviceName=hidden&format=json":        http.StatusForbidden,
+		"/?serviceName=echo&serviceName=echo&x=1": http.StatusOK,
+	} {
+		w := get(u.healthHandler, target)
+		if w.Code != want {
+			t.Errorf("GET %s = %d %q, want %d", target, w.Code, w.Body.String(), want)
+		}
+		if want == http.StatusForbidden && w.Header().Get(probeErrorReasonHeader) != limitPolicy {
+			t.Errorf("GET %s reason = %q, want %q", target, w.Header().Get(probeErrorReasonHeader), limitPolicy)
+		}
+	}
+	if w := get(u.healthHandler, "/"); w.Code != http.StatusOK || w.Body.String() != `{"statuses":{"":{"status":"SERVING"},"echo":{"status":"SERVING"}}}` {
+		t.Errorf("GET / = %d %s, want hidden left out of the list", w.Code, w.Body.String())
+	}
+}
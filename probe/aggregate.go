@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	PolicyAll    = "all"
+	PolicyAny    = "any"
+	PolicyQuorum = "quorum"
+)
+
+// Policy combines the results of several services into one verdict.
+type Policy struct {
+	// Mode is one of PolicyAll, PolicyAny or PolicyQuorum.
+	Mode string
+	// Quorum is the number of healthy services PolicyQuorum requires.
+	Quorum int
+}
+
+// ParsePolicy parses "all", "any" or "quorum=N".
+func ParsePolicy(s string) (Policy, error) {
+	switch {
+	case s == PolicyAll || s == "":
+		return Policy{Mode: PolicyAll}, nil
+	case s == PolicyAny:
+		return Policy{Mode: PolicyAny}, nil
+	case strings.HasPrefix(s, PolicyQuorum+"="):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, PolicyQuorum+"="))
+		if err != nil || n <= 0 {
+			return Policy{}, fmt.Errorf("invalid quorum in policy %q", s)
+		}
+		return Policy{Mode: PolicyQuorum, Quorum: n}, nil
+	}
+	return Policy{}, fmt.Errorf("unknown policy %q (must be all, any or quorum=N)", s)
+}
+
+func (p Policy) String() string {
+	if p.Mode == PolicyQuorum {
+		return fmt.Sprintf("%s=%d", PolicyQuorum, p.Quorum)
+	}
+	return p.Mode
+}
+
+// GroupMember is one service of a Group.
+type GroupMember struct {
+	Service string
+	// Critical members must be healthy for the group to be healthy,
+	// regardless of the policy.
+	Critical bool
+}
+
+// Group is a set of services checked together and combined with a Policy.
+type Group struct {
+	Name    string
+	Policy  Policy
+	Members []GroupMember
+}
+
+// ParseGroup parses a group definition of the form
+// "name=policy:service1,!service2", where a leading "!" marks a critical
+// service.  The policy may be empty, which means "all".
+func ParseGroup(spec string) (*Group, error) {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid group %q (must be name=policy:service,...)", spec)
+	}
+	policy, list, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid group %q (must be name=policy:service,...)", spec)
+	}
+	g := &Group{Name: name}
+	var err error
+	if g.Policy, err = ParsePolicy(policy); err != nil {
+		return nil, fmt.Errorf("group %s: %v", name, err)
+	}
+	for _, s := range strings.Split(list, ",") {
+		m := GroupMember{Service: strings.TrimSpace(s)}
+		if strings.HasPrefix(m.Service, "!") {
+			m.Service = strings.TrimPrefix(m.Service, "!")
+			m.Critical = true
+		}
+		if m.Service == "" {
+			return nil, fmt.Errorf("group %s: empty service name", name)
+		}
+		g.Members = append(g.Members, m)
+	}
+	if g.Policy.Mode == PolicyQuorum && g.Policy.Quorum > len(g.Members) {
+		return nil, fmt.Errorf("group %s: quorum %d exceeds the %d services in the group", name, g.Policy.Quorum, len(g.Members))
+	}
+	return g, nil
+}
+
+// MemberResult is the outcome of checking one GroupMember.
+type MemberResult struct {
+	GroupMember
+	Result *Result
+	Err    error
+}
+
+// Healthy reports whether the member is SERVING.
+func (m MemberResult) Healthy() bool {
+	return m.Err == nil && m.Result != nil && m.Result.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// GroupResult is the combined outcome of checking a Group.
+type GroupResult struct {
+	Group   *Group
+	Healthy bool
+	Members []MemberResult
+}
+
+// CheckGroup checks every member of g in parallel with c and combines the
+// results with the group's policy.
+func CheckGroup(ctx context.Context, c Checker, g *Group) *GroupResult {
+	gr := &GroupResult{
+		Group:   g,
+		Members: make([]MemberResult, len(g.Members)),
+	}
+
+	var wg sync.WaitGroup
+	for i, m := range g.Members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Check(ctx, m.Service)
+			gr.Members[i] = MemberResult{GroupMember: m, Result: res, Err: err}
+		}()
+	}
+	wg.Wait()
+
+	healthy := 0
+	criticalOK := true
+	for _, m := range gr.Members {
+		if m.Healthy() {
+			healthy++
+		} else if m.Critical {
+			criticalOK = false
+		}
+	}
+	switch g.Policy.Mode {
+	case PolicyAny:
+		gr.Healthy = healthy > 0
+	case PolicyQuorum:
+		gr.Healthy = healthy >= g.Policy.Quorum
+	default:
+		gr.Healthy = healthy == len(gr.Members)
+	}
+	gr.Healthy = gr.Healthy && criticalOK
+	return gr
+}
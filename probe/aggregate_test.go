@@ -0,0 +1,110 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// statusChecker is a Checker answering from a fixed map of statuses; other
+// services fail with StatusServiceNotFound.
+type statusChecker map[string]healthpb.HealthCheckResponse_ServingStatus
+
+func (c statusChecker) Check(ctx context.Context, serviceName string) (*Result, error) {
+	st, ok := c[serviceName]
+	if !ok {
+		return &Result{Service: serviceName, Status: healthpb.HealthCheckResponse_SERVICE_UNKNOWN}, NewGrpcProbeError(StatusServiceNotFound, "StatusServiceNotFound")
+	}
+	return &Result{Service: serviceName, Status: st}, nil
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    Policy
+		wantErr bool
+	}{
+		{"", Policy{Mode: PolicyAll}, false},
+		{"all", Policy{Mode: PolicyAll}, false},
+		{"any", Policy{Mode: PolicyAny}, false},
+		{"quorum=2", Policy{Mode: PolicyQuorum, Quorum: 2}, false},
+		{"quorum=0", Policy{}, true},
+		{"quorum=x", Policy{}, true},
+		{"most", Policy{}, true},
+	} {
+		got, err := ParsePolicy(tc.in)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("ParsePolicy(%q) = %v, %v, want %v (error %v)", tc.in, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestParseGroup(t *testing.T) {
+	g, err := ParseGroup("web=quorum=2:a, !b,c")
+	if err != nil {
+		t.Fatalf("ParseGroup() error = %v", err)
+	}
+	want := []GroupMember{{Service: "a"}, {Service: "b", Critical: true}, {Service: "c"}}
+	if g.Name != "web" || g.Policy.String() != "quorum=2" || len(g.Members) != len(want) {
+		t.Fatalf("ParseGroup() = %+v", g)
+	}
+	for i, m := range want {
+		if g.Members[i] != m {
+			t.Errorf("member %d = %+v, want %+v", i, g.Members[i], m)
+		}
+	}
+
+	for _, spec := range []string{"web", "=all:a", "web=all", "web=most:a", "web=all:a,,b", "web=quorum=3:a,b"} {
+		if _, err := ParseGroup(spec); err == nil {
+			t.Errorf("ParseGroup(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestCheckGroup(t *testing.T) {
+	c := statusChecker{
+		"up1":  healthpb.HealthCheckResponse_SERVING,
+		"up2":  healthpb.HealthCheckResponse_SERVING,
+		"down": healthpb.HealthCheckResponse_NOT_SERVING,
+	}
+	for _, tc := range []struct {
+		spec string
+		want bool
+	}{
+		{"g=all:up1,up2", true},
+		{"g=all:up1,down", false},
+		{"g=any:down,up1", true},
+		{"g=any:down,missing", false},
+		{"g=quorum=2:up1,up2,down", true},
+		{"g=quorum=2:up1,down,missing", false},
+		{"g=any:up1,!down", false},
+		{"g=quorum=1:!up1,down", true},
+	} {
+		g, err := ParseGroup(tc.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gr := CheckGroup(context.Background(), c, g)
+		if gr.Healthy != tc.want {
+			t.Errorf("CheckGroup(%s).Healthy = %v, want %v", tc.spec, gr.Healthy, tc.want)
+		}
+		if len(gr.Members) != len(g.Members) {
+			t.Errorf("CheckGroup(%s) returned %d members, want %d", tc.spec, len(gr.Members), len(g.Members))
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Values of Result.Cache.
+const (
+	CacheMiss      = "MISS"
+	CacheHit       = "HIT"
+	CacheCoalesced = "COALESCED"
+)
+
+// CacheConfig configures a Cache.
+type CacheConfig struct {
+	// Coalesce makes concurrent checks of a service share one in-flight
+	// check.
+	Coalesce bool
+	// PositiveTTL is how long a SERVING result is reused; NegativeTTL is
+	// how long any other result or error is reused.  Zero disables caching
+	// of the respective results.
+	PositiveTTL time.Duration
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of cached results; the least recently
+	// used one is dropped to make room.  Zero means no limit.
+	MaxEntries int
+}
+
+type cacheCall struct {
+	done chan struct{}
+	res  *Result
+	err  error
+}
+
+type cacheEntry struct {
+	res     *Result
+	err     error
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache wraps a Checker to deduplicate concurrent checks of the same
+// service and to reuse results for a short time.  Expired results are
+// dropped when they are next read or by the sweep started with Start.
+type Cache struct {
+	prober  *Prober
+	checker Checker
+	cfg     CacheConfig
+
+	mu       sync.Mutex
+	inflight map[string]*cacheCall
+	entries  *LRU[*cacheEntry]
+}
+
+// NewCache returns a Cache for c, which checks p.
+func NewCache(p *Prober, c Checker, cfg CacheConfig) *Cache {
+	return &Cache{
+		prober:   p,
+		checker:  c,
+		cfg:      cfg,
+		inflight: map[string]*cacheCall{},
+		entries:  NewLRU[*cacheEntry](cfg.MaxEntries),
+	}
+}
+
+// Start launches a goroutine that drops expired results until ctx is
+// cancelled, so that results of services that are not checked again do not
+// pile up.
+func (c *Cache) Start(ctx context.Context) {
+	interval := max(c.cfg.PositiveTTL, c.cfg.NegativeTTL)
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c.sweep(now)
+			}
+		}
+	}()
+}
+
+// sweep drops the results that expired before now.
+func (c *Cache) sweep(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.RemoveFunc(func(e *cacheEntry) bool { return !now.Before(e.expires) })
+}
+
+// Check returns a cached result for serviceName if there is a fresh one,
+// waits for an in-flight check of serviceName if there is one, and checks
+// it with the wrapped Checker otherwise.  The Cache field of the result
+// says which.
+func (c *Cache) Check(ctx context.Context, serviceName string) (*Result, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	if e, ok := c.entries.Get(serviceName); ok {
+		if now.Before(e.expires) {
+			c.mu.Unlock()
+			cacheRequests.WithLabelValues(c.prober.name, c.prober.serviceLabel(serviceName), CacheHit).Inc()
+			out := *e.res
+			out.Cache, out.Age = CacheHit, now.Sub(e.stored)
+			return &out, e.err
+		}
+		c.entries.Remove(serviceName)
+	}
+	if call, ok := c.inflight[serviceName]; ok {
+		c.mu.Unlock()
+		cacheRequests.WithLabelValues(c.prober.name, c.prober.serviceLabel(serviceName), CacheCoalesced).Inc()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return &Result{
+				Service: serviceName,
+				Status:  healthpb.HealthCheckResponse_UNKNOWN,
+				Time:    now,
+			}, NewGrpcProbeError(StatusCanceled, "StatusCanceled")
+		}
+		out := *call.res
+		out.Cache = CacheCoalesced
+		return &out, call.err
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	if c.cfg.Coalesce {
+		c.inflight[serviceName] = call
+		// the check is shared, so it must not be cut short by this caller
+		ctx = context.WithoutCancel(ctx)
+	}
+	c.mu.Unlock()
+
+	cacheRequests.WithLabelValues(c.prober.name, c.prober.serviceLabel(serviceName), CacheMiss).Inc()
+	call.res, call.err = c.checker.Check(ctx, serviceName)
+
+	ttl := c.cfg.NegativeTTL
+	switch {
+	case errors.Is(call.err, ErrCheckRejected):
+		ttl = 0
+	case call.err == nil && call.res.Status == healthpb.HealthCheckResponse_SERVING:
+		ttl = c.cfg.PositiveTTL
+	}
+	stored := time.Now()
+	c.mu.Lock()
+	if ttl > 0 {
+		c.entries.Add(serviceName, &cacheEntry{res: call.res, err: call.err, stored: stored, expires: stored.Add(ttl)})
+	}
+	delete(c.inflight, serviceName)
+	c.mu.Unlock()
+	close(call.done)
+
+	out := *call.res
+	out.Cache = CacheMiss
+	return &out, call.err
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// countingChecker counts the checks that reach it and, if gate is set,
+// blocks them until gate is closed.
+type countingChecker struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+	gate   chan struct{}
+	calls  atomic.Int32
+}
+
+func (c *countingChecker) Check(ctx context.Context, serviceName string) (*Result, error) {
+	c.calls.Add(1)
+	if c.gate != nil {
+		<-c.gate
+	}
+	return &Result{Service: serviceName, Status: c.status, Time: time.Now()}, nil
+}
+
+func newTestCache(c Checker, cfg CacheConfig) *Cache {
+	return NewCache(&Prober{name: "test", logger: discardLogger}, c, cfg)
+}
+
+func TestCacheHitMissExpiry(t *testing.T) {
+	c := &countingChecker{status: healthpb.HealthCheckResponse_SERVING}
+	cache := newTestCache(c, CacheConfig{PositiveTTL: 100 * time.Millisecond})
+
+	for i, want := range []string{CacheMiss, CacheHit, CacheHit} {
+		res, err := cache.Check(context.Background(), "echo")
+		if err != nil || res.Cache != want {
+			t.Fatalf("check %d = %s, %v, want %s", i, res.Cache, err, want)
+		}
+	}
+	if res, _ := cache.Check(context.Background(), "other"); res.Cache != CacheMiss {
+		t.Errorf("other service = %s, want MISS", res.Cache)
+	}
+	if n := c.calls.Load(); n != 2 {
+		t.Errorf("%d checks reached the upstream, want 2", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if res, _ := cache.Check(context.Background(), "echo"); res.Cache != CacheMiss {
+		t.Errorf("check after expiry = %s, want MISS", res.Cache)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	c := &countingChecker{status: healthpb.HealthCheckResponse_NOT_SERVING}
+	cache := newTestCache(c, CacheConfig{PositiveTTL: time.Minute})
+	cache.Check(context.Background(), "echo")
+	if res, _ := cache.Check(context.Background(), "echo"); res.Cache != CacheMiss {
+		t.Errorf("NOT_SERVING without -cache-negative-ttl = %s, want MISS", res.Cache)
+	}
+
+	cache = newTestCache(c, CacheConfig{NegativeTTL: time.Minute})
+	cache.Check(context.Background(), "echo")
+	if res, _ := cache.Check(context.Background(), "echo"); res.Cache != CacheHit || res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("NOT_SERVING with a negative ttl = %s %v, want a NOT_SERVING HIT", res.Cache, res.Status)
+	}
+}
+
+func TestCacheCoalesce(t *testing.T) {
+	for _, coalesce := range []bool{true, false} {
+		c := &countingChecker{status: healthpb.HealthCheckResponse_SERVING, gate: make(chan struct{})}
+		cache := newTestCache(c, CacheConfig{Coalesce: coalesce})
+
+		const n = 5
+		results := make(chan string, n)
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, _ := cache.Check(context.Background(), "echo")
+				results <- res.Cache
+			}()
+		}
+		wantCalls := int32(n)
+		if coalesce {
+			wantCalls = 1
+		}
+		// let the other requests reach the cache before the check completes
+		for c.calls.Load() < wantCalls {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(c.gate)
+		wg.Wait()
+		close(results)
+
+		counts := map[string]int{}
+		for r := range results {
+			counts[r]++
+		}
+		want := map[string]int{CacheMiss: n}
+		if coalesce {
+			want = map[string]int{CacheMiss: 1, CacheCoalesced: n - 1}
+		}
+		if got := c.calls.Load(); got != wantCalls || counts[CacheMiss] != want[CacheMiss] || counts[CacheCoalesced] != want[CacheCoalesced] {
+			t.Errorf("coalesce=%v: %d upstream checks and results %v, want %d and %v", coalesce, got, counts, wantCalls, want)
+		}
+	}
+}
+
+func TestCacheCoalescedCallerCancel(t *testing.T) {
+	c := &countingChecker{status: healthpb.HealthCheckResponse_SERVING, gate: make(chan struct{})}
+	defer close(c.gate)
+	cache := newTestCache(c, CacheConfig{Coalesce: true})
+	go cache.Check(context.Background(), "echo")
+	for c.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := cache.Check(ctx, "echo")
+	if pe, ok := err.(*GrpcProbeError); !ok || pe.Code != StatusCanceled {
+		t.Errorf("cancelled waiter error = %v, want StatusCanceled", err)
+	}
+}
+
+func TestCacheBounded(t *testing.T) {
+	c := &countingChecker{status: healthpb.HealthCheckResponse_SERVING}
+	cache := newTestCache(c, CacheConfig{PositiveTTL: time.Minute, MaxEntries: 2})
+	for _, s := range []string{"a", "b", "a", "c"} {
+		cache.Check(context.Background(), s)
+	}
+	if n := cache.entries.Len(); n != 2 {
+		t.Errorf("%d results cached, want 2", n)
+	}
+	if res, _ := cache.Check(context.Background(), "a"); res.Cache != CacheHit {
+		t.Errorf("a = %s, want HIT as it was used recently", res.Cache)
+	}
+	if res, _ := cache.Check(context.Background(), "b"); res.Cache != CacheMiss {
+		t.Errorf("b = %s, want MISS as the least recently used result", res.Cache)
+	}
+}
+
+func TestCacheSweep(t *testing.T) {
+	c := &countingChecker{status: healthpb.HealthCheckResponse_SERVING}
+	cache := newTestCache(c, CacheConfig{PositiveTTL: 20 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cache.Start(ctx)
+	for _, s := range []string{"a", "b", "c"} {
+		cache.Check(context.Background(), s)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		cache.mu.Lock()
+		n := cache.entries.Len()
+		cache.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d expired results left after a second, want them swept", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rejectingChecker rejects every check without contacting the upstream.
+type rejectingChecker struct{}
+
+func (rejectingChecker) Check(ctx context.Context, serviceName string) (*Result, error) {
+	return &Result{Service: serviceName, Status: healthpb.HealthCheckResponse_UNKNOWN, Time: time.Now()}, ErrCheckRejected
+}
+
+func TestCacheDoesNotStoreRejections(t *testing.T) {
+	cache := newTestCache(rejectingChecker{}, CacheConfig{NegativeTTL: time.Minute})
+	for range 2 {
+		if res, err := cache.Check(context.Background(), "echo"); res.Cache != CacheMiss || !errors.Is(err, ErrCheckRejected) {
+			t.Errorf("rejected check = %s, %v, want an uncached MISS", res.Cache, err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+var connStates = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+// watchState follows the connectivity state of the shared upstream
+// connection until ctx is cancelled, exporting every transition as a metric
+// and a log line.  A connection flapping between CONNECTING and
+// TRANSIENT_FAILURE means the backend is unreachable; frequent READY
+// transitions mean the connection is being re-established.
+func (p *Prober) watchState(ctx context.Context) {
+	state := p.conn.GetState()
+	for {
+		for _, s := range connStates {
+			v := 0.0
+			if s == state {
+				v = 1
+			}
+			connState.WithLabelValues(p.name, s.String()).Set(v)
+		}
+		connTransitions.WithLabelValues(p.name, state.String()).Inc()
+		if state == connectivity.Ready {
+			p.recordTransportError(nil)
+		}
+		if state == connectivity.TransientFailure {
+			p.logger.Warn("upstream connection state changed", slog.String("addr", p.cfg.Addr), slog.String("state", state.String()))
+		} else {
+			p.logger.Info("upstream connection state changed", slog.String("addr", p.cfg.Addr), slog.String("state", state.String()))
+		}
+
+		if !p.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		state = p.conn.GetState()
+	}
+}
+
+// connect waits up to ConnTimeout for the shared connection to become READY,
+// kicking it out of IDLE if needed.  A connection in TRANSIENT_FAILURE is
+// given the rest of the timeout to recover.
+func (p *Prober) connect(ctx context.Context) (established bool, pe *GrpcProbeError) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.ConnTimeout)
+	defer cancel()
+
+	var lookup chan error
+	for {
+		state := p.conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return established, nil
+		case connectivity.Idle:
+			p.conn.Connect()
+		case connectivity.Shutdown:
+			pe = NewGrpcProbeError(StatusConnectionFailure, "StatusConnectionFailure")
+			pe.Cause = errors.New("connection is shut down")
+			return false, pe
+		case connectivity.TransientFailure:
+			if lookup == nil && p.lastTransportError() == nil {
+				// the dialer was never reached, so name resolution may be
+				// failing; find out within the same timeout
+				lookup = make(chan error, 1)
+				go func() { lookup <- p.lookupHost(ctx) }()
+			}
+		}
+		established = true
+		if !p.conn.WaitForStateChange(ctx, state) {
+			pe = p.connectError(lookup)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				p.logger.Warn("timeout: failed to connect service", slog.String("addr", p.cfg.Addr), slog.Duration("conn_timeout", p.cfg.ConnTimeout), slog.String("state", state.String()), slog.String("reason", pe.Reason), slog.String("detail", pe.Detail()))
+			} else {
+				p.logger.Warn("error: failed to connect service", slog.String("addr", p.cfg.Addr), slog.String("err", ctx.Err().Error()))
+			}
+			return false, pe
+		}
+	}
+}
+
+// connectError attributes a failed connect to the last dial or handshake
+// error or, if the dialer was never reached, to the name lookup started by
+// connect, if it has failed by now.
+func (p *Prober) connectError(lookup chan error) *GrpcProbeError {
+	err := p.lastTransportError()
+	if err == nil && lookup != nil {
+		select {
+		case err = <-lookup:
+		default:
+		}
+	}
+	if err == nil {
+		pe := NewGrpcProbeError(StatusConnectionFailure, "StatusConnectionFailure")
+		pe.Reason = ReasonConnectTimeout
+		return pe
+	}
+	return classifyTransportError(err)
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"crypto/tls"
+	"log/slog"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// buildGrpcCredentials returns the upstream TransportCredentials, and the
+// CertReloader of the client certificate, CA bundle, pins and CRLs if
+// TLSReloadInterval is set.
+func buildGrpcCredentials(name string, cfg Config, logger *slog.Logger) (credentials.TransportCredentials, *CertReloader, error) {
+	var tlsCfg tls.Config
+
+	caFile := cfg.TLSCACert
+	if cfg.TLSNoVerify {
+		tlsCfg.InsecureSkipVerify = true
+		caFile = ""
+	}
+	if cfg.TLSServerName != "" {
+		tlsCfg.ServerName = cfg.TLSServerName
+	}
+	files, err := newCertReloader(name, cfg.TLSClientCert, cfg.TLSClientKey, caFile, cfg.TLSPinsFile, cfg.Revocation.CRLFiles, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier, err := newUpstreamVerifier(cfg, files)
+	if err != nil {
+		return nil, nil, err
+	}
+	if verifier != nil {
+		if verifier.verifiesIdentity() {
+			// the default verification checks the host name; verify does
+			// the rest of it and checks the identity instead
+			tlsCfg.InsecureSkipVerify = true
+		}
+		tlsCfg.VerifyConnection = verifier.verify
+	}
+	if cfg.TLSReloadInterval > 0 && len(files.files()) > 0 {
+		return &reloadingCreds{TransportCredentials: credentials.NewTLS(&tlsCfg), base: &tlsCfg, files: files}, files, nil
+	}
+
+	if cert := files.Certificate(); cert != nil {
+		tlsCfg.Certificates = []tls.Certificate{*cert}
+	}
+	tlsCfg.RootCAs = files.CertPool()
+	return credentials.NewTLS(&tlsCfg), nil, nil
+}
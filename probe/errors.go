@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCheckRejected is returned by a Checker that refused a check without
+// contacting the upstream, eg to stay within a concurrency limit.  It says
+// nothing about the service, so Cache and Hysteresis pass it through
+// without recording it.
+var ErrCheckRejected = errors.New("probe: check rejected")
+
+// GrpcProbeError is returned by a Prober when a probe could not produce a
+// health status.  Code is one of the Status* constants below and doubles as
+// the CLI exit code.
+type GrpcProbeError struct {
+	Code    int
+	Message string
+
+	// GrpcCode and GrpcMessage are the status of the failed rpc, if the
+	// error came from one.
+	GrpcCode    codes.Code
+	GrpcMessage string
+	// RetryAfter is the delay the server asked for before retrying (from
+	// the grpc-retry-pushback-ms trailer), if any.
+	RetryAfter time.Duration
+
+	// Reason narrows down why the probe failed (eg ReasonTCPRefused); it is
+	// empty for errors that are not transport or rpc failures.
+	Reason string
+	// Cause is the underlying dial, handshake or rpc error, if any.
+	Cause error
+}
+
+func NewGrpcProbeError(code int, message string) *GrpcProbeError {
+	return &GrpcProbeError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *GrpcProbeError) Error() string {
+	return e.Message
+}
+
+func (e *GrpcProbeError) Unwrap() error {
+	return e.Cause
+}
+
+// Detail returns the text of Cause, or "" if there is none.
+func (e *GrpcProbeError) Detail() string {
+	if e.Cause == nil {
+		return ""
+	}
+	return e.Cause.Error()
+}
+
+const (
+	StatusConnectionFailure = 1
+	StatusRPCFailure        = 2
+	StatusServiceNotFound   = 3
+	StatusUnimplemented     = 4
+	StatusUnhealthy         = 5
+	// StatusStale is returned by a Poller when the cached result for a
+	// service is older than the configured staleness limit.
+	StatusStale = 6
+	// the remaining codes classify failed health rpcs by their gRPC status
+	StatusUnavailable       = 7
+	StatusUnauthenticated   = 8
+	StatusPermissionDenied  = 9
+	StatusResourceExhausted = 10
+	StatusCanceled          = 11
+	StatusServerError       = 12
+	// the remaining codes classify connection failures by the step of
+	// connection setup that failed
+	StatusDNSFailure = 13
+	StatusTCPFailure = 14
+	StatusTLSFailure = 15
+	// StatusTLSPinMismatch is a TLS handshake that failed because no
+	// certificate of the upstream matched an SPKI pin.
+	StatusTLSPinMismatch = 16
+)
+
+// Reasons reported in GrpcProbeError.Reason.
+const (
+	ReasonConnectTimeout       = "connect_timeout"
+	ReasonDNSNotFound          = "dns_not_found"
+	ReasonDNSTimeout           = "dns_timeout"
+	ReasonDNSError             = "dns_error"
+	ReasonTCPRefused           = "tcp_refused"
+	ReasonTCPUnreachable       = "tcp_unreachable"
+	ReasonTCPTimeout           = "tcp_timeout"
+	ReasonTCPError             = "tcp_error"
+	ReasonTLSCertExpired       = "tls_cert_expired"
+	ReasonTLSHostnameMismatch  = "tls_hostname_mismatch"
+	ReasonTLSIdentityMismatch  = "tls_identity_mismatch"
+	ReasonTLSUnknownAuthority  = "tls_unknown_authority"
+	ReasonTLSPinMismatch       = "tls_pin_mismatch"
+	ReasonTLSRevoked           = "tls_revoked"
+	ReasonTLSRevocationUnknown = "tls_revocation_unknown"
+	ReasonTLSHandshake         = "tls_handshake"
+	ReasonRPC                  = "rpc"
+)
+
+var statusNames = map[int]string{
+	StatusConnectionFailure: "StatusConnectionFailure",
+	StatusRPCFailure:        "StatusRPCFailure",
+	StatusServiceNotFound:   "StatusServiceNotFound",
+	StatusUnimplemented:     "StatusUnimplemented",
+	StatusUnhealthy:         "StatusUnhealthy",
+	StatusStale:             "StatusStale",
+	StatusUnavailable:       "StatusUnavailable",
+	StatusUnauthenticated:   "StatusUnauthenticated",
+	StatusPermissionDenied:  "StatusPermissionDenied",
+	StatusResourceExhausted: "StatusResourceExhausted",
+	StatusCanceled:          "StatusCanceled",
+	StatusServerError:       "StatusServerError",
+	StatusDNSFailure:        "StatusDNSFailure",
+	StatusTCPFailure:        "StatusTCPFailure",
+	StatusTLSFailure:        "StatusTLSFailure",
+	StatusTLSPinMismatch:    "StatusTLSPinMismatch",
+}
+
+// grpcCodeStatus classifies the gRPC status of a failed health rpc.  Codes
+// that indicate a malformed or rejected request map to StatusRPCFailure.
+var grpcCodeStatus = map[codes.Code]int{
+	codes.Canceled:           StatusCanceled,
+	codes.Unknown:            StatusServerError,
+	codes.InvalidArgument:    StatusRPCFailure,
+	codes.DeadlineExceeded:   StatusRPCFailure,
+	codes.NotFound:           StatusServiceNotFound,
+	codes.AlreadyExists:      StatusRPCFailure,
+	codes.PermissionDenied:   StatusPermissionDenied,
+	codes.ResourceExhausted:  StatusResourceExhausted,
+	codes.FailedPrecondition: StatusRPCFailure,
+	codes.Aborted:            StatusRPCFailure,
+	codes.OutOfRange:         StatusRPCFailure,
+	codes.Unimplemented:      StatusUnimplemented,
+	codes.Internal:           StatusServerError,
+	codes.Unavailable:        StatusUnavailable,
+	codes.DataLoss:           StatusServerError,
+	codes.Unauthenticated:    StatusUnauthenticated,
+}
+
+// classifyRPCError converts the error of a failed health rpc into a
+// *GrpcProbeError.  trailer is the rpc's trailer metadata, which may carry a
+// retry pushback.
+func classifyRPCError(err error, trailer metadata.MD) *GrpcProbeError {
+	stat := status.Convert(err)
+	code, ok := grpcCodeStatus[stat.Code()]
+	if !ok {
+		code = StatusRPCFailure
+	}
+	pe := NewGrpcProbeError(code, StatusName(code))
+	pe.GrpcCode = stat.Code()
+	pe.GrpcMessage = stat.Message()
+	pe.Reason = ReasonRPC
+	pe.Cause = err
+	if v := trailer.Get("grpc-retry-pushback-ms"); len(v) > 0 {
+		if ms, err := strconv.ParseInt(v[0], 10, 64); err == nil && ms >= 0 {
+			pe.RetryAfter = time.Duration(ms) * time.Millisecond
+		}
+	}
+	return pe
+}
+
+// StatusName returns the name of a Status* code, eg "StatusRPCFailure".
+func StatusName(code int) string {
+	if n, ok := statusNames[code]; ok {
+		return n
+	}
+	return fmt.Sprintf("Status(%d)", code)
+}
+
+// StatusNames returns the sorted names of all Status* codes.
+func StatusNames() []string {
+	names := make([]string, 0, len(statusNames))
+	for _, n := range statusNames {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
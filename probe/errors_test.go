@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyRPCError(t *testing.T) {
+	for c, want := range map[codes.Code]int{
+		codes.Canceled:           StatusCanceled,
+		codes.Unknown:            StatusServerError,
+		codes.InvalidArgument:    StatusRPCFailure,
+		codes.DeadlineExceeded:   StatusRPCFailure,
+		codes.NotFound:           StatusServiceNotFound,
+		codes.AlreadyExists:      StatusRPCFailure,
+		codes.PermissionDenied:   StatusPermissionDenied,
+		codes.ResourceExhausted:  StatusResourceExhausted,
+		codes.FailedPrecondition: StatusRPCFailure,
+		codes.Aborted:            StatusRPCFailure,
+		codes.OutOfRange:         StatusRPCFailure,
+		codes.Unimplemented:      StatusUnimplemented,
+		codes.Internal:           StatusServerError,
+		codes.Unavailable:        StatusUnavailable,
+		codes.DataLoss:           StatusServerError,
+		codes.Unauthenticated:    StatusUnauthenticated,
+		codes.Code(42):           StatusRPCFailure,
+	} {
+		pe := classifyRPCError(status.Error(c, "boom"), nil)
+		if pe.Code != want || pe.Message != StatusName(want) {
+			t.Errorf("classifyRPCError(%v) = %d %q, want %d %q", c, pe.Code, pe.Message, want, StatusName(want))
+		}
+		if pe.GrpcCode != c || pe.GrpcMessage != "boom" || pe.Reason != ReasonRPC {
+			t.Errorf("classifyRPCError(%v) = %+v, want the grpc status and reason rpc", c, pe)
+		}
+	}
+}
+
+func TestClassifyRPCErrorRetryPushback(t *testing.T) {
+	for _, tc := range []struct {
+		trailer string
+		want    time.Duration
+	}{
+		{"1500", 1500 * time.Millisecond},
+		{"0", 0},
+		{"-1", 0},
+		{"soon", 0},
+	} {
+		pe := classifyRPCError(status.Error(codes.ResourceExhausted, "slow down"), metadata.Pairs("grpc-retry-pushback-ms", tc.trailer))
+		if pe.RetryAfter != tc.want {
+			t.Errorf("RetryAfter with pushback %q = %v, want %v", tc.trailer, pe.RetryAfter, tc.want)
+		}
+	}
+}
+
+func TestStatusName(t *testing.T) {
+	if got := StatusName(StatusUnhealthy); got != "StatusUnhealthy" {
+		t.Errorf("StatusName(StatusUnhealthy) = %q", got)
+	}
+	if got := StatusName(99); got != "Status(99)" {
+		t.Errorf("StatusName(99) = %q", got)
+	}
+	names := StatusNames()
+	for i := 1; i < len(names); i++ {
+		if names[i-1] >= names[i] {
+			t.Fatalf("StatusNames() = %v, want sorted unique names", names)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const feedSubscriberBuffer = 16
+
+// Event is a single health status transition published to a Feed.
+type Event struct {
+	// ID increases monotonically across all services of a Feed.
+	ID      uint64
+	Service string
+	Status  healthpb.HealthCheckResponse_ServingStatus
+	Time    time.Time
+	// Error is the probe error class (eg "StatusRPCFailure"), or empty if
+	// the status was obtained successfully.
+	Error string
+}
+
+type subscriber struct {
+	service string
+	ch      chan Event
+}
+
+// Feed fans out health status transitions to subscribers.  Pollers and
+// Watchers publish to it when their PollConfig/WatchConfig Feed is set.  A
+// bounded history of events is retained so that reconnecting subscribers
+// can resume from the last event they saw.
+type Feed struct {
+	mu      sync.Mutex
+	seq     uint64
+	size    int
+	history []Event
+	last    map[string]Event
+	subs    map[*subscriber]struct{}
+}
+
+// NewFeed returns a Feed that retains the last size events for resuming.
+func NewFeed(size int) *Feed {
+	return &Feed{
+		size: size,
+		last: map[string]Event{},
+		subs: map[*subscriber]struct{}{},
+	}
+}
+
+// publish records the outcome of a check and notifies subscribers if the
+// status or error class of the service changed.
+func (f *Feed) publish(res *Result, err error) {
+	if f == nil || res == nil {
+		return
+	}
+	ev := Event{
+		Service: res.Service,
+		Status:  res.Status,
+		Time:    res.Time,
+	}
+	if pe, ok := err.(*GrpcProbeError); ok {
+		ev.Error = pe.Message
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if prev, ok := f.last[ev.Service]; ok && prev.Status == ev.Status && prev.Error == ev.Error {
+		return
+	}
+	f.seq++
+	ev.ID = f.seq
+	f.last[ev.Service] = ev
+	f.history = append(f.history, ev)
+	if len(f.history) > f.size {
+		f.history = f.history[len(f.history)-f.size:]
+	}
+	for s := range f.subs {
+		if s.service != ev.Service {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			// slow consumer; drop it so it reconnects and resumes
+			delete(f.subs, s)
+			close(s.ch)
+			feedSubscribers.Dec()
+		}
+	}
+}
+
+// Subscribe registers for transitions of serviceName.  The returned replay
+// holds the events after lastID that the subscriber missed; with lastID 0,
+// a lastID ahead of the feed (from before a restart), or if those events
+// are no longer retained, it holds just the current status.  The channel
+// is closed if the subscriber falls behind.  cancel must be called to
+// unsubscribe.
+func (f *Feed) Subscribe(serviceName string, lastID uint64) (replay []Event, events <-chan Event, cancel func()) {
+	s := &subscriber{
+		service: serviceName,
+		ch:      make(chan Event, feedSubscriberBuffer),
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if lastID > f.seq {
+		// an ID from before the proxy restarted and the IDs began again at 1
+		lastID = 0
+	}
+	truncated := len(f.history) > 0 && f.history[0].ID > lastID+1
+	if lastID == 0 || truncated {
+		if ev, ok := f.last[serviceName]; ok && ev.ID > lastID {
+			replay = append(replay, ev)
+		}
+	} else {
+		for _, ev := range f.history {
+			if ev.ID > lastID && ev.Service == serviceName {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	f.subs[s] = struct{}{}
+	feedSubscribers.Inc()
+
+	return replay, s.ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[s]; ok {
+			delete(f.subs, s)
+			close(s.ch)
+			feedSubscribers.Dec()
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	serving    = healthpb.HealthCheckResponse_SERVING
+	notServing = healthpb.HealthCheckResponse_NOT_SERVING
+)
+
+func publishStatus(f *Feed, service string, st healthpb.HealthCheckResponse_ServingStatus) {
+	f.publish(&Result{Service: service, Status: st}, nil)
+}
+
+func eventIDs(evs []Event) []uint64 {
+	var ids []uint64
+	for _, ev := range evs {
+		ids = append(ids, ev.ID)
+	}
+	return ids
+}
+
+func TestFeedPublishesTransitionsOnly(t *testing.T) {
+	f := NewFeed(10)
+	publishStatus(f, "a", serving)
+	publishStatus(f, "a", serving)
+	publishStatus(f, "a", notServing)
+	f.publish(&Result{Service: "a", Status: notServing}, NewGrpcProbeError(StatusRPCFailure, "StatusRPCFailure"))
+
+	replay, _, cancel := f.Subscribe("a", 0)
+	defer cancel()
+	if len(replay) != 1 || replay[0].ID != 3 || replay[0].Error != "StatusRPCFailure" {
+		t.Errorf("Subscribe(a, 0) replay = %+v, want only the current status (id 3) with its error", replay)
+	}
+}
+
+func TestFeedResume(t *testing.T) {
+	f := NewFeed(10)
+	publishStatus(f, "a", serving)    // 1
+	publishStatus(f, "b", serving)    // 2
+	publishStatus(f, "a", notServing) // 3
+	publishStatus(f, "a", serving)    // 4
+
+	replay, _, cancel := f.Subscribe("a", 1)
+	defer cancel()
+	if got := eventIDs(replay); len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Errorf("Subscribe(a, 1) replay ids = %v, want [3 4]", got)
+	}
+}
+
+func TestFeedResumeAfterHistoryIsTruncated(t *testing.T) {
+	f := NewFeed(2)
+	publishStatus(f, "a", serving)    // 1
+	publishStatus(f, "a", notServing) // 2
+	publishStatus(f, "a", serving)    // 3
+	publishStatus(f, "a", notServing) // 4
+
+	replay, _, cancel := f.Subscribe("a", 1)
+	defer cancel()
+	if got := eventIDs(replay); len(got) != 1 || got[0] != 4 {
+		t.Errorf("Subscribe(a, 1) replay ids = %v, want the current status [4]", got)
+	}
+}
+
+func TestFeedResumeAfterRestart(t *testing.T) {
+	f := NewFeed(10)
+	publishStatus(f, "a", serving)    // 1
+	publishStatus(f, "a", notServing) // 2
+
+	// the subscriber saw event 1000 before the proxy restarted
+	replay, _, cancel := f.Subscribe("a", 1000)
+	defer cancel()
+	if got := eventIDs(replay); len(got) != 1 || got[0] != 2 {
+		t.Errorf("Subscribe(a, 1000) replay ids = %v, want the current status [2]", got)
+	}
+}
+
+func TestFeedDeliversToSubscribersOfTheService(t *testing.T) {
+	f := NewFeed(10)
+	_, a, cancelA := f.Subscribe("a", 0)
+	defer cancelA()
+	_, b, cancelB := f.Subscribe("b", 0)
+	defer cancelB()
+
+	publishStatus(f, "a", serving)
+	if ev := <-a; ev.Service != "a" || ev.Status != serving {
+		t.Errorf("subscriber of a got %+v", ev)
+	}
+	select {
+	case ev := <-b:
+		t.Errorf("subscriber of b got %+v", ev)
+	default:
+	}
+}
+
+func TestFeedDropsSlowSubscriber(t *testing.T) {
+	f := NewFeed(100)
+	_, events, cancel := f.Subscribe("a", 0)
+	defer cancel()
+
+	for i := 0; i <= feedSubscriberBuffer; i++ {
+		st := serving
+		if i%2 == 1 {
+			st = notServing
+		}
+		publishStatus(f, "a", st)
+	}
+	n := 0
+	for range events {
+		n++
+	}
+	if n != feedSubscriberBuffer {
+		t.Errorf("slow subscriber received %d events before being closed, want %d", n, feedSubscriberBuffer)
+	}
+}
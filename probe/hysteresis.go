@@ -0,0 +1,207 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Hysteresis states.  A service is UP or DOWN once enough consecutive
+// results agree; it is GOING_DOWN or GOING_UP while results disagree with
+// the current state but have not reached the threshold yet.
+const (
+	StateUp        = "UP"
+	StateGoingDown = "GOING_DOWN"
+	StateDown      = "DOWN"
+	StateGoingUp   = "GOING_UP"
+)
+
+var hysteresisStates = []string{StateUp, StateGoingDown, StateDown, StateGoingUp}
+
+// Thresholds are the rise/fall thresholds of a service.
+type Thresholds struct {
+	// Rise is the number of consecutive healthy results that mark a DOWN
+	// service UP.
+	Rise int
+	// Fall is the number of consecutive unhealthy results that mark an UP
+	// service DOWN.
+	Fall int
+}
+
+// ParseThresholds parses "service=rise:fall".
+func ParseThresholds(spec string) (string, Thresholds, error) {
+	name, rest, ok := strings.Cut(spec, "=")
+	rise, fall, ok2 := strings.Cut(rest, ":")
+	if !ok || !ok2 || name == "" {
+		return "", Thresholds{}, fmt.Errorf("invalid thresholds %q (must be service=rise:fall)", spec)
+	}
+	var t Thresholds
+	var err error
+	if t.Rise, err = strconv.Atoi(rise); err != nil || t.Rise <= 0 {
+		return "", Thresholds{}, fmt.Errorf("invalid rise in thresholds %q", spec)
+	}
+	if t.Fall, err = strconv.Atoi(fall); err != nil || t.Fall <= 0 {
+		return "", Thresholds{}, fmt.Errorf("invalid fall in thresholds %q", spec)
+	}
+	return name, t, nil
+}
+
+// HysteresisConfig configures a Hysteresis.
+type HysteresisConfig struct {
+	// Default applies to services without an entry in Services.
+	Default  Thresholds
+	Services map[string]Thresholds
+	// MaxServices bounds the number of services whose state is kept; the
+	// state of the least recently checked service is dropped to make room.
+	// Zero means no limit.
+	MaxServices int
+}
+
+// HysteresisState describes where a service is in the rise/fall state
+// machine.  It is set on the Results returned by a Hysteresis.
+type HysteresisState struct {
+	State string
+	// Count is the number of consecutive results that disagreed with the
+	// last UP or DOWN state.
+	Count      int
+	Thresholds Thresholds
+	// ObservedStatus and ObservedError are the actual outcome of the latest
+	// check, which differs from the reported one while GOING_DOWN or
+	// GOING_UP.
+	ObservedStatus healthpb.HealthCheckResponse_ServingStatus
+	ObservedError  error
+}
+
+type hysteresisEntry struct {
+	state string
+	count int
+	// res and err are the latest result that agreed with the state.
+	res *Result
+	err error
+	// seen is the Time of the latest result, so that cached results are
+	// only counted once.
+	seen time.Time
+}
+
+// Hysteresis wraps a Checker and only flips a service between healthy and
+// unhealthy after a number of consecutive results agree, like the rise and
+// fall options of HAProxy.  While a service is GOING_DOWN or GOING_UP, Check
+// keeps reporting the outcome of the last result that agreed with the state.
+// The first result of a service sets its state directly, as does the first
+// result after its state was dropped to stay within MaxServices.
+type Hysteresis struct {
+	prober  *Prober
+	checker Checker
+	cfg     HysteresisConfig
+
+	mu      sync.Mutex
+	entries *LRU[*hysteresisEntry]
+}
+
+// NewHysteresis returns a Hysteresis for c, which checks p.
+func NewHysteresis(p *Prober, c Checker, cfg HysteresisConfig) *Hysteresis {
+	return &Hysteresis{
+		prober:  p,
+		checker: c,
+		cfg:     cfg,
+		entries: NewLRU[*hysteresisEntry](cfg.MaxServices),
+	}
+}
+
+func (h *Hysteresis) thresholds(serviceName string) Thresholds {
+	if t, ok := h.cfg.Services[serviceName]; ok {
+		return t
+	}
+	return h.cfg.Default
+}
+
+// Check checks serviceName with the wrapped Checker and applies the
+// service's thresholds to the result.
+func (h *Hysteresis) Check(ctx context.Context, serviceName string) (*Result, error) {
+	res, err := h.checker.Check(ctx, serviceName)
+	if errors.Is(err, ErrCheckRejected) {
+		return res, err
+	}
+	healthy := err == nil && res.Status == healthpb.HealthCheckResponse_SERVING
+	t := h.thresholds(serviceName)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.entries.Get(serviceName)
+	switch {
+	case !ok:
+		e = &hysteresisEntry{state: StateDown, res: res, err: err}
+		if healthy {
+			e.state = StateUp
+		}
+		h.entries.Add(serviceName, e)
+	case !res.Time.IsZero() && res.Time.Equal(e.seen):
+		// a cached result that was already counted
+	case healthy == (e.state == StateUp || e.state == StateGoingDown):
+		e.count = 0
+		e.res, e.err = res, err
+		if healthy {
+			e.state = StateUp
+		} else {
+			e.state = StateDown
+		}
+	default:
+		e.count++
+		threshold, next, going := t.Fall, StateDown, StateGoingDown
+		if healthy {
+			threshold, next, going = t.Rise, StateUp, StateGoingUp
+		}
+		if e.count >= threshold {
+			h.prober.logger.Warn("service state changed", slog.String("service_name", serviceName), slog.String("state", next), slog.Int("count", e.count))
+			e.state, e.count = next, 0
+			e.res, e.err = res, err
+		} else {
+			h.prober.logger.Info("service state changing", slog.String("service_name", serviceName), slog.String("state", going), slog.Int("count", e.count), slog.Int("threshold", threshold))
+			e.state = going
+		}
+	}
+	e.seen = res.Time
+
+	for _, s := range hysteresisStates {
+		v := 0.0
+		if s == e.state {
+			v = 1
+		}
+		hysteresisState.WithLabelValues(h.prober.name, h.prober.serviceLabel(serviceName), s).Set(v)
+	}
+
+	// report the outcome of the state with the timing of this check
+	out := *e.res
+	out.Time, out.Duration, out.Timing = res.Time, res.Duration, res.Timing
+	out.Attempts, out.Cache, out.Age = res.Attempts, res.Cache, res.Age
+	out.Hysteresis = &HysteresisState{
+		State:          e.state,
+		Count:          e.count,
+		Thresholds:     t,
+		ObservedStatus: res.Status,
+		ObservedError:  err,
+	}
+	return &out, e.err
+}
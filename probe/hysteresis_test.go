@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestParseThresholds(t *testing.T) {
+	name, th, err := ParseThresholds("echo=2:3")
+	if err != nil || name != "echo" || th != (Thresholds{Rise: 2, Fall: 3}) {
+		t.Errorf("ParseThresholds(echo=2:3) = %q, %v, %v", name, th, err)
+	}
+	for _, spec := range []string{"", "echo", "echo=2", "=2:3", "echo=0:3", "echo=2:-1", "echo=a:b"} {
+		if _, _, err := ParseThresholds(spec); err == nil {
+			t.Errorf("ParseThresholds(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestHysteresisTransitions(t *testing.T) {
+	const (
+		up   = healthpb.HealthCheckResponse_SERVING
+		down = healthpb.HealthCheckResponse_NOT_SERVING
+	)
+	c := statusChecker{}
+	h := NewHysteresis(&Prober{name: "test", logger: discardLogger}, c, HysteresisConfig{
+		Default:  Thresholds{Rise: 2, Fall: 3},
+		Services: map[string]Thresholds{"fast": {Rise: 1, Fall: 1}},
+	})
+	for i, step := range []struct {
+		observed   healthpb.HealthCheckResponse_ServingStatus
+		wantState  string
+		wantCount  int
+		wantStatus healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{up, StateUp, 0, up},
+		{down, StateGoingDown, 1, up},
+		{down, StateGoingDown, 2, up},
+		{up, StateUp, 0, up},
+		{down, StateGoingDown, 1, up},
+		{down, StateGoingDown, 2, up},
+		{down, StateDown, 0, down},
+		{up, StateGoingUp, 1, down},
+		{down, StateDown, 0, down},
+		{up, StateGoingUp, 1, down},
+		{up, StateUp, 0, up},
+	} {
+		c["echo"] = step.observed
+		res, _ := h.Check(context.Background(), "echo")
+		hs := res.Hysteresis
+		if hs.State != step.wantState || hs.Count != step.wantCount || res.Status != step.wantStatus || hs.ObservedStatus != step.observed {
+			t.Fatalf("step %d: observed %v reported %v %s count %d, want %v %s count %d", i, step.observed, res.Status, hs.State, hs.Count, step.wantStatus, step.wantState, step.wantCount)
+		}
+	}
+
+	c["fast"] = up
+	h.Check(context.Background(), "fast")
+	c["fast"] = down
+	if res, _ := h.Check(context.Background(), "fast"); res.Hysteresis.State != StateDown || res.Status != down {
+		t.Errorf("fast service = %s %v, want DOWN with its own fall of 1", res.Hysteresis.State, res.Status)
+	}
+}
+
+func TestHysteresisFirstResultDown(t *testing.T) {
+	h := NewHysteresis(&Prober{name: "test", logger: discardLogger}, statusChecker{}, HysteresisConfig{Default: Thresholds{Rise: 2, Fall: 2}})
+	res, err := h.Check(context.Background(), "missing")
+	if res.Hysteresis.State != StateDown || err == nil {
+		t.Errorf("first check of a missing service = %s, %v, want DOWN with the error", res.Hysteresis.State, err)
+	}
+}
+
+// timedChecker returns the same result, with the same Time, until next is
+// called, like a Cache or Poller serving one result to many requests.
+type timedChecker struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+	at     time.Time
+}
+
+func (c *timedChecker) Check(ctx context.Context, serviceName string) (*Result, error) {
+	return &Result{Service: serviceName, Status: c.status, Time: c.at}, nil
+}
+
+func (c *timedChecker) next(st healthpb.HealthCheckResponse_ServingStatus) {
+	c.status, c.at = st, c.at.Add(time.Second)
+}
+
+func TestHysteresisCountsResultsOnce(t *testing.T) {
+	c := &timedChecker{status: healthpb.HealthCheckResponse_SERVING, at: time.Now()}
+	h := NewHysteresis(&Prober{name: "test", logger: discardLogger}, c, HysteresisConfig{Default: Thresholds{Rise: 2, Fall: 2}})
+	h.Check(context.Background(), "echo")
+	c.next(healthpb.HealthCheckResponse_NOT_SERVING)
+	for range 3 {
+		if res, _ := h.Check(context.Background(), "echo"); res.Hysteresis.State != StateGoingDown || res.Hysteresis.Count != 1 {
+			t.Fatalf("repeated result = %s count %d, want GOING_DOWN count 1", res.Hysteresis.State, res.Hysteresis.Count)
+		}
+	}
+	c.next(healthpb.HealthCheckResponse_NOT_SERVING)
+	if res, _ := h.Check(context.Background(), "echo"); res.Hysteresis.State != StateDown {
+		t.Errorf("second result = %s, want DOWN", res.Hysteresis.State)
+	}
+}
+
+func TestHysteresisMaxServices(t *testing.T) {
+	c := statusChecker{"a": healthpb.HealthCheckResponse_SERVING, "b": healthpb.HealthCheckResponse_SERVING, "c": healthpb.HealthCheckResponse_SERVING}
+	h := NewHysteresis(&Prober{name: "test", logger: discardLogger}, c, HysteresisConfig{Default: Thresholds{Rise: 1, Fall: 2}, MaxServices: 2})
+	h.Check(context.Background(), "a")
+	h.Check(context.Background(), "b")
+	c["a"] = healthpb.HealthCheckResponse_NOT_SERVING
+	if res, _ := h.Check(context.Background(), "a"); res.Hysteresis.State != StateGoingDown {
+		t.Fatalf("a = %s, want GOING_DOWN", res.Hysteresis.State)
+	}
+	// c evicts b, the least recently checked service
+	h.Check(context.Background(), "c")
+	if n := h.entries.Len(); n != 2 {
+		t.Errorf("%d services tracked, want 2", n)
+	}
+	if _, ok := h.entries.Get("b"); ok {
+		t.Errorf("b is still tracked, want it evicted")
+	}
+	if res, _ := h.Check(context.Background(), "a"); res.Hysteresis.State != StateDown {
+		t.Errorf("a = %s, want DOWN: its state must survive the eviction", res.Hysteresis.State)
+	}
+}
+
+func TestHysteresisIgnoresRejections(t *testing.T) {
+	h := NewHysteresis(&Prober{name: "test", logger: discardLogger}, rejectingChecker{}, HysteresisConfig{Default: Thresholds{Rise: 1, Fall: 1}})
+	if res, err := h.Check(context.Background(), "echo"); !errors.Is(err, ErrCheckRejected) || res.Hysteresis != nil {
+		t.Errorf("rejected check = %+v, %v, want it passed through", res.Hysteresis, err)
+	}
+	if h.entries.Len() != 0 {
+		t.Errorf("rejected check recorded a state")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import "container/list"
+
+// LRU is a map of per-service (or per-client) state bounded to max
+// entries, dropping the least recently used entry to make room for a new
+// one.  Service names and client addresses come from the http request, so
+// state kept per key must not grow without bounds.  It is not safe for
+// concurrent use.
+type LRU[V any] struct {
+	max   int
+	order *list.List // of *lruItem[V], most recently used first
+	items map[string]*list.Element
+}
+
+type lruItem[V any] struct {
+	key   string
+	value V
+}
+
+// NewLRU returns an LRU holding up to max entries; max <= 0 means no limit.
+func NewLRU[V any](max int) *LRU[V] {
+	return &LRU[V]{max: max, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the entry of key and marks it as the most recently used.
+func (l *LRU[V]) Get(key string) (V, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem[V]).value, true
+}
+
+// Add sets the entry of key, evicting the least recently used entry if the
+// LRU is full.
+func (l *LRU[V]) Add(key string, value V) {
+	if el, ok := l.items[key]; ok {
+		el.Value.(*lruItem[V]).value = value
+		l.order.MoveToFront(el)
+		return
+	}
+	if l.max > 0 && l.order.Len() >= l.max {
+		l.Remove(l.order.Back().Value.(*lruItem[V]).key)
+	}
+	l.items[key] = l.order.PushFront(&lruItem[V]{key: key, value: value})
+}
+
+// Remove removes the entry of key, if any.
+func (l *LRU[V]) Remove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+// RemoveFunc removes the entries for which drop returns true.
+func (l *LRU[V]) RemoveFunc(drop func(V) bool) {
+	for el := l.order.Front(); el != nil; {
+		next := el.Next()
+		if it := el.Value.(*lruItem[V]); drop(it.value) {
+			l.order.Remove(el)
+			delete(l.items, it.key)
+		}
+		el = next
+	}
+}
+
+// Len returns the number of entries.
+func (l *LRU[V]) Len() int {
+	return l.order.Len()
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import "testing"
+
+func TestLRU(t *testing.T) {
+	l := NewLRU[int](2)
+	l.Add("a", 1)
+	l.Add("b", 2)
+	l.Get("a")
+	l.Add("c", 3)
+	if _, ok := l.Get("b"); ok {
+		t.Errorf("b was not evicted as the least recently used entry")
+	}
+	if v, ok := l.Get("a"); !ok || v != 1 {
+		t.Errorf("Get(a) = %d, %v, want 1", v, ok)
+	}
+	l.Add("a", 10)
+	if v, _ := l.Get("a"); v != 10 || l.Len() != 2 {
+		t.Errorf("Get(a) = %d with %d entries, want the updated 10 with 2", v, l.Len())
+	}
+	l.RemoveFunc(func(v int) bool { return v > 5 })
+	if _, ok := l.Get("a"); ok || l.Len() != 1 {
+		t.Errorf("RemoveFunc() kept a, %d entries", l.Len())
+	}
+	l.Remove("c")
+	if l.Len() != 0 {
+		t.Errorf("Remove() left %d entries", l.Len())
+	}
+
+	unbounded := NewLRU[int](0)
+	for i := range 100 {
+		unbounded.Add(string(rune('a'+i)), i)
+	}
+	if unbounded.Len() != 100 {
+		t.Errorf("unbounded lru holds %d entries, want 100", unbounded.Len())
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const listServiceMetric = "listServiceRequest"
+
+var (
+	serviceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_service_duration_seconds",
+		Help: "Duration of HTTP requests per service.",
+	}, []string{"target", "service_name"})
+
+	grpcReqs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_service_requests",
+			Help: "backend status, partitioned by target, status code and service_name.",
+		},
+		[]string{"target", "code", "service_name"},
+	)
+
+	dnsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_dns_duration_seconds",
+		Help: "Duration of upstream name resolution.",
+	}, []string{"target"})
+
+	tcpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_tcp_connect_duration_seconds",
+		Help: "Duration of upstream tcp connects.",
+	}, []string{"target"})
+
+	tlsDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_tls_handshake_duration_seconds",
+		Help: "Duration of upstream TLS handshakes.",
+	}, []string{"target"})
+
+	firstByteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_rpc_first_byte_duration_seconds",
+		Help: "Time from the start of a health rpc to the first response bytes.",
+	}, []string{"target", "service_name"})
+
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "grpc_health_check_rpc_duration_seconds",
+		Help: "Duration of health rpcs.",
+	}, []string{"target", "service_name"})
+
+	probeAttempts = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_health_check_probe_attempts",
+		Help:    "Number of health rpcs made per probe, including retries.",
+		Buckets: prometheus.LinearBuckets(1, 1, 10),
+	}, []string{"target"})
+
+	probeRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_probe_retries",
+			Help: "retried health rpcs, partitioned by target, service_name and the code of the failed attempt.",
+		},
+		[]string{"target", "service_name", "code"},
+	)
+
+	probeErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_probe_errors",
+			Help: "failed probes, partitioned by target, service_name, probe error and reason.",
+		},
+		[]string{"target", "service_name", "error", "reason"},
+	)
+
+	connState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_health_check_connection_state",
+			Help: "upstream connection state; 1 for the current state, 0 otherwise.",
+		},
+		[]string{"target", "state"},
+	)
+
+	connTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_connection_transitions",
+			Help: "upstream connection state transitions, partitioned by target and new state.",
+		},
+		[]string{"target", "state"},
+	)
+
+	cacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_cache_requests",
+			Help: "checks answered by the result cache, partitioned by target, service_name and result (HIT, MISS or COALESCED).",
+		},
+		[]string{"target", "service_name", "result"},
+	)
+
+	hysteresisState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_health_check_hysteresis_state",
+			Help: "rise/fall state of a service; 1 for the current state, 0 otherwise.",
+		},
+		[]string{"target", "service_name", "state"},
+	)
+
+	tlsReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_tls_reloads",
+			Help: "loads of TLS certificate, CA, pin and CRL files, partitioned by source (listener or target), file (cert, key, ca, pins or crl) and result (success or failure).",
+		},
+		[]string{"source", "file", "result"},
+	)
+
+	tlsCertExpiry = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_health_check_tls_certificate_expiry_timestamp_seconds",
+			Help: "NotAfter of the loaded TLS certificate, partitioned by source (listener or target).",
+		},
+		[]string{"source"},
+	)
+
+	crlNextUpdate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "grpc_health_check_crl_next_update_timestamp_seconds",
+			Help: "NextUpdate of a loaded CRL, partitioned by source (listener or target) and file.",
+		},
+		[]string{"source", "file"},
+	)
+
+	revocationChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_revocation_checks",
+			Help: "revocation checks of peer certificates, partitioned by source (listener or target), method (crl, ocsp or none) and result (good, revoked or unknown).",
+		},
+		[]string{"source", "method", "result"},
+	)
+
+	ocspRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_ocsp_requests",
+			Help: "OCSP requests, partitioned by source (listener or target) and result (good, revoked, unknown or error).",
+		},
+		[]string{"source", "result"},
+	)
+
+	ocspCacheHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "grpc_health_check_ocsp_cache_hits",
+			Help: "OCSP checks answered from the cache, partitioned by source (listener or target).",
+		},
+		[]string{"source"},
+	)
+
+	feedSubscribers = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "grpc_health_check_watch_subscribers",
+			Help: "number of clients subscribed to health status transitions.",
+		},
+	)
+)
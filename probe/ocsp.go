@@ -0,0 +1,198 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// oidOCSPNonce is the OCSP nonce extension of RFC 8954.
+var oidOCSPNonce = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 2}
+
+// ocspClockSkew is the clock skew tolerated for the validity of a response.
+const ocspClockSkew = 5 * time.Minute
+
+// maxOCSPResponseSize bounds the OCSP response read from a responder.
+const maxOCSPResponseSize = 1 << 20
+
+// ocspNonceSize is the size of the nonce sent with an OCSP request.
+const ocspNonceSize = 16
+
+// ocspResult is the status of a certificate in an OCSP response.
+type ocspResult struct {
+	status     string
+	revokedAt  time.Time
+	nextUpdate time.Time
+}
+
+// queryOCSP posts an OCSP request for cert to responder and returns the
+// verified response.
+func (c *RevocationChecker) queryOCSP(responder string, cert, issuer *x509.Certificate, now time.Time) (*ocspResult, error) {
+	nonce := make([]byte, ocspNonceSize)
+	rand.Read(nonce)
+	der, err := newOCSPRequest(cert, issuer, nonce)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, responder, bytes.NewReader(der))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", responder, res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return verifyOCSPResponse(body, cert, issuer, nonce, now)
+}
+
+// newOCSPRequest returns an OCSP request for cert carrying nonce.
+func newOCSPRequest(cert, issuer *x509.Certificate, nonce []byte) ([]byte, error) {
+	der, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	// ocsp.CreateRequest cannot add request extensions, so the nonce is
+	// added to the tbsRequest it returns.
+	var req struct {
+		TBSRequest struct {
+			Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+			RequestorName pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+			RequestList   asn1.RawValue
+			Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+		}
+	}
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		return nil, err
+	}
+	value, err := asn1.Marshal(nonce)
+	if err != nil {
+		return nil, err
+	}
+	req.TBSRequest.Extensions = []pkix.Extension{{Id: oidOCSPNonce, Value: value}}
+	return asn1.Marshal(req)
+}
+
+// verifyOCSPResponse parses an OCSP response and returns the status of
+// cert.  The response must be signed by issuer or by a current responder
+// certificate issued by it for OCSP signing, name its signer in its
+// responder ID, be current at now and, if it has a nonce, echo nonce.
+func verifyOCSPResponse(der []byte, cert, issuer *x509.Certificate, nonce []byte, now time.Time) (*ocspResult, error) {
+	// ParseResponseForCert verifies the signature, and that a responder
+	// certificate in the response is issued by issuer.
+	resp, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %v", err)
+	}
+	signer := issuer
+	if resp.Certificate != nil && !bytes.Equal(resp.Certificate.Raw, issuer.Raw) {
+		if !slices.Contains(resp.Certificate.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning) {
+			return nil, errors.New("OCSP responder certificate is not authorized for OCSP signing")
+		}
+		if now.Before(resp.Certificate.NotBefore) || now.After(resp.Certificate.NotAfter) {
+			return nil, errors.New("OCSP responder certificate is expired or not yet valid")
+		}
+		signer = resp.Certificate
+	}
+	if !responderIDMatches(resp, signer) {
+		return nil, errors.New("OCSP responder ID does not match the signing certificate")
+	}
+	if err := checkOCSPNonce(resp, nonce); err != nil {
+		return nil, err
+	}
+	if resp.ThisUpdate.After(now.Add(ocspClockSkew)) {
+		return nil, errors.New("OCSP response is not yet valid")
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now.Add(-ocspClockSkew)) {
+		return nil, errors.New("OCSP response is past its next update")
+	}
+
+	res := &ocspResult{nextUpdate: resp.NextUpdate}
+	switch resp.Status {
+	case ocsp.Good:
+		res.status = revocationGood
+	case ocsp.Revoked:
+		res.status, res.revokedAt = revocationRevoked, resp.RevokedAt
+	default:
+		res.status = revocationUnknown
+	}
+	return res, nil
+}
+
+// responderIDMatches reports whether the responder ID of resp names signer,
+// by its subject or the sha1 hash of its public key.
+func responderIDMatches(resp *ocsp.Response, signer *x509.Certificate) bool {
+	if resp.RawResponderName != nil {
+		return bytes.Equal(resp.RawResponderName, signer.RawSubject)
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(signer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	hash := sha1.Sum(spki.PublicKey.RightAlign())
+	return bytes.Equal(resp.ResponderKeyHash, hash[:])
+}
+
+// checkOCSPNonce checks that the nonce of resp, if it has one, is nonce.
+// Responders serving pre-signed responses send none.
+func checkOCSPNonce(resp *ocsp.Response, nonce []byte) error {
+	// ocsp.Response does not have the response extensions, so they are
+	// read from its signed tbsResponseData.
+	var data struct {
+		Version     int `asn1:"optional,default:0,explicit,tag:0"`
+		ResponderID asn1.RawValue
+		ProducedAt  asn1.RawValue
+		Responses   asn1.RawValue
+		Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+	}
+	if _, err := asn1.Unmarshal(resp.TBSResponseData, &data); err != nil {
+		return fmt.Errorf("invalid OCSP response data: %v", err)
+	}
+	for _, ext := range data.Extensions {
+		if !ext.Id.Equal(oidOCSPNonce) {
+			continue
+		}
+		var got []byte
+		if _, err := asn1.Unmarshal(ext.Value, &got); err != nil || !bytes.Equal(got, nonce) {
+			return errors.New("OCSP response nonce does not match the request")
+		}
+	}
+	return nil
+}
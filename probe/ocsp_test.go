@@ -0,0 +1,273 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspResponseData is the tbsResponseData of an OCSP response, with the
+// fields a test does not change kept raw.
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  asn1.RawValue
+	Responses   asn1.RawValue
+	Extensions  []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// withOCSPNonce returns the OCSP response der with nonce as its nonce
+// extension, signed again with key.
+func withOCSPNonce(t *testing.T, der, nonce []byte, key crypto.Signer) []byte {
+	t.Helper()
+	var resp struct {
+		Status   asn1.Enumerated
+		Response struct {
+			Type  asn1.ObjectIdentifier
+			Bytes []byte
+		} `asn1:"explicit,tag:0"`
+	}
+	var basic struct {
+		TBSResponseData    asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+		Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+	}
+	var data ocspResponseData
+	mustUnmarshal(t, der, &resp)
+	mustUnmarshal(t, resp.Response.Bytes, &basic)
+	mustUnmarshal(t, basic.TBSResponseData.FullBytes, &data)
+
+	data.Extensions = []pkix.Extension{{Id: oidOCSPNonce, Value: mustMarshal(t, nonce)}}
+	tbs := mustMarshal(t, data)
+	digest := sha256.Sum256(tbs)
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic.TBSResponseData = asn1.RawValue{FullBytes: tbs}
+	basic.Signature = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+	resp.Response.Bytes = mustMarshal(t, basic)
+	return mustMarshal(t, resp)
+}
+
+// requestNonce returns the nonce of the OCSP request der.
+func requestNonce(t *testing.T, der []byte) []byte {
+	t.Helper()
+	var req struct {
+		TBSRequest struct {
+			Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+			RequestorName pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+			RequestList   asn1.RawValue
+			Extensions    []pkix.Extension `asn1:"explicit,tag:2,optional"`
+		}
+	}
+	mustUnmarshal(t, der, &req)
+	for _, ext := range req.TBSRequest.Extensions {
+		if ext.Id.Equal(oidOCSPNonce) {
+			var nonce []byte
+			mustUnmarshal(t, ext.Value, &nonce)
+			return nonce
+		}
+	}
+	t.Fatalf("OCSP request has no nonce")
+	return nil
+}
+
+func mustMarshal(t *testing.T, v any) []byte {
+	t.Helper()
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func mustUnmarshal(t *testing.T, der []byte, v any) {
+	t.Helper()
+	if rest, err := asn1.Unmarshal(der, v); err != nil || len(rest) > 0 {
+		t.Fatalf("asn1.Unmarshal() = %d bytes left, %v", len(rest), err)
+	}
+}
+
+// newOCSPResponder returns a responder certificate of ca, authorized for
+// OCSP signing if signing is set, and its key.
+func newOCSPResponder(t *testing.T, ca *testCA, signing bool) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key := newTestKey(t)
+	tmpl := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "ocsp responder"},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}
+	if signing {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	}
+	return ca.sign(t, tmpl, key), key
+}
+
+// ocspResponse returns an OCSP response of ca for cert from tmpl, with the
+// responder ID of responder and signed by key.  A responder other than ca
+// is included in the response.
+func (ca *testCA) ocspResponse(t *testing.T, cert *x509.Certificate, tmpl ocsp.Response, responder *x509.Certificate, key crypto.Signer) []byte {
+	t.Helper()
+	tmpl.SerialNumber = cert.SerialNumber
+	if responder != ca.cert {
+		tmpl.Certificate = responder
+	}
+	der, err := ocsp.CreateResponse(ca.cert, responder, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerifyOCSPResponse(t *testing.T) {
+	ca := newTestCA(t, "ocsp ca", nil)
+	other := newTestCA(t, "other ca", nil)
+	cert, _ := ca.issue(t, "server")
+	delegate, delegateKey := newOCSPResponder(t, ca, true)
+	noEKU, noEKUKey := newOCSPResponder(t, ca, false)
+	foreign, foreignKey := newOCSPResponder(t, other, true)
+	now := time.Now()
+	nonce := []byte("0123456789abcdef")
+
+	current := func(status int) ocsp.Response {
+		return ocsp.Response{Status: status, ThisUpdate: now.Add(-time.Minute), NextUpdate: now.Add(time.Hour)}
+	}
+	revoked := current(ocsp.Revoked)
+	revoked.RevokedAt = now.Add(-time.Hour).Truncate(time.Second)
+
+	for _, tc := range []struct {
+		name       string
+		der        []byte
+		wantStatus string
+		wantErr    string
+	}{
+		{"good", ca.ocspResponse(t, cert, current(ocsp.Good), ca.cert, ca.key), revocationGood, ""},
+		{"revoked", ca.ocspResponse(t, cert, revoked, ca.cert, ca.key), revocationRevoked, ""},
+		{"unknown", ca.ocspResponse(t, cert, current(ocsp.Unknown), ca.cert, ca.key), revocationUnknown, ""},
+		{"delegated responder", ca.ocspResponse(t, cert, current(ocsp.Good), delegate, delegateKey), revocationGood, ""},
+		{"delegated responder without ocsp signing", ca.ocspResponse(t, cert, current(ocsp.Good), noEKU, noEKUKey), "", "not authorized for OCSP signing"},
+		{"responder of another ca", ca.ocspResponse(t, cert, current(ocsp.Good), foreign, foreignKey), "", "invalid OCSP response"},
+		{"bad signature", ca.ocspResponse(t, cert, current(ocsp.Good), ca.cert, other.key), "", "invalid OCSP response"},
+		{"responder id not the signer", func() []byte {
+			tmpl := current(ocsp.Good)
+			tmpl.SerialNumber = cert.SerialNumber
+			der, err := ocsp.CreateResponse(ca.cert, delegate, tmpl, ca.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return der
+		}(), "", "responder ID does not match"},
+		{"stale", ca.ocspResponse(t, cert, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(-2 * time.Hour), NextUpdate: now.Add(-time.Hour)}, ca.cert, ca.key), "", "past its next update"},
+		{"future", ca.ocspResponse(t, cert, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(time.Hour), NextUpdate: now.Add(2 * time.Hour)}, ca.cert, ca.key), "", "not yet valid"},
+		{"within clock skew", ca.ocspResponse(t, cert, ocsp.Response{Status: ocsp.Good, ThisUpdate: now.Add(time.Minute), NextUpdate: now.Add(-time.Minute)}, ca.cert, ca.key), revocationGood, ""},
+		{"nonce", withOCSPNonce(t, ca.ocspResponse(t, cert, current(ocsp.Good), ca.cert, ca.key), nonce, ca.key), revocationGood, ""},
+		{"nonce mismatch", withOCSPNonce(t, ca.ocspResponse(t, cert, current(ocsp.Good), ca.cert, ca.key), []byte("fedcba9876543210"), ca.key), "", "nonce does not match"},
+		{"other certificate", ca.ocspResponse(t, ca.cert, current(ocsp.Good), ca.cert, ca.key), "", "invalid OCSP response"},
+		{"error status", ocsp.TryLaterErrorResponse, "", "try later"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := verifyOCSPResponse(tc.der, cert, ca.cert, nonce, now)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("verifyOCSPResponse() error = %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("verifyOCSPResponse() error = %v", err)
+			}
+			if res.status != tc.wantStatus {
+				t.Errorf("verifyOCSPResponse() status = %s, want %s", res.status, tc.wantStatus)
+			}
+			if tc.wantStatus == revocationRevoked && !res.revokedAt.Equal(revoked.RevokedAt) {
+				t.Errorf("verifyOCSPResponse() revokedAt = %v, want %v", res.revokedAt, revoked.RevokedAt)
+			}
+		})
+	}
+}
+
+// startOCSPResponder serves the OCSP responses of ca, made by respond for
+// the certificate asked about, until the test ends.  It counts the
+// requests in hits.
+func startOCSPResponder(t *testing.T, ca *testCA, respond func(req *ocsp.Request, nonce []byte) []byte) (string, *atomic.Int32) {
+	t.Helper()
+	hits := &atomic.Int32{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.Write(ocsp.MalformedRequestErrorResponse)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(respond(req, requestNonce(t, body)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, hits
+}
+
+func TestQueryOCSPNonce(t *testing.T) {
+	ca := newTestCA(t, "ocsp nonce ca", nil)
+	cert, _ := ca.issue(t, "server")
+	c := &RevocationChecker{client: &http.Client{Timeout: 5 * time.Second}}
+
+	for _, tc := range []struct {
+		name    string
+		echo    bool
+		wantErr string
+	}{
+		{"echoed", true, ""},
+		{"replayed", false, "nonce does not match"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var last []byte
+			url, _ := startOCSPResponder(t, ca, func(req *ocsp.Request, nonce []byte) []byte {
+				if req.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+					t.Errorf("OCSP request for serial %v, want %v", req.SerialNumber, cert.SerialNumber)
+				}
+				if !tc.echo && last != nil {
+					nonce = last
+				}
+				last = nonce
+				der := ca.ocspResponse(t, cert, ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}, ca.cert, ca.key)
+				return withOCSPNonce(t, der, nonce, ca.key)
+			})
+			if _, err := c.queryOCSP(url, cert, ca.cert, time.Now()); err != nil {
+				t.Fatalf("first queryOCSP() error = %v", err)
+			}
+			_, err := c.queryOCSP(url, cert, ca.cert, time.Now())
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("second queryOCSP() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
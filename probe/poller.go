@@ -0,0 +1,129 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// PollConfig configures a Poller.
+type PollConfig struct {
+	// Services maps each polled service name to its poll interval.
+	Services map[string]time.Duration
+	// MaxStaleness is the age after which a cached result is reported as
+	// UNKNOWN with StatusStale.  Zero disables the limit.
+	MaxStaleness time.Duration
+	// Feed, if set, receives every status transition.
+	Feed *Feed
+}
+
+type pollEntry struct {
+	res *Result
+	err error
+}
+
+// Poller checks a fixed set of services in the background, each on its own
+// interval, and answers Check from the latest cached result.  Upstream load
+// is therefore independent of how often Check is called.
+type Poller struct {
+	prober *Prober
+	cfg    PollConfig
+
+	mu      sync.RWMutex
+	entries map[string]*pollEntry
+}
+
+// NewPoller returns a Poller for p.  Call Start to begin polling.
+func NewPoller(p *Prober, cfg PollConfig) *Poller {
+	pl := &Poller{
+		prober:  p,
+		cfg:     cfg,
+		entries: map[string]*pollEntry{},
+	}
+	for s := range cfg.Services {
+		pl.entries[s] = nil
+	}
+	return pl
+}
+
+// Start launches one polling goroutine per service.  Each service is checked
+// immediately and then on its interval until ctx is cancelled.
+func (pl *Poller) Start(ctx context.Context) {
+	for s, interval := range pl.cfg.Services {
+		go pl.poll(ctx, s, interval)
+	}
+}
+
+func (pl *Poller) poll(ctx context.Context, serviceName string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		res, err := pl.prober.Check(ctx, serviceName)
+		pl.mu.Lock()
+		pl.entries[serviceName] = &pollEntry{res: res, err: err}
+		pl.mu.Unlock()
+		pl.cfg.Feed.publish(res, err)
+		pl.prober.logger.Debug("polled service", slog.String("service_name", serviceName), slog.String("status", res.Status.String()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tracks reports whether serviceName is polled.
+func (pl *Poller) Tracks(serviceName string) bool {
+	_, ok := pl.cfg.Services[serviceName]
+	return ok
+}
+
+// Check returns the cached result for serviceName.  Services that are not
+// polled are checked live with the underlying Prober.
+func (pl *Poller) Check(ctx context.Context, serviceName string) (*Result, error) {
+	pl.mu.RLock()
+	e, ok := pl.entries[serviceName]
+	pl.mu.RUnlock()
+	if !ok {
+		return pl.prober.Check(ctx, serviceName)
+	}
+
+	// stale results are stamped with the current time rather than that of
+	// the last poll: each one is a new observation, so that a Hysteresis
+	// counts it instead of taking it for a result it has already seen
+	if e == nil {
+		pl.prober.logger.Warn("no polled result yet", slog.String("service_name", serviceName))
+		return &Result{
+			Service: serviceName,
+			Status:  healthpb.HealthCheckResponse_UNKNOWN,
+			Time:    time.Now(),
+		}, NewGrpcProbeError(StatusStale, "StatusStale")
+	}
+	if pl.cfg.MaxStaleness > 0 && time.Since(e.res.Time) > pl.cfg.MaxStaleness {
+		pl.prober.logger.Warn("polled result is stale", slog.String("service_name", serviceName), slog.Time("checked", e.res.Time), slog.Duration("max_staleness", pl.cfg.MaxStaleness))
+		return &Result{
+			Service: serviceName,
+			Status:  healthpb.HealthCheckResponse_UNKNOWN,
+			Time:    time.Now(),
+		}, NewGrpcProbeError(StatusStale, "StatusStale")
+	}
+	return e.res, e.err
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startTestPoller polls echo on addr every interval until the test ends.
+func startTestPoller(t *testing.T, addr string, interval, maxStaleness time.Duration) *Poller {
+	t.Helper()
+	pl := NewPoller(newTestProber(t, Config{Addr: addr}), PollConfig{
+		Services:     map[string]time.Duration{"echo": interval},
+		MaxStaleness: maxStaleness,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	pl.Start(ctx)
+	return pl
+}
+
+// waitForPolled waits for c to report st for echo without an error.
+func waitForPolled(t *testing.T, c Checker, st healthpb.HealthCheckResponse_ServingStatus) *Result {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := c.Check(context.Background(), "echo")
+		if err == nil && res.Status == st {
+			return res
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Check() = %v, %v, want %s", res, err, st)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPollerNoResultYet(t *testing.T) {
+	pl := NewPoller(&Prober{name: "test", logger: discardLogger}, PollConfig{Services: map[string]time.Duration{"echo": time.Second}})
+	res, err := pl.Check(context.Background(), "echo")
+	var pe *GrpcProbeError
+	if !errors.As(err, &pe) || pe.Code != StatusStale || res.Status != healthpb.HealthCheckResponse_UNKNOWN {
+		t.Errorf("Check() before the first poll = %v, %v, want UNKNOWN and StatusStale", res, err)
+	}
+	if !pl.Tracks("echo") || pl.Tracks("other") {
+		t.Errorf("Tracks() does not match the polled services")
+	}
+}
+
+func TestPollerServesPolledStatus(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("other", healthpb.HealthCheckResponse_NOT_SERVING)
+	pl := startTestPoller(t, addr, 10*time.Millisecond, 0)
+
+	first := waitForPolled(t, pl, healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if res := waitForPolled(t, pl, healthpb.HealthCheckResponse_NOT_SERVING); !res.Time.After(first.Time) {
+		t.Errorf("polled result time %v is not after the first poll at %v", res.Time, first.Time)
+	}
+
+	// services that are not polled are checked live
+	if res, err := pl.Check(context.Background(), "other"); err != nil || res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check() of an unpolled service = %v, %v, want NOT_SERVING", res, err)
+	}
+}
+
+func TestPollerMaxStaleness(t *testing.T) {
+	const maxStaleness = 100 * time.Millisecond
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	// only the first poll happens within the test
+	pl := startTestPoller(t, addr, time.Hour, maxStaleness)
+
+	polled := waitForPolled(t, pl, healthpb.HealthCheckResponse_SERVING)
+	time.Sleep(time.Until(polled.Time.Add(maxStaleness + 10*time.Millisecond)))
+	res, err := pl.Check(context.Background(), "echo")
+	var pe *GrpcProbeError
+	if !errors.As(err, &pe) || pe.Code != StatusStale {
+		t.Fatalf("Check() past MaxStaleness error = %v, want StatusStale", err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_UNKNOWN || !res.Time.After(polled.Time) {
+		t.Errorf("Check() past MaxStaleness = %s at %v, want UNKNOWN after the last poll at %v", res.Status, res.Time, polled.Time)
+	}
+}
+
+func TestPollerStalenessFlipsHysteresis(t *testing.T) {
+	const maxStaleness = 50 * time.Millisecond
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	pl := startTestPoller(t, addr, time.Hour, maxStaleness)
+	h := NewHysteresis(pl.prober, pl, HysteresisConfig{Default: Thresholds{Rise: 2, Fall: 2}})
+
+	polled := waitForPolled(t, pl, healthpb.HealthCheckResponse_SERVING)
+	if res, err := h.Check(context.Background(), "echo"); err != nil || res.Hysteresis.State != StateUp {
+		t.Fatalf("polled check = %s, %v, want UP", res.Hysteresis.State, err)
+	}
+	time.Sleep(time.Until(polled.Time.Add(maxStaleness + 10*time.Millisecond)))
+	res, err := h.Check(context.Background(), "echo")
+	if err != nil || res.Hysteresis.State != StateGoingDown || res.Hysteresis.Count != 1 {
+		t.Fatalf("first stale check = %s count %d, %v, want GOING_DOWN count 1 without an error", res.Hysteresis.State, res.Hysteresis.Count, err)
+	}
+	res, err = h.Check(context.Background(), "echo")
+	var pe *GrpcProbeError
+	if !errors.As(err, &pe) || pe.Code != StatusStale || res.Hysteresis.State != StateDown || res.Status != healthpb.HealthCheckResponse_UNKNOWN {
+		t.Errorf("second stale check = %s %s, %v, want DOWN, UNKNOWN and StatusStale", res.Hysteresis.State, res.Status, err)
+	}
+}
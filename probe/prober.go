@@ -0,0 +1,482 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package probe implements a client for the gRPC Health Checking Protocol
+// (grpc.health.v1.Health).  It is used by the grpc_health_proxy binary and
+// can be embedded in other Go programs and tests.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Config describes the upstream gRPC server a Prober checks.
+type Config struct {
+	// Name identifies the upstream in metrics (the target label) and logs.
+	// Addr is used if empty.
+	Name string
+	// Addr is the upstream gRPC host:port.
+	Addr string
+	// UserAgent is sent as the user-agent of every health rpc.
+	UserAgent string
+	// ConnTimeout bounds how long a probe waits for the upstream connection
+	// to become READY before failing with StatusConnectionFailure.
+	ConnTimeout time.Duration
+	// RPCTimeout bounds each health rpc.
+	RPCTimeout time.Duration
+
+	// TLS enables transport security to the upstream server.  The remaining
+	// TLS* fields are only used when TLS is set.
+	TLS           bool
+	TLSNoVerify   bool
+	TLSCACert     string
+	TLSClientCert string
+	TLSClientKey  string
+	TLSServerName string
+	// TLSSPIFFEID, TLSURISAN and TLSSANRegex verify the upstream by the
+	// identity in its certificate instead of by host name: the certificate
+	// must be the SPIFFE ID TLSSPIFFEID, carry the URI SAN TLSURISAN, or
+	// carry a DNS or URI SAN matching TLSSANRegex in full.  At most one can
+	// be set.
+	TLSSPIFFEID string
+	TLSURISAN   string
+	TLSSANRegex string
+	// TLSPins and the pins in TLSPinsFile (one per line) are base64 sha256
+	// hashes of SubjectPublicKeyInfos, see SPKISHA256.  If any are set, a
+	// certificate of the verified upstream chain must match one of them;
+	// with TLSNoVerify the upstream is trusted by its pinned leaf alone.
+	// TLSPinsFile is reloaded like the certificates.
+	TLSPins     []string
+	TLSPinsFile string
+	// Revocation configures the revocation checking of the upstream
+	// certificate chain.  Its OCSPTimeout is limited to half of
+	// ConnTimeout.
+	Revocation RevocationConfig
+	// TLSReloadInterval, if set, is how often TLSClientCert, TLSClientKey,
+	// TLSCACert, TLSPinsFile and the CRL files are checked for changes;
+	// changed files are used for new connections.
+	TLSReloadInterval time.Duration
+
+	// Retry configures retries of failed health rpcs.  Retries are disabled
+	// by default.
+	Retry RetryPolicy
+
+	// KnownServices, if not nil, bounds the service_name label of metrics.
+	// Services neither in it nor matching KnownServicesRegex are labelled
+	// UnknownServiceLabel, so callers probing arbitrary names cannot create
+	// arbitrary label values.
+	KnownServices      []string
+	KnownServicesRegex *regexp.Regexp
+
+	// Logger receives probe logs.  slog.Default() is used if nil.
+	Logger *slog.Logger
+}
+
+// UnknownServiceLabel is the service_name label of services that are not
+// known, see Config.KnownServices.
+const UnknownServiceLabel = "_unknown"
+
+// Result is the outcome of a single Check.
+type Result struct {
+	Service  string
+	Status   healthpb.HealthCheckResponse_ServingStatus
+	Time     time.Time
+	Duration time.Duration
+	// Timing breaks Duration down into phases.
+	Timing Timing
+	// Attempts is the number of health rpcs made, including retries.
+	Attempts int
+	// Cache and Age are set on results returned by a Cache: Cache is one
+	// of CacheMiss, CacheHit or CacheCoalesced and Age is the age of a
+	// cached result.
+	Cache string
+	Age   time.Duration
+	// Hysteresis is set on results returned by a Hysteresis.
+	Hysteresis *HysteresisState
+}
+
+// Checker is implemented by anything that can answer a health Check for a
+// service, either live (Prober) or from cached state (Poller).
+type Checker interface {
+	Check(ctx context.Context, serviceName string) (*Result, error)
+}
+
+// ListResult is the outcome of a single List.
+type ListResult struct {
+	Statuses map[string]healthpb.HealthCheckResponse_ServingStatus
+	Time     time.Time
+	Duration time.Duration
+	Timing   Timing
+	Attempts int
+}
+
+// Healthy reports whether every service in the result whose name matches
+// filter is SERVING.  A nil filter matches every service.  The "" entry, the
+// overall server health, always counts: it is the only entry of an Overall
+// result, which a filter would otherwise report as healthy whatever its
+// status.
+func (r *ListResult) Healthy(filter func(serviceName string) bool) bool {
+	for s, st := range r.Statuses {
+		if s != "" && filter != nil && !filter(s) {
+			continue
+		}
+		if st != healthpb.HealthCheckResponse_SERVING {
+			return false
+		}
+	}
+	return true
+}
+
+// Prober runs gRPC health checks against one upstream server.  All probes
+// share a single long-lived ClientConn which reconnects on its own; call
+// Close to release it.
+type Prober struct {
+	name   string
+	cfg    Config
+	opts   []grpc.DialOption
+	logger *slog.Logger
+	// known (and cfg.KnownServicesRegex) are the services labelled by name
+	// in metrics; nil if labels are not bounded.
+	known map[string]bool
+
+	conn   *grpc.ClientConn
+	cancel context.CancelFunc
+	// certs reloads the TLS files, if TLSReloadInterval is set.
+	certs *CertReloader
+
+	mu sync.Mutex
+	// transportErr is the last dial or handshake failure, cleared once the
+	// connection is READY.
+	transportErr error
+	// setup is the timing of the last connection attempt.
+	setup Timing
+}
+
+// NewProber validates cfg and returns a Prober for it.
+func NewProber(cfg Config) (*Prober, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("probe: upstream address not specified")
+	}
+	if cfg.ConnTimeout <= 0 {
+		return nil, fmt.Errorf("probe: connect timeout must be greater than zero (specified: %v)", cfg.ConnTimeout)
+	}
+	if cfg.RPCTimeout <= 0 {
+		return nil, fmt.Errorf("probe: rpc timeout must be greater than zero (specified: %v)", cfg.RPCTimeout)
+	}
+	if cfg.Retry.enabled() && (cfg.Retry.InitialBackoff <= 0 || cfg.Retry.MaxBackoff < cfg.Retry.InitialBackoff) {
+		return nil, fmt.Errorf("probe: retry backoff must be greater than zero and not exceed the max backoff (specified: %v, %v)", cfg.Retry.InitialBackoff, cfg.Retry.MaxBackoff)
+	}
+
+	if !cfg.TLS && (cfg.TLSNoVerify || cfg.TLSCACert != "" || cfg.TLSClientCert != "" || cfg.TLSServerName != "") {
+		return nil, errors.New("probe: TLS options specified without TLS")
+	}
+	if (cfg.TLSClientCert == "") != (cfg.TLSClientKey == "") {
+		return nil, errors.New("probe: TLS client certificate and key must be specified together")
+	}
+	if cfg.TLSNoVerify && (cfg.TLSCACert != "" || cfg.TLSServerName != "") {
+		return nil, errors.New("probe: TLS CA certificate and server name cannot be used without verification")
+	}
+	if !cfg.TLS && (cfg.TLSSPIFFEID != "" || cfg.TLSURISAN != "" || cfg.TLSSANRegex != "") {
+		return nil, errors.New("probe: TLS identity specified without TLS")
+	}
+	if !cfg.TLS && (len(cfg.TLSPins) > 0 || cfg.TLSPinsFile != "") {
+		return nil, errors.New("probe: TLS pins specified without TLS")
+	}
+	if cfg.Revocation.Enabled() && (!cfg.TLS || cfg.TLSNoVerify) {
+		return nil, errors.New("probe: revocation checking requires TLS with verification")
+	}
+	if cfg.TLSNoVerify && (cfg.TLSSPIFFEID != "" || cfg.TLSURISAN != "" || cfg.TLSSANRegex != "") {
+		return nil, errors.New("probe: TLS identity cannot be verified without verification")
+	}
+
+	p := &Prober{
+		name:   cfg.Name,
+		cfg:    cfg,
+		logger: cfg.Logger,
+	}
+	if p.name == "" {
+		p.name = cfg.Addr
+	}
+	if cfg.KnownServices != nil {
+		p.known = map[string]bool{}
+		for _, s := range cfg.KnownServices {
+			p.known[s] = true
+		}
+	}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+	if cfg.Name != "" {
+		p.logger = p.logger.With(slog.String("target", cfg.Name))
+	}
+	// OCSP requests run within the handshake, so they must give up early
+	// enough for a soft fail to leave the connection time to become ready
+	if maxOCSP := cfg.ConnTimeout / 2; cfg.Revocation.OCSP || cfg.Revocation.OCSPResponder != "" {
+		if cfg.Revocation.OCSPTimeout > maxOCSP {
+			p.logger.Warn("OCSP timeout limited to half the connect timeout", slog.Duration("ocsp_timeout", cfg.Revocation.OCSPTimeout), slog.Duration("limit", maxOCSP))
+		}
+		if cfg.Revocation.OCSPTimeout <= 0 || cfg.Revocation.OCSPTimeout > maxOCSP {
+			cfg.Revocation.OCSPTimeout = maxOCSP
+			p.cfg = cfg
+		}
+	}
+
+	if cfg.UserAgent != "" {
+		p.opts = append(p.opts, grpc.WithUserAgent(cfg.UserAgent))
+	}
+	if !strings.HasPrefix(cfg.Addr, "unix:") {
+		p.opts = append(p.opts, grpc.WithContextDialer(p.dial), grpc.WithResolvers(&dnsResolverBuilder{p: p}))
+	}
+	p.opts = append(p.opts, grpc.WithStatsHandler(statsHandler{}))
+	if cfg.TLS {
+		creds, certs, err := buildGrpcCredentials(p.name, cfg, p.logger)
+		if err != nil {
+			return nil, err
+		}
+		p.certs = certs
+		p.opts = append(p.opts, grpc.WithTransportCredentials(&recordingCreds{TransportCredentials: creds, p: p}))
+	} else {
+		p.opts = append(p.opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+
+	conn, err := grpc.NewClient(cfg.Addr, p.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("probe: failed to create client for %s: %v", cfg.Addr, err)
+	}
+	p.conn = conn
+
+	var ctx context.Context
+	ctx, p.cancel = context.WithCancel(context.Background())
+	go p.watchState(ctx)
+	if p.certs != nil {
+		p.certs.Start(ctx, cfg.TLSReloadInterval)
+	}
+	conn.Connect()
+	return p, nil
+}
+
+// Name returns the name the Prober reports in metrics and logs.
+func (p *Prober) Name() string {
+	return p.name
+}
+
+// serviceLabel returns the service_name label of serviceName.  It depends
+// only on the configuration, not on what the upstream answered.
+func (p *Prober) serviceLabel(serviceName string) string {
+	if p.known == nil || p.known[serviceName] || (p.cfg.KnownServicesRegex != nil && p.cfg.KnownServicesRegex.MatchString(serviceName)) {
+		return serviceName
+	}
+	return UnknownServiceLabel
+}
+
+// Close stops state tracking and closes the upstream connection.
+func (p *Prober) Close() error {
+	p.cancel()
+	return p.conn.Close()
+}
+
+// Check calls grpc.health.v1.Health/Check for serviceName.  A non-nil error
+// is always a *GrpcProbeError.
+func (p *Prober) Check(ctx context.Context, serviceName string) (*Result, error) {
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	res := &Result{
+		Service: serviceName,
+		Status:  healthpb.HealthCheckResponse_UNKNOWN,
+		Time:    start,
+	}
+	defer func() {
+		res.Duration = time.Since(start)
+		serviceDuration.WithLabelValues(p.name, p.serviceLabel(serviceName)).Observe(res.Duration.Seconds())
+	}()
+
+	p.logger.Info("establishing connection")
+	connStart := time.Now()
+	established, pe := p.connect(ctx)
+	res.Timing.Connect = time.Since(connStart)
+	if established {
+		setup := p.lastSetup()
+		res.Timing.DNS, res.Timing.TCP, res.Timing.TLS = setup.DNS, setup.TCP, setup.TLS
+	}
+	if pe != nil {
+		probeErrors.WithLabelValues(p.name, p.serviceLabel(serviceName), pe.Message, pe.Reason).Inc()
+		return res, pe
+	}
+	p.logger.Info("connection established", slog.Duration("duration", res.Timing.Connect))
+
+	p.logger.Info("Running HealthCheck for service:", slog.String("service_name", serviceName))
+
+	var trailer metadata.MD
+	var resp *healthpb.HealthCheckResponse
+	attempts, err := p.invoke(ctx, p.serviceLabel(serviceName), func(ctx context.Context) error {
+		rpcStart := time.Now()
+		rpcCtx, rpcTiming := withRPCTiming(ctx)
+		trailer = nil
+		var err error
+		resp, err = healthpb.NewHealthClient(p.conn).Check(rpcCtx, &healthpb.HealthCheckRequest{Service: serviceName}, grpc.Trailer(&trailer))
+		rpcTiming.apply(&res.Timing, time.Since(rpcStart))
+		p.observeRPC(p.serviceLabel(serviceName), res.Timing)
+		return err
+	})
+	res.Attempts = attempts
+	label := p.serviceLabel(serviceName)
+	if err != nil {
+		pe := classifyRPCError(err, trailer)
+		grpcReqs.WithLabelValues(p.name, pe.GrpcCode.String(), label).Inc()
+		probeErrors.WithLabelValues(p.name, label, pe.Message, pe.Reason).Inc()
+		switch pe.Code {
+		case StatusUnimplemented:
+			p.logger.Warn("error: this server does not implement the grpc health protocol (grpc.health.v1.Health)")
+		case StatusServiceNotFound:
+			// wrap a grpC NOT_FOUND as grpcProbeError.
+			// https://github.com/grpc/grpc/blob/master/doc/health-checking.md
+			// if the service name is not registerered, the server returns a NOT_FOUND GPRPC status.
+			// the Check for a not found should "return nil, status.Error(codes.NotFound, "unknown service")"
+			p.logger.Warn("error Service Not Found ", slog.String("", err.Error()))
+			res.Status = healthpb.HealthCheckResponse_SERVICE_UNKNOWN
+		default:
+			if pe.GrpcCode == codes.DeadlineExceeded {
+				p.logger.Warn("error timeout: health rpc did not complete within ", slog.Duration("rpc_timeout", p.cfg.RPCTimeout))
+			} else {
+				p.logger.Warn("error: health rpc failed: ", slog.String("class", pe.Message), slog.String("", err.Error()))
+			}
+		}
+		return res, pe
+	}
+	grpcReqs.WithLabelValues(p.name, resp.GetStatus().String(), label).Inc()
+	// otherwise, retrurn gRPC-HC status
+	p.logTiming(res.Timing, res.Attempts)
+
+	res.Status = resp.GetStatus()
+	return res, nil
+}
+
+// List calls grpc.health.v1.Health/List.  A non-nil error is always a
+// *GrpcProbeError.
+func (p *Prober) List(ctx context.Context) (*ListResult, error) {
+
+	timer := prometheus.NewTimer(serviceDuration.WithLabelValues(p.name, listServiceMetric))
+	defer timer.ObserveDuration()
+
+	ctx, cancel := p.probeContext(ctx)
+	defer cancel()
+
+	start := time.Now()
+	res := &ListResult{
+		Statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{},
+		Time:     start,
+	}
+	defer func() { res.Duration = time.Since(start) }()
+
+	p.logger.Info("establishing connection")
+	connStart := time.Now()
+	established, pe := p.connect(ctx)
+	res.Timing.Connect = time.Since(connStart)
+	if established {
+		setup := p.lastSetup()
+		res.Timing.DNS, res.Timing.TCP, res.Timing.TLS = setup.DNS, setup.TCP, setup.TLS
+	}
+	if pe != nil {
+		probeErrors.WithLabelValues(p.name, listServiceMetric, pe.Message, pe.Reason).Inc()
+		return res, pe
+	}
+	p.logger.Info("connection established", slog.Duration("duration", res.Timing.Connect))
+
+	p.logger.Info("Running ListServices")
+
+	var trailer metadata.MD
+	var resp *healthpb.HealthListResponse
+	attempts, err := p.invoke(ctx, listServiceMetric, func(ctx context.Context) error {
+		rpcStart := time.Now()
+		rpcCtx, rpcTiming := withRPCTiming(ctx)
+		trailer = nil
+		var err error
+		resp, err = healthpb.NewHealthClient(p.conn).List(rpcCtx, &healthpb.HealthListRequest{}, grpc.Trailer(&trailer))
+		rpcTiming.apply(&res.Timing, time.Since(rpcStart))
+		p.observeRPC(listServiceMetric, res.Timing)
+		return err
+	})
+	res.Attempts = attempts
+	if err != nil {
+		pe := classifyRPCError(err, trailer)
+		grpcReqs.WithLabelValues(p.name, pe.GrpcCode.String(), listServiceMetric).Inc()
+		probeErrors.WithLabelValues(p.name, listServiceMetric, pe.Message, pe.Reason).Inc()
+		switch pe.Code {
+		case StatusUnimplemented:
+			p.logger.Warn("error: this server does not implement the grpc health protocol list services (grpc.health.v1.Health)")
+		case StatusServiceNotFound:
+			p.logger.Warn("error Service Not Found ", slog.String("", err.Error()))
+		default:
+			if pe.GrpcCode == codes.DeadlineExceeded {
+				p.logger.Warn("error timeout: health rpc did not complete within ", slog.Duration("rpc_timeout", p.cfg.RPCTimeout))
+			} else {
+				p.logger.Warn("error: health rpc failed: ", slog.String("class", pe.Message), slog.String("", err.Error()))
+			}
+		}
+		return res, pe
+	}
+	for s, r := range resp.GetStatuses() {
+		grpcReqs.WithLabelValues(p.name, r.GetStatus().String(), p.serviceLabel(s)).Inc()
+	}
+	// otherwise, retrurn gRPC-HC status
+	p.logTiming(res.Timing, res.Attempts)
+
+	for s, r := range resp.GetStatuses() {
+		res.Statuses[s] = r.GetStatus()
+	}
+	return res, nil
+}
+
+// Overall checks the overall health of the server, a Check with an empty
+// service name, and reports it as a ListResult with a single "" entry.
+func (p *Prober) Overall(ctx context.Context) (*ListResult, error) {
+	res, err := p.Check(ctx, "")
+	return &ListResult{
+		Statuses: map[string]healthpb.HealthCheckResponse_ServingStatus{"": res.Status},
+		Time:     res.Time,
+		Duration: res.Duration,
+		Timing:   res.Timing,
+		Attempts: res.Attempts,
+	}, err
+}
+
+// ListOrOverall calls List and falls back to Overall if the server does not
+// implement List, as is the case for many older grpc-java and grpc-go
+// releases.
+func (p *Prober) ListOrOverall(ctx context.Context) (*ListResult, error) {
+	res, err := p.List(ctx)
+	if pe, ok := err.(*GrpcProbeError); ok && pe.Code == StatusUnimplemented {
+		p.logger.Info("List is not implemented, falling back to overall server health")
+		return p.Overall(ctx)
+	}
+	return res, err
+}
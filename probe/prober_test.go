@@ -0,0 +1,315 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// startHealthServer serves the grpc health service on a local port until
+// the test ends.
+func startHealthServer(t *testing.T, opts ...grpc.ServerOption) (*health.Server, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(opts...)
+	hs := health.NewServer()
+	healthpb.RegisterHealthServer(srv, hs)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return hs, lis.Addr().String()
+}
+
+// newTestProber returns a Prober for addr that is closed when the test ends.
+func newTestProber(t *testing.T, cfg Config) *Prober {
+	t.Helper()
+	if cfg.ConnTimeout == 0 {
+		cfg.ConnTimeout = 2 * time.Second
+	}
+	if cfg.RPCTimeout == 0 {
+		cfg.RPCTimeout = 2 * time.Second
+	}
+	cfg.Logger = discardLogger
+	p, err := NewProber(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestNewProberValidation(t *testing.T) {
+	valid := Config{Addr: "localhost:50051", ConnTimeout: time.Second, RPCTimeout: time.Second}
+	for _, tc := range []struct {
+		name string
+		edit func(*Config)
+	}{
+		{"no address", func(c *Config) { c.Addr = "" }},
+		{"no connect timeout", func(c *Config) { c.ConnTimeout = 0 }},
+		{"no rpc timeout", func(c *Config) { c.RPCTimeout = 0 }},
+		{"tls options without tls", func(c *Config) { c.TLSCACert = "ca.crt" }},
+		{"client cert without key", func(c *Config) { c.TLS, c.TLSClientCert = true, "client.crt" }},
+		{"ca with no verify", func(c *Config) { c.TLS, c.TLSNoVerify, c.TLSCACert = true, true, "ca.crt" }},
+		{"identity without tls", func(c *Config) { c.TLSSPIFFEID = "spiffe://example.org/svc" }},
+		{"identity with no verify", func(c *Config) { c.TLS, c.TLSNoVerify, c.TLSURISAN = true, true, "urn:svc" }},
+		{"pins without tls", func(c *Config) { c.TLSPinsFile = "pins" }},
+		{"revocation with no verify", func(c *Config) { c.TLS, c.TLSNoVerify, c.Revocation.OCSP = true, true, true }},
+		{"bad retry backoff", func(c *Config) {
+			c.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Millisecond}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := valid
+			tc.edit(&cfg)
+			if p, err := NewProber(cfg); err == nil {
+				p.Close()
+				t.Errorf("NewProber() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestNewProberLimitsOCSPTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{"above the limit", 5 * time.Second, 500 * time.Millisecond},
+		{"within the limit", 200 * time.Millisecond, 200 * time.Millisecond},
+		{"unset", 0, 500 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProber(t, Config{
+				Addr:        "localhost:50051",
+				ConnTimeout: time.Second,
+				TLS:         true,
+				Revocation:  RevocationConfig{OCSP: true, OCSPTimeout: tc.timeout},
+			})
+			if got := p.cfg.Revocation.OCSPTimeout; got != tc.want {
+				t.Errorf("OCSPTimeout = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("serving", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("down", healthpb.HealthCheckResponse_NOT_SERVING)
+	p := newTestProber(t, Config{Addr: addr})
+
+	for _, tc := range []struct {
+		service  string
+		want     healthpb.HealthCheckResponse_ServingStatus
+		wantCode int
+	}{
+		{"", healthpb.HealthCheckResponse_SERVING, 0},
+		{"serving", healthpb.HealthCheckResponse_SERVING, 0},
+		{"down", healthpb.HealthCheckResponse_NOT_SERVING, 0},
+		{"missing", healthpb.HealthCheckResponse_SERVICE_UNKNOWN, StatusServiceNotFound},
+	} {
+		t.Run(tc.service, func(t *testing.T) {
+			res, err := p.Check(context.Background(), tc.service)
+			if res.Status != tc.want {
+				t.Errorf("Check(%q) status = %v, want %v", tc.service, res.Status, tc.want)
+			}
+			if tc.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("Check(%q) error = %v", tc.service, err)
+				}
+				if res.Attempts != 1 || res.Service != tc.service {
+					t.Errorf("Check(%q) = %+v, want one attempt for the service", tc.service, res)
+				}
+				return
+			}
+			pe, ok := err.(*GrpcProbeError)
+			if !ok || pe.Code != tc.wantCode {
+				t.Errorf("Check(%q) error = %v, want code %d", tc.service, err, tc.wantCode)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("a", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("b", healthpb.HealthCheckResponse_NOT_SERVING)
+	p := newTestProber(t, Config{Addr: addr})
+
+	res, err := p.List(context.Background())
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	want := map[string]healthpb.HealthCheckResponse_ServingStatus{
+		"":  healthpb.HealthCheckResponse_SERVING,
+		"a": healthpb.HealthCheckResponse_SERVING,
+		"b": healthpb.HealthCheckResponse_NOT_SERVING,
+	}
+	if len(res.Statuses) != len(want) {
+		t.Fatalf("List() = %v, want %v", res.Statuses, want)
+	}
+	for s, st := range want {
+		if res.Statuses[s] != st {
+			t.Errorf("List()[%q] = %v, want %v", s, res.Statuses[s], st)
+		}
+	}
+	if res.Healthy(nil) {
+		t.Errorf("Healthy(nil) = true with a NOT_SERVING service")
+	}
+	if !res.Healthy(func(s string) bool { return s != "b" }) {
+		t.Errorf("Healthy() = false for a filter excluding the NOT_SERVING service")
+	}
+}
+
+func TestSharedConnection(t *testing.T) {
+	_, addr := startHealthServer(t)
+	p := newTestProber(t, Config{Addr: addr})
+
+	for i := 0; i < 3; i++ {
+		if _, err := p.Check(context.Background(), ""); err != nil {
+			t.Fatalf("Check() #%d error = %v", i, err)
+		}
+	}
+	if st := p.conn.GetState(); st != connectivity.Ready {
+		t.Errorf("connection state = %v, want READY between probes", st)
+	}
+}
+
+func TestOverall(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	p := newTestProber(t, Config{Addr: addr})
+
+	res, err := p.Overall(context.Background())
+	if err != nil {
+		t.Fatalf("Overall() error = %v", err)
+	}
+	if len(res.Statuses) != 1 || res.Statuses[""] != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Overall() = %v, want only \"\" NOT_SERVING", res.Statuses)
+	}
+	if res.Healthy(func(s string) bool { return s == "echo" }) {
+		t.Errorf("Healthy() = true for a NOT_SERVING server with a filter that only matches named services")
+	}
+}
+
+// checkOnlyHealth implements only Check of the health service, reporting
+// NOT_SERVING for the overall server health.
+type checkOnlyHealth struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (checkOnlyHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.GetService() != "" {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+}
+
+func TestListOrOverall(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	p := newTestProber(t, Config{Addr: addr})
+	res, err := p.ListOrOverall(context.Background())
+	if err != nil || len(res.Statuses) != 2 || res.Statuses["echo"] != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("ListOrOverall() with List = %v, %v, want the listed services", res, err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, checkOnlyHealth{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	p = newTestProber(t, Config{Addr: lis.Addr().String()})
+
+	_, err = p.List(context.Background())
+	if pe, ok := err.(*GrpcProbeError); !ok || pe.Code != StatusUnimplemented {
+		t.Fatalf("List() error = %v, want StatusUnimplemented", err)
+	}
+	res, err = p.ListOrOverall(context.Background())
+	if err != nil {
+		t.Fatalf("ListOrOverall() without List error = %v", err)
+	}
+	if len(res.Statuses) != 1 || res.Statuses[""] != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("ListOrOverall() without List = %v, want only \"\" NOT_SERVING", res.Statuses)
+	}
+}
+
+func TestServiceLabel(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("echo.v2", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("other", healthpb.HealthCheckResponse_SERVING)
+	p := newTestProber(t, Config{Name: "labels", Addr: addr, KnownServices: []string{"echo"}, KnownServicesRegex: regexp.MustCompile(`^echo\.`)})
+
+	for s, want := range map[string]string{
+		"echo":    "echo",
+		"echo.v2": "echo.v2",
+		"other":   UnknownServiceLabel,
+		"random":  UnknownServiceLabel,
+	} {
+		// the label must not depend on whether the service was checked
+		// before, nor on the answer
+		for i := range 2 {
+			p.Check(context.Background(), s)
+			if got := p.serviceLabel(s); got != want {
+				t.Errorf("serviceLabel(%q) after %d checks = %q, want %q", s, i+1, got, want)
+			}
+		}
+	}
+	if got := testutil.ToFloat64(grpcReqs.WithLabelValues("labels", "SERVING", "other")); got != 0 {
+		t.Errorf("other was counted under its own label %v times", got)
+	}
+	if got := testutil.ToFloat64(grpcReqs.WithLabelValues("labels", "SERVING", "echo")); got != 2 {
+		t.Errorf("echo was counted %v times under its label, want 2", got)
+	}
+	unknown := testutil.ToFloat64(grpcReqs.WithLabelValues("labels", "SERVING", UnknownServiceLabel))
+	if _, err := p.List(context.Background()); err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if got := testutil.ToFloat64(grpcReqs.WithLabelValues("labels", "SERVING", "other")); got != 0 {
+		t.Errorf("List() counted other under its own label %v times", got)
+	}
+	// other and the overall health "", which is not in KnownServices here
+	if got := testutil.ToFloat64(grpcReqs.WithLabelValues("labels", "SERVING", UnknownServiceLabel)); got != unknown+2 {
+		t.Errorf("List() counted %v services as %s, want 2", got-unknown, UnknownServiceLabel)
+	}
+
+	unbounded := newTestProber(t, Config{Addr: addr})
+	if got := unbounded.serviceLabel("random"); got != "random" {
+		t.Errorf("serviceLabel() without KnownServices = %q, want the name", got)
+	}
+}
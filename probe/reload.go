@@ -0,0 +1,275 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// CertReloader holds a certificate/key pair, a CA bundle, CRLs (and, for an
+// upstream, SPKI pins) loaded from files, and reloads them when the files
+// change.  Any of the files may be empty.  If a reload fails, the previously
+// loaded material stays in use.
+type CertReloader struct {
+	source   string
+	certFile string
+	keyFile  string
+	caFile   string
+	// pinsFile holds the SPKI pins of the upstream, see Config.TLSPinsFile.
+	pinsFile string
+	crlFiles []string
+	logger   *slog.Logger
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+	pins map[string]bool
+	crls []*crlEntry
+	// hashes are the content hashes of the files last loaded successfully.
+	hashes map[string][sha256.Size]byte
+}
+
+// NewCertReloader loads certFile, keyFile, caFile and crlFiles.  source
+// identifies the files in metrics (the source label) and logs.
+func NewCertReloader(source, certFile, keyFile, caFile string, crlFiles []string, logger *slog.Logger) (*CertReloader, error) {
+	return newCertReloader(source, certFile, keyFile, caFile, "", crlFiles, logger)
+}
+
+func newCertReloader(source, certFile, keyFile, caFile, pinsFile string, crlFiles []string, logger *slog.Logger) (*CertReloader, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	r := &CertReloader{
+		source:   source,
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		pinsFile: pinsFile,
+		crlFiles: crlFiles,
+		logger:   logger,
+	}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reloadFile is a file of a CertReloader along with its role: cert, key,
+// ca, pins or crl, the file label of grpc_health_check_tls_reloads.
+type reloadFile struct {
+	role string
+	path string
+}
+
+func (r *CertReloader) files() []reloadFile {
+	var files []reloadFile
+	for _, f := range []reloadFile{{"cert", r.certFile}, {"key", r.keyFile}, {"ca", r.caFile}, {"pins", r.pinsFile}} {
+		if f.path != "" {
+			files = append(files, f)
+		}
+	}
+	for _, f := range r.crlFiles {
+		files = append(files, reloadFile{"crl", f})
+	}
+	return files
+}
+
+// Reload loads the files again if the content of any of them changed since
+// the last successful load, and reports whether it did.  Files are read
+// once and parsed from what was read, so a file replaced during a reload
+// cannot be half seen; a file caught while being written fails to parse and
+// is loaded by the next Reload instead.
+func (r *CertReloader) Reload() (bool, error) {
+	files := r.files()
+	data := map[string][]byte{}
+	hashes := map[string][sha256.Size]byte{}
+	for _, f := range files {
+		b, err := os.ReadFile(f.path)
+		if err != nil {
+			return false, r.failed(f.role, fmt.Errorf("failed to read %s file %s: %v", f.role, f.path, err))
+		}
+		data[f.path] = b
+		hashes[f.path] = sha256.Sum256(b)
+	}
+	r.mu.RLock()
+	changed := r.hashes == nil || !maps.Equal(r.hashes, hashes)
+	r.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		keyPair, err := tls.X509KeyPair(data[r.certFile], data[r.keyFile])
+		if err != nil {
+			return false, r.failed("cert", fmt.Errorf("failed to load tls cert/key pair. error=%v", err))
+		}
+		cert = &keyPair
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data[r.caFile]) {
+			return false, r.failed("ca", fmt.Errorf("no root CA certs parsed from file %s", r.caFile))
+		}
+	}
+
+	var pins map[string]bool
+	if r.pinsFile != "" {
+		var err error
+		if pins, err = parsePins(data[r.pinsFile]); err != nil {
+			return false, r.failed("pins", fmt.Errorf("invalid SPKI pins in file %s: %v", r.pinsFile, err))
+		}
+	}
+
+	var crls []*crlEntry
+	for _, f := range r.crlFiles {
+		crl, err := parseCRL(f, data[f])
+		if err != nil {
+			return false, r.failed("crl", err)
+		}
+		crls = append(crls, crl)
+	}
+
+	r.mu.Lock()
+	first := r.hashes == nil
+	r.cert, r.pool, r.pins, r.crls, r.hashes = cert, pool, pins, crls, hashes
+	r.mu.Unlock()
+
+	for _, f := range files {
+		tlsReloads.WithLabelValues(r.source, f.role, "success").Inc()
+	}
+	if cert != nil && cert.Leaf != nil {
+		tlsCertExpiry.WithLabelValues(r.source).Set(float64(cert.Leaf.NotAfter.Unix()))
+	}
+	for i, crl := range crls {
+		crlNextUpdate.WithLabelValues(r.source, r.crlFiles[i]).Set(float64(crl.list.NextUpdate.Unix()))
+	}
+	if !first {
+		attrs := []any{slog.String("source", r.source)}
+		if cert != nil && cert.Leaf != nil {
+			attrs = append(attrs, slog.Time("not_after", cert.Leaf.NotAfter))
+		}
+		r.logger.Info("reloaded tls certificates", attrs...)
+	}
+	return true, nil
+}
+
+func (r *CertReloader) failed(role string, err error) error {
+	tlsReloads.WithLabelValues(r.source, role, "failure").Inc()
+	return err
+}
+
+// Start reloads the files every interval until ctx is cancelled.
+func (r *CertReloader) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := r.Reload(); err != nil {
+					r.logger.Error("failed to reload tls certificates, keeping the previous ones", slog.String("source", r.source), slog.String("", err.Error()))
+				}
+			}
+		}
+	}()
+}
+
+// Certificate returns the current certificate/key pair, or nil if there is
+// no certFile.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert
+}
+
+// CertPool returns the current CA bundle, or nil if there is no caFile.
+func (r *CertReloader) CertPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// Pins returns the current SPKI pins, or nil if there is no pins file.
+func (r *CertReloader) Pins() map[string]bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pins
+}
+
+// CRLs returns the current CRLs.
+func (r *CertReloader) CRLs() []*crlEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.crls
+}
+
+// GetCertificate is a tls.Config.GetCertificate returning the current
+// certificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate loaded from %s", r.certFile)
+}
+
+// GetClientCertificate is a tls.Config.GetClientCertificate returning the
+// current certificate, or none if there is no certFile.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil
+}
+
+// reloadingCreds are upstream TransportCredentials that pick up the current
+// client certificate and CA bundle on every handshake.
+type reloadingCreds struct {
+	credentials.TransportCredentials
+	base  *tls.Config
+	files *CertReloader
+}
+
+func (c *reloadingCreds) config() *tls.Config {
+	cfg := c.base.Clone()
+	cfg.GetClientCertificate = c.files.GetClientCertificate
+	if pool := c.files.CertPool(); pool != nil {
+		cfg.RootCAs = pool
+	}
+	return cfg
+}
+
+func (c *reloadingCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return credentials.NewTLS(c.config()).ClientHandshake(ctx, authority, rawConn)
+}
+
+func (c *reloadingCreds) Clone() credentials.TransportCredentials {
+	return &reloadingCreds{TransportCredentials: c.TransportCredentials.Clone(), base: c.base, files: c.files}
+}
@@ -0,0 +1,140 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "root", nil)
+	cert, key := ca.issue(t, "localhost")
+	certFile := writeTestFile(t, dir, "cert.pem", certPEM(cert))
+	keyFile := writeTestFile(t, dir, "key.pem", keyPEM(t, key))
+	caFile := writeTestFile(t, dir, "ca.pem", certPEM(ca.cert))
+	crlFile := writeTestFile(t, dir, "ca.crl", ca.crl(t, time.Now(), time.Now().Add(time.Hour)))
+
+	r, err := NewCertReloader("reload-test", certFile, keyFile, caFile, []string{crlFile}, discardLogger)
+	if err != nil {
+		t.Fatalf("NewCertReloader() error = %v", err)
+	}
+	if got := r.Certificate(); got == nil || !got.Leaf.Equal(cert) {
+		t.Fatalf("Certificate() = %v, want the loaded certificate", got)
+	}
+	if r.CertPool() == nil || len(r.CRLs()) != 1 {
+		t.Fatalf("CertPool() = %v and %d CRLs, want the CA and one CRL", r.CertPool(), len(r.CRLs()))
+	}
+	if got := testutil.ToFloat64(tlsReloads.WithLabelValues("reload-test", "cert", "success")); got != 1 {
+		t.Errorf("cert loads = %v, want 1", got)
+	}
+
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of unchanged files = %v, %v, want no reload", reloaded, err)
+	}
+	// rewriting the same content changes the modification time only
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if reloaded, err := r.Reload(); reloaded || err != nil {
+		t.Errorf("Reload() of a touched file = %v, %v, want no reload", reloaded, err)
+	}
+
+	// a certificate replaced in two steps: the key does not match until the
+	// second one, and the old pair stays in use meanwhile
+	cert2, key2 := ca.issue(t, "localhost")
+	writeTestFile(t, dir, "cert.pem", certPEM(cert2))
+	if reloaded, err := r.Reload(); reloaded || err == nil {
+		t.Errorf("Reload() of a mismatched pair = %v, %v, want an error", reloaded, err)
+	}
+	if !r.Certificate().Leaf.Equal(cert) {
+		t.Errorf("Certificate() after a failed reload is not the previous one")
+	}
+	if got := testutil.ToFloat64(tlsReloads.WithLabelValues("reload-test", "cert", "failure")); got != 1 {
+		t.Errorf("cert load failures = %v, want 1", got)
+	}
+	writeTestFile(t, dir, "key.pem", keyPEM(t, key2))
+	if reloaded, err := r.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload() of the new pair = %v, %v, want a reload", reloaded, err)
+	}
+	if !r.Certificate().Leaf.Equal(cert2) {
+		t.Errorf("Certificate() after the reload is not the new one")
+	}
+}
+
+func TestCertReloaderPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "root", nil)
+	caPEM := certPEM(ca.cert)
+	caFile := writeTestFile(t, dir, "ca.pem", caPEM)
+	r, err := NewCertReloader("reload-partial", "", "", caFile, nil, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := r.CertPool()
+
+	// a writer caught half way through a new bundle
+	ca2 := newTestCA(t, "root2", nil)
+	bundle := certPEM(ca.cert, ca2.cert)
+	writeTestFile(t, dir, "ca.pem", bundle[:len(caPEM)/2])
+	if _, err := r.Reload(); err == nil {
+		t.Errorf("Reload() of a half written file succeeded")
+	}
+	if r.CertPool() != pool {
+		t.Errorf("CertPool() changed after a failed reload")
+	}
+	// the file is loaded once complete, even though its previous, broken
+	// version was already seen
+	writeTestFile(t, dir, "ca.pem", bundle)
+	if reloaded, err := r.Reload(); !reloaded || err != nil {
+		t.Errorf("Reload() of the complete file = %v, %v, want a reload", reloaded, err)
+	}
+	if got := testutil.ToFloat64(tlsReloads.WithLabelValues("reload-partial", "ca", "failure")); got != 1 {
+		t.Errorf("ca load failures = %v, want 1", got)
+	}
+}
+
+func TestCertReloaderErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "root", nil)
+	for _, tc := range []struct {
+		name    string
+		caData  []byte
+		crlData []byte
+		wantErr string
+	}{
+		{"bad ca", []byte("not a certificate"), nil, "no root CA certs"},
+		{"bad crl", certPEM(ca.cert), []byte("not a crl"), "failed to parse CRL"},
+		{"crl pem type", certPEM(ca.cert), certPEM(ca.cert), "unexpected PEM block"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			caFile := writeTestFile(t, dir, "ca.pem", tc.caData)
+			var crls []string
+			if tc.crlData != nil {
+				crls = append(crls, writeTestFile(t, dir, "ca.crl", tc.crlData))
+			}
+			if _, err := NewCertReloader("reload-errors", "", "", caFile, crls, discardLogger); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("NewCertReloader() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := NewCertReloader("reload-errors", "", "", dir+"/missing.pem", nil, discardLogger); err == nil {
+		t.Errorf("NewCertReloader() of a missing file succeeded")
+	}
+}
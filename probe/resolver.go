@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/dns"
+)
+
+// dnsMinResolveInterval is the default minimum interval between two
+// resolutions of grpc's dns resolver, which the proxy does not change.
+const dnsMinResolveInterval = 30 * time.Second
+
+// dnsResolverBuilder builds the resolver of dns targets, the default.  It
+// delegates to grpc's dns resolver, so that targets resolve exactly as they
+// would without the proxy (A, AAAA and TXT service config records, DNS
+// servers named in dns://server/host:port, re-resolution limits), and times
+// its resolutions for the dns phase, which grpc does not expose.
+//
+// A resolution is timed from the moment grpc's resolver starts it, when the
+// resolver is built or when ResolveNow is called at least
+// dnsMinResolveInterval after the last successful resolution, until it
+// delivers the addresses.  Resolutions that grpc defers or retries after a
+// failure are not timed, nor are IP address targets.
+type dnsResolverBuilder struct {
+	p *Prober
+}
+
+func (b *dnsResolverBuilder) Scheme() string { return "dns" }
+
+func (b *dnsResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	host := target.Endpoint()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	r := &dnsResolver{p: b.p, timed: host != "" && net.ParseIP(host) == nil}
+	if r.timed {
+		r.start = time.Now()
+	}
+	inner, err := dns.NewBuilder().Build(target, &dnsClientConn{ClientConn: cc, r: r}, opts)
+	if err != nil {
+		return nil, err
+	}
+	r.Resolver = inner
+	return r, nil
+}
+
+// dnsResolver is grpc's dns resolver with timed resolutions.
+type dnsResolver struct {
+	resolver.Resolver
+	p     *Prober
+	timed bool
+
+	mu sync.Mutex
+	// start is the start of the resolution in progress, zero if it is not
+	// timed.
+	start time.Time
+	// resolved is the time of the last successful resolution, zero after a
+	// failed one.
+	resolved time.Time
+}
+
+func (r *dnsResolver) ResolveNow(o resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	if r.timed && r.start.IsZero() && !r.resolved.IsZero() && time.Since(r.resolved) >= dnsMinResolveInterval {
+		// grpc's resolver starts a new resolution right away
+		r.start = time.Now()
+	}
+	r.mu.Unlock()
+	r.Resolver.ResolveNow(o)
+}
+
+// done records the end of a resolution, which failed if err is set.  The
+// duration of a timed successful resolution is the dns phase of the
+// connection to one of its addresses.
+func (r *dnsResolver) done(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	start := r.start
+	r.start, r.resolved = time.Time{}, time.Time{}
+	if err != nil {
+		return
+	}
+	r.resolved = now
+	if start.IsZero() {
+		return
+	}
+	d := now.Sub(start)
+	dnsDuration.WithLabelValues(r.p.name).Observe(d.Seconds())
+	r.p.recordSetup(func(t *Timing) { t.DNS = d })
+}
+
+// dnsClientConn reports the results of grpc's dns resolver to its
+// dnsResolver.
+type dnsClientConn struct {
+	resolver.ClientConn
+	r *dnsResolver
+}
+
+func (cc *dnsClientConn) UpdateState(s resolver.State) error {
+	err := cc.ClientConn.UpdateState(s)
+	cc.r.done(err)
+	return err
+}
+
+func (cc *dnsClientConn) ReportError(err error) {
+	cc.r.done(err)
+	cc.ClientConn.ReportError(err)
+}
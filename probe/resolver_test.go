@@ -0,0 +1,170 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// resolverCC is a resolver.ClientConn that records what a resolver reports.
+type resolverCC struct {
+	states chan resolver.State
+	errs   chan error
+}
+
+func newResolverCC() *resolverCC {
+	return &resolverCC{states: make(chan resolver.State, 10), errs: make(chan error, 10)}
+}
+
+// UpdateState rejects a state without addresses, like grpc's ClientConn.
+func (cc *resolverCC) UpdateState(s resolver.State) error {
+	cc.states <- s
+	if len(s.Addresses) == 0 && len(s.Endpoints) == 0 {
+		return errors.New("produced zero addresses")
+	}
+	return nil
+}
+
+func (cc *resolverCC) ReportError(err error) { cc.errs <- err }
+
+func (cc *resolverCC) NewAddress([]resolver.Address) {}
+
+func (cc *resolverCC) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{Err: errors.New("no service config expected")}
+}
+
+// buildResolver builds the dns resolver of p for target until the test ends.
+func buildResolver(t *testing.T, p *Prober, target string) (*dnsResolver, *resolverCC) {
+	t.Helper()
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := newResolverCC()
+	r, err := (&dnsResolverBuilder{p: p}).Build(resolver.Target{URL: *u}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r.(*dnsResolver), cc
+}
+
+func waitForState(t *testing.T, cc *resolverCC) resolver.State {
+	t.Helper()
+	select {
+	case s := <-cc.states:
+		return s
+	case err := <-cc.errs:
+		t.Fatalf("resolver reported %v, want addresses", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("resolver reported nothing")
+	}
+	return resolver.State{}
+}
+
+// waitForDone waits for r to record the end of the resolution in progress,
+// which happens once the ClientConn has processed its result.
+func waitForDone(t *testing.T, r *dnsResolver) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		pending := !r.start.IsZero()
+		r.mu.Unlock()
+		if !pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resolution never completed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDNSResolverTimesHostNames(t *testing.T) {
+	p := &Prober{name: t.Name(), logger: discardLogger}
+	r, cc := buildResolver(t, p, "dns:///localhost:50051")
+
+	s := waitForState(t, cc)
+	waitForDone(t, r)
+	var found bool
+	for _, a := range s.Addresses {
+		if host, port, _ := net.SplitHostPort(a.Addr); net.ParseIP(host).IsLoopback() && port == "50051" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("resolved addresses = %v, want the loopback address of localhost", s.Addresses)
+	}
+	if d := p.lastSetup().DNS; d <= 0 {
+		t.Errorf("Timing.DNS = %v, want the resolution time", d)
+	}
+
+	// grpc's resolver defers a re-resolution within its minimum interval,
+	// which is therefore not timed
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	r.mu.Lock()
+	timing := !r.start.IsZero()
+	r.mu.Unlock()
+	if timing {
+		t.Errorf("ResolveNow() within the minimum interval started timing a resolution")
+	}
+}
+
+func TestDNSResolverIPAddress(t *testing.T) {
+	p := &Prober{name: t.Name(), logger: discardLogger}
+	_, cc := buildResolver(t, p, "dns:///127.0.0.1:50051")
+
+	s := waitForState(t, cc)
+	if len(s.Addresses) != 1 || s.Addresses[0].Addr != "127.0.0.1:50051" {
+		t.Errorf("resolved addresses = %v, want 127.0.0.1:50051", s.Addresses)
+	}
+	if d := p.lastSetup().DNS; d != 0 {
+		t.Errorf("Timing.DNS = %v for an IP address, want 0", d)
+	}
+}
+
+func TestDNSResolverFailure(t *testing.T) {
+	p := &Prober{name: t.Name(), logger: discardLogger}
+	r, cc := buildResolver(t, p, "dns:///grpc-health-proxy-test.invalid:50051")
+
+	// grpc's resolver reports a host that does not exist as one without
+	// addresses
+	select {
+	case <-cc.errs:
+	case s := <-cc.states:
+		if len(s.Addresses) != 0 {
+			t.Fatalf("resolver reported %v, want no addresses", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("resolver reported nothing")
+	}
+	waitForDone(t, r)
+	if d := p.lastSetup().DNS; d != 0 {
+		t.Errorf("Timing.DNS = %v after a failed resolution, want 0", d)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.start.IsZero() || !r.resolved.IsZero() {
+		t.Errorf("failed resolution left start %v, resolved %v; want both cleared", r.start, r.resolved)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy configures retries of failed health rpcs within a single
+// probe.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts including the first one; 0 or 1
+	// disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry; it doubles on
+	// every retry up to MaxBackoff.  The actual delay is jittered between
+	// half the backoff and the backoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Codes are the retryable gRPC status codes.
+	Codes []codes.Code
+	// Deadline bounds the whole probe, connect and all attempts included.
+	// Zero means ConnTimeout+RPCTimeout, the longest a probe takes without
+	// retries.
+	Deadline time.Duration
+}
+
+func (r RetryPolicy) enabled() bool {
+	return r.MaxAttempts > 1
+}
+
+// probeContext bounds ctx by the retry policy deadline, if retries are
+// enabled.
+func (p *Prober) probeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if !p.cfg.Retry.enabled() {
+		return ctx, func() {}
+	}
+	d := p.cfg.Retry.Deadline
+	if d <= 0 {
+		d = p.cfg.ConnTimeout + p.cfg.RPCTimeout
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// invoke calls rpc with an RPCTimeout deadline, retrying failures with a
+// retryable code with exponential backoff until the policy's attempts or ctx
+// run out.  label is the service_name label of retried attempts.  It
+// returns the number of attempts made and the error of the last one.
+func (p *Prober) invoke(ctx context.Context, label string, rpc func(ctx context.Context) error) (int, error) {
+	policy := p.cfg.Retry
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		rpcCtx, cancel := context.WithTimeout(ctx, p.cfg.RPCTimeout)
+		err := rpc(rpcCtx)
+		cancel()
+		code := status.Code(err)
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !slices.Contains(policy.Codes, code) {
+			probeAttempts.WithLabelValues(p.name).Observe(float64(attempt))
+			return attempt, err
+		}
+
+		delay := backoff
+		if backoff > 1 {
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+			// no time left for another attempt
+			probeAttempts.WithLabelValues(p.name).Observe(float64(attempt))
+			return attempt, err
+		}
+		grpcReqs.WithLabelValues(p.name, code.String(), label).Inc()
+		probeRetries.WithLabelValues(p.name, label, code.String()).Inc()
+		p.logger.Info("retrying health rpc", slog.String("service_name", label), slog.Int("attempt", attempt), slog.String("code", code.String()), slog.Duration("backoff", delay))
+		select {
+		case <-ctx.Done():
+			probeAttempts.WithLabelValues(p.name).Observe(float64(attempt))
+			return attempt, err
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, policy.MaxBackoff)
+	}
+}
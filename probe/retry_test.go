@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// flakyHealth fails the first failures Checks with code and reports SERVING
+// afterwards.
+type flakyHealth struct {
+	healthpb.UnimplementedHealthServer
+	failures int32
+	code     codes.Code
+	calls    atomic.Int32
+}
+
+func (h *flakyHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if h.calls.Add(1) <= h.failures {
+		return nil, status.Error(h.code, "flaky")
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func startFlakyServer(t *testing.T, h *flakyHealth) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, h)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+		Codes:          []codes.Code{codes.Unavailable},
+	}
+	for _, tc := range []struct {
+		name         string
+		failures     int32
+		code         codes.Code
+		policy       RetryPolicy
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"recovers", 2, codes.Unavailable, policy, 3, false},
+		{"attempts exhausted", 5, codes.Unavailable, policy, 3, true},
+		{"not retryable", 5, codes.Internal, policy, 1, true},
+		{"disabled", 1, codes.Unavailable, RetryPolicy{}, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &flakyHealth{failures: tc.failures, code: tc.code}
+			p := newTestProber(t, Config{Addr: startFlakyServer(t, h), Retry: tc.policy})
+			res, err := p.Check(context.Background(), "")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Check() error = %v, want error %v", err, tc.wantErr)
+			}
+			if res.Attempts != tc.wantAttempts || int(h.calls.Load()) != tc.wantAttempts {
+				t.Errorf("Check() made %d attempts (server saw %d), want %d", res.Attempts, h.calls.Load(), tc.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	h := &flakyHealth{failures: 100, code: codes.Unavailable}
+	p := newTestProber(t, Config{Addr: startFlakyServer(t, h), Retry: RetryPolicy{
+		MaxAttempts:    100,
+		InitialBackoff: 50 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Codes:          []codes.Code{codes.Unavailable},
+		Deadline:       300 * time.Millisecond,
+	}})
+	start := time.Now()
+	res, err := p.Check(context.Background(), "")
+	if err == nil {
+		t.Fatalf("Check() succeeded, want the last Unavailable error")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Check() took %v, want it bounded by the 300ms deadline", elapsed)
+	}
+	if res.Attempts < 2 || res.Attempts >= 100 {
+		t.Errorf("Check() made %d attempts, want a few within the deadline", res.Attempts)
+	}
+}
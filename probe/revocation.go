@@ -0,0 +1,288 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Revocation status of a certificate, as the result label of
+// grpc_health_check_revocation_checks.
+const (
+	revocationGood    = "good"
+	revocationRevoked = "revoked"
+	revocationUnknown = "unknown"
+)
+
+// ocspErrorTTL is how long a failed OCSP request is cached, so that an
+// unreachable responder is not asked again on every handshake.
+const ocspErrorTTL = 30 * time.Second
+
+// maxOCSPCacheEntries is the number of cached OCSP responses kept before
+// expired ones are dropped.
+const maxOCSPCacheEntries = 10000
+
+// RevocationConfig configures the revocation checking of a peer's
+// certificate chain.  Every certificate of the verified chain but the root
+// is checked against the CRLs of its issuer and, if no current CRL of the
+// issuer is loaded and OCSP is set, with an OCSP request.
+type RevocationConfig struct {
+	// CRLFiles are PEM or DER encoded CRLs, one per file.  They are
+	// reloaded along with the certificates.
+	CRLFiles []string
+	// OCSP enables OCSP checking with the responder named in the
+	// certificate, or OCSPResponder if set.
+	OCSP          bool
+	OCSPResponder string
+	// OCSPTimeout bounds an OCSP request.  OCSPCacheTTL is how long an OCSP
+	// response is used, at most until its nextUpdate.
+	OCSPTimeout  time.Duration
+	OCSPCacheTTL time.Duration
+	// HardFail rejects a certificate whose revocation status cannot be
+	// determined; otherwise it is accepted.
+	HardFail bool
+}
+
+// Enabled reports whether rc checks revocation at all.
+func (rc RevocationConfig) Enabled() bool {
+	return len(rc.CRLFiles) > 0 || rc.OCSP || rc.OCSPResponder != ""
+}
+
+// revocationError is returned by the TLS handshake when a certificate of
+// the peer's chain is revoked, or, with HardFail, when its revocation status
+// is unknown.
+type revocationError struct {
+	subject   string
+	serial    string
+	revokedAt time.Time
+	cause     error
+}
+
+func (e *revocationError) Error() string {
+	if e.revoked() {
+		return fmt.Sprintf("x509: certificate %q (serial %s) was revoked at %s", e.subject, e.serial, e.revokedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("x509: revocation status of certificate %q (serial %s) is unknown: %v", e.subject, e.serial, e.cause)
+}
+
+func (e *revocationError) revoked() bool { return !e.revokedAt.IsZero() }
+
+// crlEntry is a loaded CRL with its revoked serial numbers.
+type crlEntry struct {
+	list    *x509.RevocationList
+	revoked map[string]time.Time
+}
+
+// parseCRL parses data, the PEM or DER contents of the CRL file file.
+func parseCRL(file string, data []byte) (*crlEntry, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block %q in CRL file %s", block.Type, file)
+		}
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL file %s: %v", file, err)
+	}
+	e := &crlEntry{list: list, revoked: map[string]time.Time{}}
+	for _, rc := range list.RevokedCertificateEntries {
+		e.revoked[rc.SerialNumber.String()] = rc.RevocationTime
+	}
+	return e, nil
+}
+
+type ocspCacheEntry struct {
+	status    string
+	revokedAt time.Time
+	err       error
+	expires   time.Time
+}
+
+// RevocationChecker checks certificate chains against the CRLs of a
+// CertReloader and with OCSP.
+type RevocationChecker struct {
+	source    string
+	files     *CertReloader
+	ocsp      bool
+	responder string
+	client    *http.Client
+	cacheTTL  time.Duration
+	hardFail  bool
+	logger    *slog.Logger
+
+	mu    sync.Mutex
+	cache map[string]ocspCacheEntry
+}
+
+// NewRevocationChecker returns a RevocationChecker for the certificates
+// verified against files, which holds the CRLs of rc, or nil if rc is not
+// enabled.
+func NewRevocationChecker(rc RevocationConfig, files *CertReloader) *RevocationChecker {
+	if !rc.Enabled() {
+		return nil
+	}
+	return &RevocationChecker{
+		source:    files.source,
+		files:     files,
+		ocsp:      rc.OCSP || rc.OCSPResponder != "",
+		responder: rc.OCSPResponder,
+		client:    &http.Client{Timeout: rc.OCSPTimeout},
+		cacheTTL:  rc.OCSPCacheTTL,
+		hardFail:  rc.HardFail,
+		logger:    files.logger,
+		cache:     map[string]ocspCacheEntry{},
+	}
+}
+
+// VerifyConnection is a tls.Config.VerifyConnection checking the verified
+// chain of the peer.
+func (c *RevocationChecker) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	return c.Check(cs.VerifiedChains[0])
+}
+
+// Check checks every certificate of a verified chain but the root.
+func (c *RevocationChecker) Check(chain []*x509.Certificate) error {
+	for i := 0; i+1 < len(chain); i++ {
+		if err := c.checkCert(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RevocationChecker) checkCert(cert, issuer *x509.Certificate) error {
+	now := time.Now()
+	method := "crl"
+	status, revokedAt, cause := c.checkCRL(cert, issuer, now)
+	if status == revocationUnknown {
+		if c.ocsp {
+			method = "ocsp"
+			status, revokedAt, cause = c.checkOCSP(cert, issuer, now)
+		} else {
+			method = "none"
+		}
+	}
+	revocationChecks.WithLabelValues(c.source, method, status).Inc()
+
+	attrs := []any{
+		slog.String("source", c.source),
+		slog.String("subject", cert.Subject.String()),
+		slog.String("serial", cert.SerialNumber.String()),
+		slog.String("method", method),
+	}
+	switch status {
+	case revocationRevoked:
+		c.logger.Warn("certificate revoked", append(attrs, slog.Time("revoked_at", revokedAt))...)
+		return &revocationError{subject: cert.Subject.String(), serial: cert.SerialNumber.String(), revokedAt: revokedAt}
+	case revocationUnknown:
+		attrs = append(attrs, slog.String("", cause.Error()))
+		if c.hardFail {
+			c.logger.Warn("revocation status unknown, rejecting certificate", attrs...)
+			return &revocationError{subject: cert.Subject.String(), serial: cert.SerialNumber.String(), cause: cause}
+		}
+		c.logger.Debug("revocation status unknown, accepting certificate", attrs...)
+	}
+	return nil
+}
+
+// checkCRL looks cert up in the current CRLs signed by issuer.
+func (c *RevocationChecker) checkCRL(cert, issuer *x509.Certificate, now time.Time) (string, time.Time, error) {
+	covered, stale := false, false
+	for _, crl := range c.files.CRLs() {
+		if !bytes.Equal(crl.list.RawIssuer, issuer.RawSubject) || crl.list.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		if !crl.list.NextUpdate.IsZero() && now.After(crl.list.NextUpdate) {
+			stale = true
+			continue
+		}
+		if t, ok := crl.revoked[cert.SerialNumber.String()]; ok {
+			return revocationRevoked, t, nil
+		}
+		covered = true
+	}
+	switch {
+	case covered:
+		return revocationGood, time.Time{}, nil
+	case stale:
+		return revocationUnknown, time.Time{}, errors.New("the CRL of the issuer is past its next update")
+	}
+	return revocationUnknown, time.Time{}, errors.New("no CRL of the issuer")
+}
+
+// checkOCSP asks the OCSP responder for the status of cert, or returns the
+// cached answer.
+func (c *RevocationChecker) checkOCSP(cert, issuer *x509.Certificate, now time.Time) (string, time.Time, error) {
+	issuerKey := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+	key := hex.EncodeToString(issuerKey[:]) + "/" + cert.SerialNumber.String()
+	c.mu.Lock()
+	e, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		ocspCacheHits.WithLabelValues(c.source).Inc()
+		return e.status, e.revokedAt, e.err
+	}
+
+	responder := c.responder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return revocationUnknown, time.Time{}, errors.New("the certificate names no OCSP responder")
+		}
+		responder = cert.OCSPServer[0]
+	}
+	res, err := c.queryOCSP(responder, cert, issuer, now)
+	if err != nil {
+		ocspRequests.WithLabelValues(c.source, "error").Inc()
+		e = ocspCacheEntry{status: revocationUnknown, err: err, expires: now.Add(min(ocspErrorTTL, c.cacheTTL))}
+	} else {
+		ocspRequests.WithLabelValues(c.source, res.status).Inc()
+		e = ocspCacheEntry{status: res.status, revokedAt: res.revokedAt, expires: now.Add(c.cacheTTL)}
+		if res.status == revocationUnknown {
+			e.err = fmt.Errorf("OCSP responder %s does not know the certificate", responder)
+		}
+		if !res.nextUpdate.IsZero() && res.nextUpdate.Before(e.expires) {
+			e.expires = res.nextUpdate
+		}
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= maxOCSPCacheEntries {
+		for k, old := range c.cache {
+			if !now.Before(old.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	if len(c.cache) < maxOCSPCacheEntries {
+		c.cache[key] = e
+	}
+	c.mu.Unlock()
+	return e.status, e.revokedAt, e.err
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestRevocationChecker returns the RevocationChecker of rc, with its
+// CRL files loaded by a CertReloader for source.
+func newTestRevocationChecker(t *testing.T, source string, rc RevocationConfig) (*RevocationChecker, *CertReloader) {
+	t.Helper()
+	files, err := newCertReloader(source, "", "", "", "", rc.CRLFiles, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRevocationChecker(rc, files), files
+}
+
+// wantRevoked checks that err is a revocationError for a revoked
+// certificate if revoked is set, and for an unknown status otherwise.
+func wantRevoked(t *testing.T, err error, revoked bool) {
+	t.Helper()
+	var re *revocationError
+	if !errors.As(err, &re) || re.revoked() != revoked {
+		t.Errorf("Check() error = %v, want a revocationError with revoked %v", err, revoked)
+	}
+}
+
+func TestRevocationCheckerCRL(t *testing.T) {
+	root := newTestCA(t, "crl root", nil)
+	inter := newTestCA(t, "crl intermediate", root)
+	good, _ := inter.issue(t, "good")
+	revoked, _ := inter.issue(t, "revoked")
+	now := time.Now()
+	dir := t.TempDir()
+	rc := RevocationConfig{CRLFiles: []string{
+		writeTestFile(t, dir, "root.crl", root.crl(t, now.Add(-time.Minute), now.Add(time.Hour))),
+		writeTestFile(t, dir, "inter.crl", inter.crl(t, now.Add(-time.Minute), now.Add(time.Hour), revoked)),
+	}}
+	c, _ := newTestRevocationChecker(t, "revocation-crl", rc)
+
+	if err := c.Check([]*x509.Certificate{good, inter.cert, root.cert}); err != nil {
+		t.Errorf("Check() of a good chain error = %v", err)
+	}
+	err := c.Check([]*x509.Certificate{revoked, inter.cert, root.cert})
+	wantRevoked(t, err, true)
+	if err == nil || !strings.Contains(err.Error(), revoked.SerialNumber.String()) {
+		t.Errorf("Check() error = %v, want the revoked serial", err)
+	}
+	if got := testutil.ToFloat64(revocationChecks.WithLabelValues("revocation-crl", "crl", revocationRevoked)); got != 1 {
+		t.Errorf("revoked crl checks = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(revocationChecks.WithLabelValues("revocation-crl", "crl", revocationGood)); got != 2 {
+		t.Errorf("good crl checks = %v, want 2", got)
+	}
+}
+
+func TestRevocationCheckerCRLReload(t *testing.T) {
+	ca := newTestCA(t, "crl reload ca", nil)
+	cert, _ := ca.issue(t, "server")
+	now := time.Now()
+	dir := t.TempDir()
+	crlFile := writeTestFile(t, dir, "ca.crl", ca.crl(t, now.Add(-time.Minute), now.Add(time.Hour)))
+	c, files := newTestRevocationChecker(t, "revocation-reload", RevocationConfig{CRLFiles: []string{crlFile}, HardFail: true})
+
+	if err := c.Check([]*x509.Certificate{cert, ca.cert}); err != nil {
+		t.Fatalf("Check() before the revocation error = %v", err)
+	}
+	writeTestFile(t, dir, "ca.crl", ca.crl(t, now.Add(-time.Minute), now.Add(time.Hour), cert))
+	if reloaded, err := files.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload() of the new CRL = %v, %v, want a reload", reloaded, err)
+	}
+	wantRevoked(t, c.Check([]*x509.Certificate{cert, ca.cert}), true)
+
+	// a CRL that fails to parse keeps the last one
+	writeTestFile(t, dir, "ca.crl", []byte("not a crl"))
+	if _, err := files.Reload(); err == nil {
+		t.Errorf("Reload() of a bad CRL succeeded")
+	}
+	wantRevoked(t, c.Check([]*x509.Certificate{cert, ca.cert}), true)
+}
+
+func TestRevocationCheckerFailMode(t *testing.T) {
+	ca := newTestCA(t, "fail mode ca", nil)
+	// an impostor CA with the same name, whose CRLs must not count
+	impostor := newTestCA(t, "fail mode ca", nil)
+	other := newTestCA(t, "fail mode other ca", nil)
+	cert, _ := ca.issue(t, "server")
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name      string
+		crl       []byte
+		wantCause string
+	}{
+		{"crl of another issuer", other.crl(t, now.Add(-time.Minute), now.Add(time.Hour)), "no CRL of the issuer"},
+		{"crl not signed by the issuer", impostor.crl(t, now.Add(-time.Minute), now.Add(time.Hour)), "no CRL of the issuer"},
+		{"stale crl", ca.crl(t, now.Add(-2*time.Hour), now.Add(-time.Hour)), "past its next update"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			crlFiles := []string{writeTestFile(t, t.TempDir(), "ca.crl", tc.crl)}
+			for _, hardFail := range []bool{false, true} {
+				c, _ := newTestRevocationChecker(t, "revocation-fail-mode", RevocationConfig{CRLFiles: crlFiles, HardFail: hardFail})
+				err := c.Check([]*x509.Certificate{cert, ca.cert})
+				if !hardFail {
+					if err != nil {
+						t.Errorf("soft fail Check() error = %v, want the certificate accepted", err)
+					}
+					continue
+				}
+				wantRevoked(t, err, false)
+				if err == nil || !strings.Contains(err.Error(), tc.wantCause) {
+					t.Errorf("hard fail Check() error = %v, want %q", err, tc.wantCause)
+				}
+			}
+		})
+	}
+
+	// the impostor's CRL revoking the certificate is ignored too
+	crlFile := writeTestFile(t, t.TempDir(), "impostor.crl", impostor.crl(t, now.Add(-time.Minute), now.Add(time.Hour), cert))
+	c, _ := newTestRevocationChecker(t, "revocation-fail-mode", RevocationConfig{CRLFiles: []string{crlFile}})
+	if err := c.Check([]*x509.Certificate{cert, ca.cert}); err != nil {
+		t.Errorf("Check() with a forged CRL error = %v, want it ignored", err)
+	}
+}
+
+func TestRevocationCheckerOCSP(t *testing.T) {
+	ca := newTestCA(t, "ocsp checker ca", nil)
+	good, _ := ca.issue(t, "good")
+	revoked, _ := ca.issue(t, "revoked")
+	url, hits := startOCSPResponder(t, ca, func(req *ocsp.Request, nonce []byte) []byte {
+		cert, tmpl := good, ocsp.Response{Status: ocsp.Good, ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+		if req.SerialNumber.Cmp(revoked.SerialNumber) == 0 {
+			cert, tmpl.Status, tmpl.RevokedAt = revoked, ocsp.Revoked, time.Now().Add(-time.Hour)
+		}
+		return ca.ocspResponse(t, cert, tmpl, ca.cert, ca.key)
+	})
+	rc := RevocationConfig{OCSPResponder: url, OCSPTimeout: 5 * time.Second, OCSPCacheTTL: time.Minute, HardFail: true}
+	c, _ := newTestRevocationChecker(t, "revocation-ocsp", rc)
+
+	for range 2 {
+		if err := c.Check([]*x509.Certificate{good, ca.cert}); err != nil {
+			t.Errorf("Check() of a good certificate error = %v", err)
+		}
+		wantRevoked(t, c.Check([]*x509.Certificate{revoked, ca.cert}), true)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("OCSP responder asked %d times, want 2 with the answers cached", n)
+	}
+	if got := testutil.ToFloat64(ocspCacheHits.WithLabelValues("revocation-ocsp")); got != 2 {
+		t.Errorf("OCSP cache hits = %v, want 2", got)
+	}
+
+	for _, hardFail := range []bool{false, true} {
+		rc := RevocationConfig{OCSPResponder: "http://127.0.0.1:1", OCSPTimeout: time.Second, OCSPCacheTTL: time.Minute, HardFail: hardFail}
+		c, _ := newTestRevocationChecker(t, "revocation-ocsp-down", rc)
+		err := c.Check([]*x509.Certificate{good, ca.cert})
+		if hardFail {
+			wantRevoked(t, err, false)
+		} else if err != nil {
+			t.Errorf("soft fail Check() with the responder down error = %v, want the certificate accepted", err)
+		}
+	}
+}
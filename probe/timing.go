@@ -0,0 +1,142 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/stats"
+)
+
+// Timing breaks down the time spent in a probe.
+type Timing struct {
+	// Connect is the time spent waiting for the upstream connection to be
+	// READY; it is close to zero when an established connection is reused.
+	Connect time.Duration
+	// DNS, TCP and TLS are the name resolution, tcp connect and TLS
+	// handshake of a connection established during the probe.  They are
+	// zero if an existing connection was used or the step did not apply,
+	// eg DNS for an IP address.  DNS is the lookup that produced the
+	// address connected to, which may precede the probe.
+	DNS time.Duration
+	TCP time.Duration
+	TLS time.Duration
+	// FirstByte is the time from the start of the health rpc to the first
+	// response headers (or trailers) from the upstream.
+	FirstByte time.Duration
+	// RPC is the duration of the health rpc.
+	RPC time.Duration
+}
+
+// recordSetup records the duration of the steps of the most recent
+// connection attempt.
+func (p *Prober) recordSetup(set func(t *Timing)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set(&p.setup)
+}
+
+func (p *Prober) lastSetup() Timing {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.setup
+}
+
+type rpcTimingKey struct{}
+
+// rpcTiming collects the stats of one rpc; it is passed to statsHandler in
+// the rpc context.
+type rpcTiming struct {
+	mu        sync.Mutex
+	begin     time.Time
+	firstByte time.Time
+	end       time.Time
+}
+
+func withRPCTiming(ctx context.Context) (context.Context, *rpcTiming) {
+	t := &rpcTiming{}
+	return context.WithValue(ctx, rpcTimingKey{}, t), t
+}
+
+// apply sets the FirstByte and RPC phases of timing from the rpc stats;
+// fallback is used for RPC if the rpc never started.
+func (t *rpcTiming) apply(timing *Timing, fallback time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing.RPC = fallback
+	if t.begin.IsZero() {
+		return
+	}
+	if !t.firstByte.IsZero() {
+		timing.FirstByte = t.firstByte.Sub(t.begin)
+	}
+	if !t.end.IsZero() {
+		timing.RPC = t.end.Sub(t.begin)
+	}
+}
+
+// statsHandler is the grpc stats.Handler of the upstream connection.  It
+// fills in the rpcTiming carried by the rpc context, if any.
+type statsHandler struct{}
+
+func (statsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (statsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	t, ok := ctx.Value(rpcTimingKey{}).(*rpcTiming)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch s := s.(type) {
+	case *stats.Begin:
+		t.begin = s.BeginTime
+	case *stats.InHeader, *stats.InTrailer:
+		if t.firstByte.IsZero() {
+			t.firstByte = time.Now()
+		}
+	case *stats.End:
+		t.end = s.EndTime
+	}
+}
+
+func (statsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (statsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (p *Prober) observeRPC(label string, t Timing) {
+	if t.FirstByte > 0 {
+		firstByteDuration.WithLabelValues(p.name, label).Observe(t.FirstByte.Seconds())
+	}
+	rpcDuration.WithLabelValues(p.name, label).Observe(t.RPC.Seconds())
+}
+
+func (p *Prober) logTiming(t Timing, attempts int) {
+	p.logger.Info("time elapsed",
+		slog.Int("attempts", attempts),
+		slog.Duration("connect", t.Connect),
+		slog.Duration("dns", t.DNS),
+		slog.Duration("tcp", t.TCP),
+		slog.Duration("tls", t.TLS),
+		slog.Duration("first_byte", t.FirstByte),
+		slog.Duration("rpc", t.RPC))
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// handshakeError marks an error returned by the TLS handshake, as opposed to
+// the TCP dial that preceded it.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string { return e.err.Error() }
+func (e *handshakeError) Unwrap() error { return e.err }
+
+// recordingCreds wraps the upstream TransportCredentials to time handshakes
+// and record their failures.
+type recordingCreds struct {
+	credentials.TransportCredentials
+	p *Prober
+}
+
+func (c *recordingCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	start := time.Now()
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	if err != nil {
+		c.p.recordTransportError(&handshakeError{err: err})
+		return conn, info, err
+	}
+	d := time.Since(start)
+	tlsDuration.WithLabelValues(c.p.name).Observe(d.Seconds())
+	c.p.recordSetup(func(t *Timing) { t.TLS = d })
+	return conn, info, err
+}
+
+func (c *recordingCreds) Clone() credentials.TransportCredentials {
+	return &recordingCreds{TransportCredentials: c.TransportCredentials.Clone(), p: c.p}
+}
+
+// dial is the grpc.WithContextDialer of the upstream connection.  It dials
+// the address picked by the resolver, timing the tcp connect and recording
+// its failure.  Addresses of dns targets arrive resolved, the lookup timed
+// by dnsResolver, and are dialled as they are.  Only a host name that grpc
+// passes through unresolved (a passthrough:/// target) is looked up here,
+// once per dial, and one of the addresses found is dialled.
+func (p *Prober) dial(ctx context.Context, addr string) (net.Conn, error) {
+	p.recordSetup(func(t *Timing) { t.TCP, t.TLS = 0, 0 })
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		p.recordTransportError(err)
+		return nil, err
+	}
+	hosts := []string{host}
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		hosts, err = net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			p.recordTransportError(err)
+			return nil, err
+		}
+		d := time.Since(start)
+		dnsDuration.WithLabelValues(p.name).Observe(d.Seconds())
+		p.recordSetup(func(t *Timing) { t.DNS = d })
+	}
+
+	start := time.Now()
+	var conn net.Conn
+	for _, h := range hosts {
+		if conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(h, port)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		p.recordTransportError(err)
+		return nil, err
+	}
+	d := time.Since(start)
+	tcpDuration.WithLabelValues(p.name).Observe(d.Seconds())
+	p.recordSetup(func(t *Timing) { t.TCP = d })
+	return conn, nil
+}
+
+func (p *Prober) recordTransportError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transportErr = err
+}
+
+func (p *Prober) lastTransportError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.transportErr
+}
+
+// lookupHost resolves the host of the upstream address, to tell name
+// resolution failures (which never reach the dialer) apart from the rest.
+// It returns nil for addresses that are not resolved with DNS.
+func (p *Prober) lookupHost(ctx context.Context) error {
+	addr := strings.TrimPrefix(strings.TrimPrefix(p.cfg.Addr, "dns:///"), "dns:")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || strings.Contains(host, ":") || net.ParseIP(host) != nil {
+		return nil
+	}
+	_, err = net.DefaultResolver.LookupHost(ctx, host)
+	return err
+}
+
+// classifyTransportError maps a dial, name resolution or handshake error to
+// a *GrpcProbeError.
+func classifyTransportError(err error) *GrpcProbeError {
+	code, reason := StatusTCPFailure, ReasonTCPError
+
+	var he *handshakeError
+	var dnsErr *net.DNSError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var authority x509.UnknownAuthorityError
+	var identity *identityError
+	var pin *pinError
+	var revocation *revocationError
+	switch {
+	case errors.As(err, &pin):
+		code, reason = StatusTLSPinMismatch, ReasonTLSPinMismatch
+	case errors.As(err, &he):
+		code = StatusTLSFailure
+		switch {
+		case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+			reason = ReasonTLSCertExpired
+		case errors.As(err, &hostname):
+			reason = ReasonTLSHostnameMismatch
+		case errors.As(err, &identity):
+			reason = ReasonTLSIdentityMismatch
+		case errors.As(err, &revocation) && revocation.revoked():
+			reason = ReasonTLSRevoked
+		case errors.As(err, &revocation):
+			reason = ReasonTLSRevocationUnknown
+		case errors.As(err, &authority):
+			reason = ReasonTLSUnknownAuthority
+		default:
+			reason = ReasonTLSHandshake
+		}
+	case errors.As(err, &dnsErr):
+		code = StatusDNSFailure
+		switch {
+		case dnsErr.IsNotFound:
+			reason = ReasonDNSNotFound
+		case dnsErr.IsTimeout:
+			reason = ReasonDNSTimeout
+		default:
+			reason = ReasonDNSError
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		reason = ReasonTCPRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		reason = ReasonTCPUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		reason = ReasonTCPTimeout
+	}
+
+	pe := NewGrpcProbeError(code, StatusName(code))
+	pe.Reason = reason
+	pe.Cause = err
+	return pe
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyTransportError(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		wantCode int
+		want     string
+	}{
+		{"dns not found", &net.DNSError{Err: "no such host", Name: "x", IsNotFound: true}, StatusDNSFailure, ReasonDNSNotFound},
+		{"dns timeout", &net.DNSError{Err: "i/o timeout", Name: "x", IsTimeout: true}, StatusDNSFailure, ReasonDNSTimeout},
+		{"dns error", &net.DNSError{Err: "server misbehaving", Name: "x"}, StatusDNSFailure, ReasonDNSError},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, StatusTCPFailure, ReasonTCPRefused},
+		{"unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, StatusTCPFailure, ReasonTCPUnreachable},
+		{"tcp timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, StatusTCPFailure, ReasonTCPTimeout},
+		{"tcp error", errors.New("reset"), StatusTCPFailure, ReasonTCPError},
+		{"expired", &handshakeError{err: x509.CertificateInvalidError{Reason: x509.Expired}}, StatusTLSFailure, ReasonTLSCertExpired},
+		{"hostname", &handshakeError{err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "x"}}, StatusTLSFailure, ReasonTLSHostnameMismatch},
+		{"identity", &handshakeError{err: &identityError{want: "spiffe://a"}}, StatusTLSFailure, ReasonTLSIdentityMismatch},
+		{"revoked", &handshakeError{err: &revocationError{revokedAt: time.Now()}}, StatusTLSFailure, ReasonTLSRevoked},
+		{"revocation unknown", &handshakeError{err: &revocationError{cause: errors.New("no CRL")}}, StatusTLSFailure, ReasonTLSRevocationUnknown},
+		{"authority", &handshakeError{err: x509.UnknownAuthorityError{}}, StatusTLSFailure, ReasonTLSUnknownAuthority},
+		{"handshake", &handshakeError{err: errors.New("bad record MAC")}, StatusTLSFailure, ReasonTLSHandshake},
+		{"pin", &handshakeError{err: &pinError{}}, StatusTLSPinMismatch, ReasonTLSPinMismatch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pe := classifyTransportError(tc.err)
+			if pe.Code != tc.wantCode || pe.Reason != tc.want {
+				t.Errorf("classifyTransportError() = %s %q, want %s %q", pe.Message, pe.Reason, StatusName(tc.wantCode), tc.want)
+			}
+			if !errors.Is(pe, tc.err) {
+				t.Errorf("classifyTransportError() does not wrap the cause")
+			}
+		})
+	}
+}
+
+// unusedAddr returns a local address nothing listens on.
+func unusedAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func TestConnectFailure(t *testing.T) {
+	const timeout = 500 * time.Millisecond
+	for _, tc := range []struct {
+		name     string
+		addr     string
+		wantCode int
+		reasons  string
+	}{
+		{"refused", unusedAddr(t), StatusTCPFailure, ReasonTCPRefused},
+		{"no such host", "dns:///grpc-health-proxy-test.invalid:50051", StatusDNSFailure, "dns_"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProber(t, Config{Addr: tc.addr, ConnTimeout: timeout})
+			start := time.Now()
+			_, err := p.Check(context.Background(), "")
+			elapsed := time.Since(start)
+
+			pe, ok := err.(*GrpcProbeError)
+			if !ok || pe.Code != tc.wantCode {
+				t.Fatalf("Check() error = %v, want %s", err, StatusName(tc.wantCode))
+			}
+			if !strings.HasPrefix(pe.Reason, tc.reasons) {
+				t.Errorf("Check() reason = %q, want %s*", pe.Reason, tc.reasons)
+			}
+			if elapsed > timeout+250*time.Millisecond {
+				t.Errorf("Check() took %v, want about the %v connect timeout", elapsed, timeout)
+			}
+		})
+	}
+}
+
+func TestDialTiming(t *testing.T) {
+	_, addr := startHealthServer(t)
+	_, port, _ := net.SplitHostPort(addr)
+	for _, tc := range []struct {
+		name    string
+		addr    string
+		wantDNS bool
+	}{
+		{"ip address", addr, false},
+		{"default", "localhost:" + port, true},
+		{"dns", "dns:///localhost:" + port, true},
+		{"passthrough", "passthrough:///localhost:" + port, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := newTestProber(t, Config{Addr: tc.addr})
+			res, err := p.Check(context.Background(), "")
+			if err != nil {
+				t.Fatalf("Check() error = %v", err)
+			}
+			if res.Timing.TCP <= 0 {
+				t.Errorf("Timing.TCP = %v, want the tcp connect time", res.Timing.TCP)
+			}
+			if (res.Timing.DNS > 0) != tc.wantDNS {
+				t.Errorf("Timing.DNS = %v, want it set: %v", res.Timing.DNS, tc.wantDNS)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// identityError is returned by the TLS handshake when the upstream
+// certificate is valid but does not carry the configured identity.
+type identityError struct {
+	want string
+	got  []string
+}
+
+func (e *identityError) Error() string {
+	return fmt.Sprintf("x509: certificate is not valid for %s, it is valid for %v", e.want, e.got)
+}
+
+// pinError is returned by the TLS handshake when no certificate of the
+// upstream chain matches an SPKI pin.
+type pinError struct {
+	leaf string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("x509: no certificate matches a pinned public key (leaf spki sha256 %s)", e.leaf)
+}
+
+// SPKISHA256 returns the base64 sha256 of the SubjectPublicKeyInfo of cert,
+// the format of SPKI pins.
+func SPKISHA256(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// ValidSPKIPin reports whether pin is a base64 sha256 hash.
+func ValidSPKIPin(pin string) bool {
+	h, err := base64.StdEncoding.DecodeString(pin)
+	return err == nil && len(h) == sha256.Size
+}
+
+// parsePins parses a pins file: one pin per line, blank lines and lines
+// starting with # are ignored.
+func parsePins(data []byte) (map[string]bool, error) {
+	pins := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !ValidSPKIPin(line) {
+			return nil, fmt.Errorf("invalid SPKI pin %q (must be a base64 sha256 hash)", line)
+		}
+		pins[line] = true
+	}
+	if len(pins) == 0 {
+		return nil, errors.New("no pins")
+	}
+	return pins, nil
+}
+
+// upstreamVerifier does the verification of the upstream certificate that
+// goes beyond the default: it checks the identity against one of
+// TLSSPIFFEID, TLSURISAN or TLSSANRegex instead of the host name, the
+// chain against the SPKI pins, and the revocation status of the chain.
+type upstreamVerifier struct {
+	spiffeID   string
+	uriSAN     string
+	sanRegex   *regexp.Regexp
+	pins       map[string]bool
+	noVerify   bool
+	files      *CertReloader
+	revocation *RevocationChecker
+}
+
+// newUpstreamVerifier returns the upstreamVerifier of cfg, or nil if there
+// is nothing to verify beyond the default.
+func newUpstreamVerifier(cfg Config, files *CertReloader) (*upstreamVerifier, error) {
+	v := &upstreamVerifier{
+		spiffeID: cfg.TLSSPIFFEID,
+		uriSAN:   cfg.TLSURISAN,
+		noVerify: cfg.TLSNoVerify,
+		files:    files,
+	}
+	set := 0
+	for _, s := range []string{cfg.TLSSPIFFEID, cfg.TLSURISAN, cfg.TLSSANRegex} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, errors.New("probe: only one of the TLS SPIFFE ID, URI SAN and SAN regex can be specified")
+	}
+	if cfg.TLSSPIFFEID != "" && !strings.HasPrefix(cfg.TLSSPIFFEID, "spiffe://") {
+		return nil, fmt.Errorf("probe: invalid SPIFFE ID %q (must start with spiffe://)", cfg.TLSSPIFFEID)
+	}
+	if cfg.TLSSANRegex != "" {
+		// the whole SAN must match, or svc\.example\.com would accept
+		// svc.example.com.evil.net
+		var err error
+		if v.sanRegex, err = regexp.Compile(`^(?:` + cfg.TLSSANRegex + `)$`); err != nil {
+			return nil, fmt.Errorf("probe: invalid TLS SAN regex: %v", err)
+		}
+	}
+	if len(cfg.TLSPins) > 0 {
+		v.pins = map[string]bool{}
+		for _, pin := range cfg.TLSPins {
+			if !ValidSPKIPin(pin) {
+				return nil, fmt.Errorf("probe: invalid SPKI pin %q (must be a base64 sha256 hash)", pin)
+			}
+			v.pins[pin] = true
+		}
+	}
+	v.revocation = NewRevocationChecker(cfg.Revocation, files)
+	if !v.verifiesIdentity() && v.pins == nil && cfg.TLSPinsFile == "" && v.revocation == nil {
+		return nil, nil
+	}
+	return v, nil
+}
+
+func (v *upstreamVerifier) verifiesIdentity() bool {
+	return v.spiffeID != "" || v.uriSAN != "" || v.sanRegex != nil
+}
+
+// verify is a tls.Config.VerifyConnection.
+func (v *upstreamVerifier) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: server presented no certificate")
+	}
+	chains := cs.VerifiedChains
+	if v.verifiesIdentity() {
+		var err error
+		if chains, err = v.verifyIdentity(cs); err != nil {
+			return err
+		}
+	}
+	if err := v.verifyPins(cs, chains); err != nil {
+		return err
+	}
+	if v.revocation != nil && len(chains) > 0 {
+		return v.revocation.Check(chains[0])
+	}
+	return nil
+}
+
+// verifyIdentity verifies the chain like the default verification, except
+// for the host name, and then the identity of the leaf.
+func (v *upstreamVerifier) verifyIdentity(cs tls.ConnectionState) ([][]*x509.Certificate, error) {
+	leaf := cs.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         v.files.CertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		return nil, &tls.CertificateVerificationError{UnverifiedCertificates: cs.PeerCertificates, Err: err}
+	}
+
+	var uris []string
+	for _, u := range leaf.URIs {
+		uris = append(uris, u.String())
+	}
+	switch {
+	case v.spiffeID != "":
+		// an X509-SVID carries exactly one URI SAN, the SPIFFE ID
+		if len(uris) != 1 || uris[0] != v.spiffeID {
+			return nil, &identityError{want: v.spiffeID, got: uris}
+		}
+	case v.uriSAN != "":
+		if !slices.Contains(uris, v.uriSAN) {
+			return nil, &identityError{want: v.uriSAN, got: uris}
+		}
+	case v.sanRegex != nil:
+		sans := append(slices.Clone(leaf.DNSNames), uris...)
+		if !slices.ContainsFunc(sans, v.sanRegex.MatchString) {
+			return nil, &identityError{want: v.sanRegex.String(), got: sans}
+		}
+	}
+	return chains, nil
+}
+
+// verifyPins checks that a certificate of the verified chains matches a
+// pin.  Without verification only the leaf can be trusted to be the
+// server's, so only the leaf is checked.
+func (v *upstreamVerifier) verifyPins(cs tls.ConnectionState, chains [][]*x509.Certificate) error {
+	filePins := v.files.Pins()
+	if v.pins == nil && filePins == nil {
+		return nil
+	}
+	certs := []*x509.Certificate{cs.PeerCertificates[0]}
+	if !v.noVerify {
+		for _, chain := range chains {
+			certs = append(certs, chain...)
+		}
+	}
+	for _, c := range certs {
+		h := SPKISHA256(c)
+		if v.pins[h] || filePins[h] {
+			return nil
+		}
+	}
+	return &pinError{leaf: SPKISHA256(cs.PeerCertificates[0])}
+}
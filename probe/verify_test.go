@@ -0,0 +1,260 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// issueSANs returns a server certificate of ca with the given SANs.
+func (ca *testCA) issueSANs(t *testing.T, dnsNames []string, uris ...string) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    dnsNames,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl.URIs = append(tmpl.URIs, parsed)
+	}
+	return ca.sign(t, tmpl, newTestKey(t))
+}
+
+// newTestVerifier returns the upstreamVerifier of cfg trusting ca.
+func newTestVerifier(t *testing.T, cfg Config, ca *testCA) *upstreamVerifier {
+	t.Helper()
+	caFile := writeTestFile(t, t.TempDir(), "ca.pem", certPEM(ca.cert))
+	files, err := newCertReloader("verify-test", "", "", caFile, cfg.TLSPinsFile, nil, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := newUpstreamVerifier(cfg, files)
+	if err != nil {
+		t.Fatalf("newUpstreamVerifier() error = %v", err)
+	}
+	if v == nil {
+		t.Fatalf("newUpstreamVerifier() = nil, want a verifier")
+	}
+	return v
+}
+
+func TestNewUpstreamVerifier(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		cfg     Config
+		wantErr string
+	}{
+		{"spiffe id and uri san", Config{TLSSPIFFEID: "spiffe://example.com/a", TLSURISAN: "urn:a"}, "only one of"},
+		{"uri san and regex", Config{TLSURISAN: "urn:a", TLSSANRegex: "a"}, "only one of"},
+		{"spiffe id and regex", Config{TLSSPIFFEID: "spiffe://example.com/a", TLSSANRegex: "a"}, "only one of"},
+		{"not a spiffe id", Config{TLSSPIFFEID: "https://example.com/a"}, "invalid SPIFFE ID"},
+		{"bad regex", Config{TLSSANRegex: "("}, "invalid TLS SAN regex"},
+		{"bad pin", Config{TLSPins: []string{"abc"}}, "invalid SPKI pin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newUpstreamVerifier(tc.cfg, nil); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("newUpstreamVerifier() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+	if v, err := newUpstreamVerifier(Config{}, nil); v != nil || err != nil {
+		t.Errorf("newUpstreamVerifier() with nothing to verify = %v, %v, want nil", v, err)
+	}
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	ca := newTestCA(t, "root", nil)
+	other := newTestCA(t, "other", nil)
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+		cert *x509.Certificate
+		// wantErr is "", "identity" or "chain"
+		wantErr string
+	}{
+		{"spiffe id", Config{TLSSPIFFEID: "spiffe://example.com/svc"}, ca.issueSANs(t, nil, "spiffe://example.com/svc"), ""},
+		{"spiffe id mismatch", Config{TLSSPIFFEID: "spiffe://example.com/svc"}, ca.issueSANs(t, nil, "spiffe://example.com/other"), "identity"},
+		{"spiffe id among several uris", Config{TLSSPIFFEID: "spiffe://example.com/svc"}, ca.issueSANs(t, nil, "spiffe://example.com/svc", "spiffe://example.com/other"), "identity"},
+		{"spiffe id without uris", Config{TLSSPIFFEID: "spiffe://example.com/svc"}, ca.issueSANs(t, []string{"svc"}), "identity"},
+		{"spiffe id from an untrusted ca", Config{TLSSPIFFEID: "spiffe://example.com/svc"}, other.issueSANs(t, nil, "spiffe://example.com/svc"), "chain"},
+		{"uri san", Config{TLSURISAN: "urn:svc"}, ca.issueSANs(t, nil, "urn:other", "urn:svc"), ""},
+		{"uri san mismatch", Config{TLSURISAN: "urn:svc"}, ca.issueSANs(t, nil, "urn:svc:v2"), "identity"},
+		{"regex dns", Config{TLSSANRegex: `svc\.example\.com`}, ca.issueSANs(t, []string{"svc.example.com"}), ""},
+		{"regex suffix", Config{TLSSANRegex: `svc\.example\.com`}, ca.issueSANs(t, []string{"svc.example.com.evil.net"}), "identity"},
+		{"regex prefix", Config{TLSSANRegex: `svc\.example\.com`}, ca.issueSANs(t, []string{"evilsvc.example.com"}), "identity"},
+		{"regex alternation", Config{TLSSANRegex: `a\.example\.com|b\.example\.com`}, ca.issueSANs(t, []string{"b.example.com"}), ""},
+		{"regex alternation suffix", Config{TLSSANRegex: `a\.example\.com|b\.example\.com`}, ca.issueSANs(t, []string{"a.example.com.evil.net"}), "identity"},
+		{"regex uri", Config{TLSSANRegex: `spiffe://example\.com/ns/[^/]+/sa/svc`}, ca.issueSANs(t, nil, "spiffe://example.com/ns/prod/sa/svc"), ""},
+		{"regex from an untrusted ca", Config{TLSSANRegex: `svc\.example\.com`}, other.issueSANs(t, []string{"svc.example.com"}), "chain"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(t, tc.cfg, ca)
+			err := v.verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}})
+			var identity *identityError
+			var chain *tls.CertificateVerificationError
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Errorf("verify() error = %v", err)
+			case tc.wantErr == "identity" && !errors.As(err, &identity):
+				t.Errorf("verify() error = %v, want an identity mismatch", err)
+			case tc.wantErr == "chain" && !errors.As(err, &chain):
+				t.Errorf("verify() error = %v, want a chain verification error", err)
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	ca := newTestCA(t, "root", nil)
+	pin := SPKISHA256(ca.cert)
+	pins, err := parsePins([]byte("# upstream pins\n\n  " + pin + "  \n"))
+	if err != nil || len(pins) != 1 || !pins[pin] {
+		t.Errorf("parsePins() = %v, %v, want the one pin", pins, err)
+	}
+	for _, data := range []string{
+		"",
+		"# only a comment\n",
+		pin + "\nnot-a-pin\n",
+		pin + "\n" + pin[:20] + "\n",
+		"sha256/" + pin + "\n",
+	} {
+		if _, err := parsePins([]byte(data)); err == nil {
+			t.Errorf("parsePins(%q) succeeded", data)
+		}
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	inter := newTestCA(t, "intermediate", root)
+	leaf, _ := inter.issue(t, "localhost")
+	other := newTestCA(t, "other", nil)
+	verified := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf, inter.cert},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, inter.cert, root.cert}},
+	}
+	unverified := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, inter.cert}}
+
+	for _, tc := range []struct {
+		name     string
+		pin      *x509.Certificate
+		noVerify bool
+		cs       tls.ConnectionState
+		wantErr  bool
+	}{
+		{"leaf", leaf, false, verified, false},
+		{"intermediate", inter.cert, false, verified, false},
+		{"root", root.cert, false, verified, false},
+		{"unrelated", other.cert, false, verified, true},
+		{"no verify leaf", leaf, true, unverified, false},
+		// without verification the rest of the chain is not proven to
+		// belong to the leaf, so its pins do not count
+		{"no verify intermediate", inter.cert, true, unverified, true},
+		{"no verify root", root.cert, true, tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf, inter.cert, root.cert}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := newTestVerifier(t, Config{TLSPins: []string{SPKISHA256(tc.pin)}, TLSNoVerify: tc.noVerify}, root)
+			err := v.verify(tc.cs)
+			var pe *pinError
+			if tc.wantErr != errors.As(err, &pe) || (!tc.wantErr && err != nil) {
+				t.Errorf("verify() error = %v, want a pin mismatch %v", err, tc.wantErr)
+			}
+			if pe != nil && pe.leaf != SPKISHA256(leaf) {
+				t.Errorf("pinError reports leaf %s, want %s", pe.leaf, SPKISHA256(leaf))
+			}
+		})
+	}
+}
+
+func TestVerifyPinsFileReload(t *testing.T) {
+	root := newTestCA(t, "root", nil)
+	leaf, _ := root.issue(t, "localhost")
+	next := newTestCA(t, "next", nil)
+	cs := tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{leaf},
+		VerifiedChains:   [][]*x509.Certificate{{leaf, root.cert}},
+	}
+
+	dir := t.TempDir()
+	pinsFile := writeTestFile(t, dir, "pins.txt", []byte(SPKISHA256(root.cert)+"\n"))
+	v := newTestVerifier(t, Config{TLSPinsFile: pinsFile}, root)
+	if err := v.verify(cs); err != nil {
+		t.Fatalf("verify() with the root pinned = %v", err)
+	}
+
+	// a broken pins file keeps the previous pins in use
+	writeTestFile(t, dir, "pins.txt", []byte("not-a-pin\n"))
+	if _, err := v.files.Reload(); err == nil {
+		t.Errorf("Reload() of a broken pins file succeeded")
+	}
+	if err := v.verify(cs); err != nil {
+		t.Errorf("verify() after a failed reload = %v, want the previous pins", err)
+	}
+
+	// rotating the pin away from the root rejects the server
+	writeTestFile(t, dir, "pins.txt", []byte("# rotated\n"+SPKISHA256(next.cert)+"\n"))
+	if reloaded, err := v.files.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload() = %v, %v, want the new pins", reloaded, err)
+	}
+	var pe *pinError
+	if err := v.verify(cs); !errors.As(err, &pe) {
+		t.Errorf("verify() after rotating the pin = %v, want a pin mismatch", err)
+	}
+
+	// pinning both during a rotation accepts the server again
+	writeTestFile(t, dir, "pins.txt", []byte(SPKISHA256(next.cert)+"\n"+SPKISHA256(root.cert)+"\n"))
+	v.files.Reload()
+	if err := v.verify(cs); err != nil {
+		t.Errorf("verify() with both pins = %v", err)
+	}
+}
+
+func TestCheckPinMismatch(t *testing.T) {
+	ca := newTestCA(t, "pinned ca", nil)
+	other := newTestCA(t, "other ca", nil)
+	cert, key := ca.issue(t, "server")
+	creds := credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}})
+	hs, addr := startHealthServer(t, grpc.Creds(creds))
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+
+	p := newTestProber(t, Config{Addr: addr, TLS: true, TLSNoVerify: true, TLSPins: []string{SPKISHA256(cert)}})
+	if res, err := p.Check(context.Background(), "echo"); err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Check() with the server key pinned = %v, %v, want SERVING", res, err)
+	}
+
+	p = newTestProber(t, Config{Addr: addr, TLS: true, TLSNoVerify: true, TLSPins: []string{SPKISHA256(other.cert)}, ConnTimeout: 500 * time.Millisecond})
+	_, err := p.Check(context.Background(), "echo")
+	var pe *GrpcProbeError
+	if !errors.As(err, &pe) || pe.Code != StatusTLSPinMismatch || pe.Reason != ReasonTLSPinMismatch {
+		t.Errorf("Check() with another key pinned = %v, want StatusTLSPinMismatch", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	watchBaseBackoff = time.Second
+	watchMaxBackoff  = 30 * time.Second
+)
+
+// WatchConfig configures a Watcher.
+type WatchConfig struct {
+	// Services are the service names to watch.
+	Services []string
+	// MaxStaleness is how long the last pushed status keeps being served
+	// after its Watch stream is lost.  Zero reports the stream failure
+	// immediately.
+	MaxStaleness time.Duration
+	// FallbackInterval is the interval Check is polled on for servers that
+	// return Unimplemented for Watch.
+	FallbackInterval time.Duration
+	// Feed, if set, receives every status transition, including stream
+	// failures.
+	Feed *Feed
+}
+
+type watchEntry struct {
+	res *Result
+	err error
+	// current is set while res is backed by an open Watch stream or a
+	// fallback poll, and cleared when the stream is lost.
+	current bool
+	// failure is what Check reports once a lost stream is past MaxStaleness.
+	failure    *Result
+	failureErr error
+}
+
+// Watcher keeps one grpc.health.v1.Health/Watch stream open per service and
+// answers Check from the most recently pushed status.  Streams are
+// re-established with exponential backoff; servers that do not implement
+// Watch are polled with Check instead.
+type Watcher struct {
+	prober *Prober
+	cfg    WatchConfig
+	// backoff and maxBackoff bound the delay before a stream is reopened.
+	backoff, maxBackoff time.Duration
+
+	mu      sync.RWMutex
+	entries map[string]*watchEntry
+}
+
+// NewWatcher returns a Watcher for p.  Call Start to open the streams.
+func NewWatcher(p *Prober, cfg WatchConfig) *Watcher {
+	w := &Watcher{
+		prober:     p,
+		cfg:        cfg,
+		backoff:    watchBaseBackoff,
+		maxBackoff: watchMaxBackoff,
+		entries:    map[string]*watchEntry{},
+	}
+	for _, s := range cfg.Services {
+		w.entries[s] = nil
+	}
+	return w
+}
+
+// Start launches one watch goroutine per service; they run until ctx is
+// cancelled.
+func (w *Watcher) Start(ctx context.Context) {
+	for _, s := range w.cfg.Services {
+		go w.watch(ctx, s)
+	}
+}
+
+func (w *Watcher) watch(ctx context.Context, serviceName string) {
+	backoff := w.backoff
+	for {
+		err := w.stream(ctx, serviceName, func() { backoff = w.backoff })
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			w.prober.logger.Warn("server does not implement Watch, falling back to polling Check", slog.String("service_name", serviceName), slog.Duration("interval", w.cfg.FallbackInterval))
+			w.fallback(ctx, serviceName)
+			return
+		}
+
+		// equal jitter: sleep somewhere in [backoff/2, backoff)
+		delay := backoff
+		if backoff > 1 {
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		}
+		w.prober.logger.Info("reconnecting watch stream", slog.String("service_name", serviceName), slog.Duration("backoff", delay))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		backoff = min(2*backoff, w.maxBackoff)
+	}
+}
+
+// stream runs a single Watch stream until it fails, storing every pushed
+// status.  onMessage is called for each received status.
+func (w *Watcher) stream(ctx context.Context, serviceName string, onMessage func()) error {
+	if _, pe := w.prober.connect(ctx); pe != nil {
+		w.lost(serviceName, pe)
+		return pe
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w.prober.logger.Info("Running HealthCheck Watch for service:", slog.String("service_name", serviceName))
+	stream, err := healthpb.NewHealthClient(w.prober.conn).Watch(streamCtx, &healthpb.HealthCheckRequest{Service: serviceName})
+	if err != nil {
+		w.lost(serviceName, classifyRPCError(err, nil))
+		return err
+	}
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			pe := classifyRPCError(err, stream.Trailer())
+			grpcReqs.WithLabelValues(w.prober.name, pe.GrpcCode.String(), w.prober.serviceLabel(serviceName)).Inc()
+			if pe.Code == StatusUnimplemented {
+				return err
+			}
+			w.prober.logger.Warn("error: watch stream failed: ", slog.String("service_name", serviceName), slog.String("class", pe.Message), slog.String("", err.Error()))
+			w.lost(serviceName, pe)
+			return err
+		}
+		onMessage()
+		grpcReqs.WithLabelValues(w.prober.name, resp.GetStatus().String(), w.prober.serviceLabel(serviceName)).Inc()
+		w.prober.logger.Info("watch status changed", slog.String("service_name", serviceName), slog.String("status", resp.GetStatus().String()))
+		w.store(serviceName, &Result{
+			Service: serviceName,
+			Status:  resp.GetStatus(),
+			Time:    time.Now(),
+		}, nil)
+	}
+}
+
+func (w *Watcher) fallback(ctx context.Context, serviceName string) {
+	ticker := time.NewTicker(w.cfg.FallbackInterval)
+	defer ticker.Stop()
+	for {
+		res, err := w.prober.Check(ctx, serviceName)
+		w.store(serviceName, res, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *Watcher) store(serviceName string, res *Result, err error) {
+	w.mu.Lock()
+	w.entries[serviceName] = &watchEntry{res: res, err: err, current: true}
+	w.mu.Unlock()
+	w.cfg.Feed.publish(res, err)
+}
+
+// lost records that the stream for serviceName failed with err.  The last
+// pushed status, if any, remains available for MaxStaleness.
+func (w *Watcher) lost(serviceName string, err error) {
+	now := time.Now()
+	failure := &Result{
+		Service: serviceName,
+		Status:  healthpb.HealthCheckResponse_UNKNOWN,
+		Time:    now,
+	}
+
+	w.cfg.Feed.publish(failure, err)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e := w.entries[serviceName]
+	if e == nil {
+		w.entries[serviceName] = &watchEntry{res: failure, err: err, failure: failure, failureErr: err}
+		return
+	}
+	if e.current {
+		// start the staleness clock from the moment the stream was lost
+		res := *e.res
+		res.Time = now
+		e = &watchEntry{res: &res, err: e.err}
+	}
+	e.failure, e.failureErr = failure, err
+	w.entries[serviceName] = e
+}
+
+// Tracks reports whether serviceName is watched.
+func (w *Watcher) Tracks(serviceName string) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	_, ok := w.entries[serviceName]
+	return ok
+}
+
+// Check returns the most recently pushed status for serviceName.  Services
+// that are not watched are checked live with the underlying Prober.
+func (w *Watcher) Check(ctx context.Context, serviceName string) (*Result, error) {
+	w.mu.RLock()
+	e, ok := w.entries[serviceName]
+	w.mu.RUnlock()
+	if !ok {
+		return w.prober.Check(ctx, serviceName)
+	}
+
+	if e == nil {
+		w.prober.logger.Warn("no watched status yet", slog.String("service_name", serviceName))
+		return &Result{
+			Service: serviceName,
+			Status:  healthpb.HealthCheckResponse_UNKNOWN,
+		}, NewGrpcProbeError(StatusStale, "StatusStale")
+	}
+	if e.current || (w.cfg.MaxStaleness > 0 && time.Since(e.res.Time) <= w.cfg.MaxStaleness) {
+		return e.res, e.err
+	}
+	return e.failure, e.failureErr
+}
@@ -0,0 +1,254 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// watchHealth is a health server whose Check reports status and whose
+// Watch calls are served by watch, or are Unimplemented if it is nil.
+type watchHealth struct {
+	healthpb.UnimplementedHealthServer
+	status  atomic.Int32
+	watches atomic.Int32
+	watch   func(n int32, stream healthpb.Health_WatchServer) error
+}
+
+func (h *watchHealth) set(st healthpb.HealthCheckResponse_ServingStatus) {
+	h.status.Store(int32(st))
+}
+
+func (h *watchHealth) response() *healthpb.HealthCheckResponse {
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_ServingStatus(h.status.Load())}
+}
+
+func (h *watchHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return h.response(), nil
+}
+
+func (h *watchHealth) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	n := h.watches.Add(1)
+	if h.watch == nil {
+		return status.Error(codes.Unimplemented, "unknown method Watch")
+	}
+	return h.watch(n, stream)
+}
+
+func startWatchServer(t *testing.T, h *watchHealth) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	healthpb.RegisterHealthServer(srv, h)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// startTestWatcher starts a Watcher of echo on addr, reconnecting after
+// 10ms, until the test ends.
+func startTestWatcher(t *testing.T, addr string, cfg WatchConfig) *Watcher {
+	t.Helper()
+	cfg.Services = []string{"echo"}
+	w := NewWatcher(newTestProber(t, Config{Name: t.Name(), Addr: addr}), cfg)
+	w.backoff, w.maxBackoff = 10*time.Millisecond, 20*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	return w
+}
+
+// waitForStatus waits for c to report st for echo, with no error if ok is
+// set and with an error otherwise.
+func waitForStatus(t *testing.T, c Checker, st healthpb.HealthCheckResponse_ServingStatus, ok bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := c.Check(context.Background(), "echo")
+		if res != nil && res.Status == st && (err == nil) == ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Check() = %v, %v, want %s with error: %v", res, err, st, !ok)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// keepOpen sends the current status and keeps the stream open.
+func keepOpen(h *watchHealth) func(int32, healthpb.Health_WatchServer) error {
+	return func(_ int32, stream healthpb.Health_WatchServer) error {
+		if err := stream.Send(h.response()); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+}
+
+func TestWatcherNoStatusYet(t *testing.T) {
+	w := NewWatcher(&Prober{name: "test", logger: discardLogger}, WatchConfig{Services: []string{"echo"}})
+	res, err := w.Check(context.Background(), "echo")
+	var pe *GrpcProbeError
+	if !errors.As(err, &pe) || pe.Code != StatusStale || res.Status != healthpb.HealthCheckResponse_UNKNOWN {
+		t.Errorf("Check() before any status = %v, %v, want UNKNOWN and StatusStale", res, err)
+	}
+	if !w.Tracks("echo") || w.Tracks("other") {
+		t.Errorf("Tracks() does not match the watched services")
+	}
+}
+
+func TestWatcherServesPushedStatus(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	hs.SetServingStatus("other", healthpb.HealthCheckResponse_NOT_SERVING)
+	feed := NewFeed(10)
+	w := startTestWatcher(t, addr, WatchConfig{Feed: feed})
+
+	waitForStatus(t, w, healthpb.HealthCheckResponse_SERVING, true)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	waitForStatus(t, w, healthpb.HealthCheckResponse_NOT_SERVING, true)
+	replay, _, cancel := feed.Subscribe("echo", 1)
+	cancel()
+	if len(replay) != 1 || replay[0].Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("feed replay after the first event = %+v, want the NOT_SERVING transition", replay)
+	}
+
+	// services that are not watched are checked live
+	if res, err := w.Check(context.Background(), "other"); err != nil || res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Check() of an unwatched service = %v, %v, want NOT_SERVING", res, err)
+	}
+}
+
+func TestWatcherFallsBackToPolling(t *testing.T) {
+	h := &watchHealth{}
+	h.set(healthpb.HealthCheckResponse_SERVING)
+	w := startTestWatcher(t, startWatchServer(t, h), WatchConfig{FallbackInterval: 10 * time.Millisecond})
+
+	waitForStatus(t, w, healthpb.HealthCheckResponse_SERVING, true)
+	h.set(healthpb.HealthCheckResponse_NOT_SERVING)
+	waitForStatus(t, w, healthpb.HealthCheckResponse_NOT_SERVING, true)
+	if n := h.watches.Load(); n != 1 {
+		t.Errorf("Watch called %d times, want 1 before polling", n)
+	}
+	if got := testutil.ToFloat64(grpcReqs.WithLabelValues(t.Name(), "Unimplemented", "echo")); got != 1 {
+		t.Errorf("Unimplemented watch counted %v times, want 1", got)
+	}
+}
+
+func TestWatcherReconnects(t *testing.T) {
+	h := &watchHealth{}
+	h.set(healthpb.HealthCheckResponse_SERVING)
+	// the first stream breaks after its first status
+	h.watch = func(n int32, stream healthpb.Health_WatchServer) error {
+		if n == 1 {
+			stream.Send(h.response())
+			return status.Error(codes.Unavailable, "server restarting")
+		}
+		return keepOpen(h)(n, stream)
+	}
+	w := startTestWatcher(t, startWatchServer(t, h), WatchConfig{})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.watches.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := h.watches.Load(); n != 2 {
+		t.Fatalf("Watch called %d times, want the stream reopened once", n)
+	}
+	waitForStatus(t, w, healthpb.HealthCheckResponse_SERVING, true)
+}
+
+func TestWatcherReconnectsWithoutBackoff(t *testing.T) {
+	h := &watchHealth{}
+	h.set(healthpb.HealthCheckResponse_SERVING)
+	h.watch = func(n int32, stream healthpb.Health_WatchServer) error {
+		if n < 3 {
+			return status.Error(codes.Unavailable, "server restarting")
+		}
+		return keepOpen(h)(n, stream)
+	}
+	w := NewWatcher(newTestProber(t, Config{Name: t.Name(), Addr: startWatchServer(t, h)}), WatchConfig{Services: []string{"echo"}})
+	// a backoff too small to halve must not break the jitter
+	w.backoff, w.maxBackoff = 1, 1
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	waitForStatus(t, w, healthpb.HealthCheckResponse_SERVING, true)
+}
+
+func TestWatcherMaxStaleness(t *testing.T) {
+	const staleness = 300 * time.Millisecond
+	for _, tc := range []struct {
+		name         string
+		maxStaleness time.Duration
+	}{
+		{"fail immediately", 0},
+		{"serve the last status", staleness},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &watchHealth{}
+			h.set(healthpb.HealthCheckResponse_SERVING)
+			lose := make(chan struct{})
+			// the first stream is lost when lose is closed, and every
+			// stream after it fails
+			h.watch = func(n int32, stream healthpb.Health_WatchServer) error {
+				if n > 1 {
+					return status.Error(codes.Unavailable, "server down")
+				}
+				stream.Send(h.response())
+				<-lose
+				return status.Error(codes.Unavailable, "server down")
+			}
+			w := startTestWatcher(t, startWatchServer(t, h), WatchConfig{MaxStaleness: tc.maxStaleness})
+			waitForStatus(t, w, healthpb.HealthCheckResponse_SERVING, true)
+
+			lostAt := time.Now()
+			close(lose)
+			if tc.maxStaleness == 0 {
+				waitForStatus(t, w, healthpb.HealthCheckResponse_UNKNOWN, false)
+				return
+			}
+			// give the stream time to fail and be retried
+			time.Sleep(50 * time.Millisecond)
+			if res, err := w.Check(context.Background(), "echo"); err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("Check() within MaxStaleness = %v, %v, want the last SERVING", res, err)
+			}
+			waitForStatus(t, w, healthpb.HealthCheckResponse_UNKNOWN, false)
+			if elapsed := time.Since(lostAt); elapsed < tc.maxStaleness {
+				t.Errorf("stream failure reported after %v, want after MaxStaleness %v", elapsed, tc.maxStaleness)
+			}
+			_, err := w.Check(context.Background(), "echo")
+			var pe *GrpcProbeError
+			if !errors.As(err, &pe) || pe.Code != StatusUnavailable {
+				t.Errorf("Check() past MaxStaleness error = %v, want StatusUnavailable", err)
+			}
+		})
+	}
+}
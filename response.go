@@ -0,0 +1,370 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	"google.golang.org/grpc/codes"
+)
+
+// responseSchemaVersion is the version of the json response schema.  It
+// only changes if a field is removed or changes meaning.
+const responseSchemaVersion = "v1"
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// checkResponse is the json response for a single service.
+type checkResponse struct {
+	Version    string              `json:"version"`
+	Target     string              `json:"target"`
+	Service    string              `json:"service"`
+	Status     string              `json:"status"`
+	Error      *errorResponse      `json:"error,omitempty"`
+	Attempts   int                 `json:"attempts,omitempty"`
+	Cache      string              `json:"cache,omitempty"`
+	Age        string              `json:"age,omitempty"`
+	Hysteresis *hysteresisResponse `json:"hysteresis,omitempty"`
+	Latency    latency             `json:"latency"`
+	Timestamp  string              `json:"timestamp"`
+}
+
+// hysteresisResponse is the rise/fall state of the service.
+type hysteresisResponse struct {
+	State          string         `json:"state"`
+	Count          int            `json:"count"`
+	Rise           int            `json:"rise"`
+	Fall           int            `json:"fall"`
+	ObservedStatus string         `json:"observedStatus"`
+	ObservedError  *errorResponse `json:"observedError,omitempty"`
+}
+
+// serviceListResponse is the json response when no service name is given.
+type serviceListResponse struct {
+	Version   string            `json:"version"`
+	Target    string            `json:"target"`
+	Healthy   bool              `json:"healthy"`
+	Services  map[string]string `json:"services"`
+	Error     *errorResponse    `json:"error,omitempty"`
+	Attempts  int               `json:"attempts,omitempty"`
+	Latency   latency           `json:"latency"`
+	Timestamp string            `json:"timestamp"`
+}
+
+// errorResponse describes a failed probe.
+type errorResponse struct {
+	Class       string `json:"class"`
+	Reason      string `json:"reason,omitempty"`
+	GrpcCode    string `json:"grpcCode,omitempty"`
+	GrpcMessage string `json:"grpcMessage,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+// latency is encoded like a google.protobuf.Duration, eg "0.001500s".  The
+// dns, tcp and tls phases are only set if the probe established a new
+// connection.
+type latency struct {
+	Total     string `json:"total"`
+	Connect   string `json:"connect"`
+	DNS       string `json:"dns,omitempty"`
+	TCP       string `json:"tcp,omitempty"`
+	TLS       string `json:"tls,omitempty"`
+	FirstByte string `json:"firstByte"`
+	RPC       string `json:"rpc"`
+}
+
+func newLatency(total time.Duration, t probe.Timing) latency {
+	l := latency{
+		Total:     formatDuration(total),
+		Connect:   formatDuration(t.Connect),
+		FirstByte: formatDuration(t.FirstByte),
+		RPC:       formatDuration(t.RPC),
+	}
+	if t.DNS > 0 {
+		l.DNS = formatDuration(t.DNS)
+	}
+	if t.TCP > 0 {
+		l.TCP = formatDuration(t.TCP)
+	}
+	if t.TLS > 0 {
+		l.TLS = formatDuration(t.TLS)
+	}
+	return l
+}
+
+// setServerTiming sets the Server-Timing header to the phases of a probe
+// that took any time.
+func setServerTiming(w http.ResponseWriter, total time.Duration, t probe.Timing) {
+	var metrics []string
+	for _, m := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"connect", t.Connect},
+		{"dns", t.DNS},
+		{"tcp", t.TCP},
+		{"tls", t.TLS},
+		{"ttfb", t.FirstByte},
+		{"rpc", t.RPC},
+		{"total", total},
+	} {
+		if m.d > 0 {
+			metrics = append(metrics, fmt.Sprintf("%s;dur=%.3f", m.name, float64(m.d)/float64(time.Millisecond)))
+		}
+	}
+	if len(metrics) > 0 {
+		w.Header().Set("Server-Timing", strings.Join(metrics, ", "))
+	}
+}
+
+// responseFormat returns the format requested with ?format= or, failing
+// that, the Accept header.  Text is the default.
+func responseFormat(r *http.Request) (string, error) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if f != formatText && f != formatJSON {
+			return "", fmt.Errorf("unknown format %q (must be %s or %s)", f, formatText, formatJSON)
+		}
+		return f, nil
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(a); err == nil && mt == "application/json" {
+			return formatJSON, nil
+		}
+	}
+	return formatText, nil
+}
+
+func newErrorResponse(err error) *errorResponse {
+	pe, ok := err.(*probe.GrpcProbeError)
+	if !ok {
+		return &errorResponse{Class: err.Error()}
+	}
+	er := &errorResponse{
+		Class:  pe.Error(),
+		Reason: pe.Reason,
+	}
+	if pe.Reason == probe.ReasonRPC {
+		er.GrpcCode = grpcCodeName(pe.GrpcCode)
+		er.GrpcMessage = pe.GrpcMessage
+		// the grpc message already says it all
+	} else if cfg.flHTTPErrorDetail {
+		er.Detail = pe.Detail()
+	}
+	return er
+}
+
+// grpcCodeNames are the google.rpc.Code enum names, eg "DEADLINE_EXCEEDED".
+var grpcCodeNames = [...]string{
+	codes.OK:                 "OK",
+	codes.Canceled:           "CANCELLED",
+	codes.Unknown:            "UNKNOWN",
+	codes.InvalidArgument:    "INVALID_ARGUMENT",
+	codes.DeadlineExceeded:   "DEADLINE_EXCEEDED",
+	codes.NotFound:           "NOT_FOUND",
+	codes.AlreadyExists:      "ALREADY_EXISTS",
+	codes.PermissionDenied:   "PERMISSION_DENIED",
+	codes.ResourceExhausted:  "RESOURCE_EXHAUSTED",
+	codes.FailedPrecondition: "FAILED_PRECONDITION",
+	codes.Aborted:            "ABORTED",
+	codes.OutOfRange:         "OUT_OF_RANGE",
+	codes.Unimplemented:      "UNIMPLEMENTED",
+	codes.Internal:           "INTERNAL",
+	codes.Unavailable:        "UNAVAILABLE",
+	codes.DataLoss:           "DATA_LOSS",
+	codes.Unauthenticated:    "UNAUTHENTICATED",
+}
+
+// parseGrpcCode parses a google.rpc.Code enum name, eg "UNAVAILABLE".
+func parseGrpcCode(name string) (codes.Code, bool) {
+	for c, n := range grpcCodeNames {
+		if n == name {
+			return codes.Code(c), true
+		}
+	}
+	return 0, false
+}
+
+// grpcCodeName returns the google.rpc.Code enum name of c, eg
+// "DEADLINE_EXCEEDED".
+func grpcCodeName(c codes.Code) string {
+	if int(c) < len(grpcCodeNames) {
+		return grpcCodeNames[c]
+	}
+	return c.String()
+}
+
+func formatDuration(d time.Duration) string {
+	return fmt.Sprintf("%.6fs", d.Seconds())
+}
+
+func formatTimestamp(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// attemptsHeader carries the number of health rpcs made by the probe.
+const attemptsHeader = "X-Probe-Attempts"
+
+func setAttempts(w http.ResponseWriter, attempts int) {
+	if attempts > 0 {
+		w.Header().Set(attemptsHeader, strconv.Itoa(attempts))
+	}
+}
+
+// setCache sets the X-Cache header, and the Age header of cached results.
+func setCache(w http.ResponseWriter, res *probe.Result) {
+	if res.Cache == "" {
+		return
+	}
+	w.Header().Set("X-Cache", res.Cache)
+	if res.Cache == probe.CacheHit {
+		w.Header().Set("Age", strconv.Itoa(int(res.Age.Seconds())))
+	}
+}
+
+// hysteresisStateHeader carries the rise/fall state of the service, eg
+// "GOING_DOWN; count=1; rise=2; fall=3".
+const hysteresisStateHeader = "X-Hysteresis-State"
+
+func setHysteresisState(w http.ResponseWriter, h *probe.HysteresisState) {
+	if h == nil {
+		return
+	}
+	w.Header().Set(hysteresisStateHeader, fmt.Sprintf("%s; count=%d; rise=%d; fall=%d", h.State, h.Count, h.Thresholds.Rise, h.Thresholds.Fall))
+}
+
+// writeCheckJSON writes the json response for a Check of serviceName.  The
+// status code and headers are those of the -http-status-map entry.
+func (u *upstream) writeCheckJSON(w http.ResponseWriter, serviceName string, res *probe.Result, err error) {
+	resp := &checkResponse{
+		Version:   responseSchemaVersion,
+		Target:    u.name,
+		Service:   serviceName,
+		Status:    res.Status.String(),
+		Attempts:  res.Attempts,
+		Cache:     res.Cache,
+		Latency:   newLatency(res.Duration, res.Timing),
+		Timestamp: formatTimestamp(res.Time),
+	}
+	if res.Cache == probe.CacheHit {
+		resp.Age = formatDuration(res.Age)
+	}
+	if h := res.Hysteresis; h != nil {
+		resp.Hysteresis = &hysteresisResponse{
+			State:          h.State,
+			Count:          h.Count,
+			Rise:           h.Thresholds.Rise,
+			Fall:           h.Thresholds.Fall,
+			ObservedStatus: h.ObservedStatus.String(),
+		}
+		if h.ObservedError != nil {
+			resp.Hysteresis.ObservedError = newErrorResponse(h.ObservedError)
+		}
+	}
+	if err == nil {
+		statusMapping.statusResponse(res.Status).writeJSON(w, resp, nil)
+		return
+	}
+	resp.Error = newErrorResponse(err)
+	writeErrorJSON(w, err, resp)
+}
+
+// writeListJSON writes the json response for a List.
+func (u *upstream) writeListJSON(w http.ResponseWriter, res *probe.ListResult, err error) {
+	resp := &serviceListResponse{
+		Version:   responseSchemaVersion,
+		Target:    u.name,
+		Services:  map[string]string{},
+		Attempts:  res.Attempts,
+		Latency:   newLatency(res.Duration, res.Timing),
+		Timestamp: formatTimestamp(res.Time),
+	}
+	for s, st := range res.Statuses {
+		resp.Services[s] = st.String()
+	}
+	if err != nil {
+		resp.Error = newErrorResponse(err)
+		writeErrorJSON(w, err, resp)
+		return
+	}
+	resp.Healthy = res.Healthy(listFilter)
+	r := &httpResponse{Code: http.StatusOK}
+	if !resp.Healthy {
+		r.Code = http.StatusServiceUnavailable
+	}
+	r.writeJSON(w, resp, nil)
+}
+
+// rejectionResponse is the json response for a request the proxy refused
+// without contacting the upstream.
+type rejectionResponse struct {
+	Version string         `json:"version"`
+	Target  string         `json:"target"`
+	Error   *errorResponse `json:"error"`
+}
+
+// writeRejection writes a code response for a refused request: msg as text,
+// or a rejectionResponse with class and reason as json.  The reason is also
+// returned in the X-Probe-Error-Reason header.
+func (u *upstream) writeRejection(w http.ResponseWriter, code int, msg, class, reason, format string) {
+	w.Header().Set(probeErrorReasonHeader, reason)
+	if format != formatJSON {
+		http.Error(w, msg, code)
+		return
+	}
+	r := &httpResponse{Code: code}
+	r.writeJSON(w, &rejectionResponse{
+		Version: responseSchemaVersion,
+		Target:  u.name,
+		Error:   &errorResponse{Class: class, Reason: reason},
+	}, nil)
+}
+
+// writeRequestError writes a code response for a malformed request: msg as
+// text, or a rejectionResponse with class and msg as its detail as json.
+func (u *upstream) writeRequestError(w http.ResponseWriter, code int, msg, class, format string) {
+	if format != formatJSON {
+		http.Error(w, msg, code)
+		return
+	}
+	r := &httpResponse{Code: code}
+	r.writeJSON(w, &rejectionResponse{
+		Version: responseSchemaVersion,
+		Target:  u.name,
+		Error:   &errorResponse{Class: class, Detail: msg},
+	}, nil)
+}
+
+func writeErrorJSON(w http.ResponseWriter, err error, v any) {
+	r := &httpResponse{Code: http.StatusBadGateway}
+	var extra map[string]string
+	if pe, ok := err.(*probe.GrpcProbeError); ok {
+		if mapped, h := statusMapping.errorResponse(pe); mapped != nil {
+			r, extra = mapped, h
+		}
+	}
+	r.writeJSON(w, v, extra)
+}
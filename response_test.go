@@ -0,0 +1,81 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGrpcCodeName(t *testing.T) {
+	for c, want := range map[codes.Code]string{
+		codes.OK:                 "OK",
+		codes.Canceled:           "CANCELLED",
+		codes.DeadlineExceeded:   "DEADLINE_EXCEEDED",
+		codes.FailedPrecondition: "FAILED_PRECONDITION",
+		codes.Unauthenticated:    "UNAUTHENTICATED",
+	} {
+		if got := grpcCodeName(c); got != want {
+			t.Errorf("grpcCodeName(%v) = %q, want %q", c, got, want)
+		}
+	}
+}
+
+func TestParseGrpcCode(t *testing.T) {
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		got, ok := parseGrpcCode(grpcCodeName(c))
+		if !ok || got != c {
+			t.Errorf("parseGrpcCode(%q) = %v, %v, want %v", grpcCodeName(c), got, ok, c)
+		}
+	}
+	for _, name := range []string{"", "O_K", "Unavailable", "CANCELED"} {
+		if _, ok := parseGrpcCode(name); ok {
+			t.Errorf("parseGrpcCode(%q) succeeded", name)
+		}
+	}
+}
+
+func TestErrorDetail(t *testing.T) {
+	pe := probe.NewGrpcProbeError(probe.StatusConnectionFailure, "StatusConnectionFailure")
+	pe.Reason = probe.ReasonTCPRefused
+	pe.Cause = errors.New("dial tcp 10.0.0.12:50051: connect: connection refused")
+
+	for _, detail := range []bool{false, true} {
+		cfg.flHTTPErrorDetail = detail
+		er := newErrorResponse(pe)
+		if er.Class != "StatusConnectionFailure" || er.Reason != probe.ReasonTCPRefused {
+			t.Errorf("newErrorResponse() = %+v", er)
+		}
+		if (er.Detail != "") != detail {
+			t.Errorf("with -http-error-detail=%v newErrorResponse().Detail = %q", detail, er.Detail)
+		}
+
+		w := httptest.NewRecorder()
+		statusMapping.writeError(w, "echo", healthpb.HealthCheckResponse_UNKNOWN, pe)
+		if w.Code != 502 || w.Header().Get(probeErrorReasonHeader) != probe.ReasonTCPRefused {
+			t.Errorf("writeError() = %d with reason %q, want 502 tcp_refused", w.Code, w.Header().Get(probeErrorReasonHeader))
+		}
+		if strings.Contains(w.Body.String(), "10.0.0.12") != detail {
+			t.Errorf("with -http-error-detail=%v writeError() body = %s", detail, w.Body.String())
+		}
+	}
+	cfg.flHTTPErrorDetail = false
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"text/template"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// httpResponse describes the http response written for one probe outcome.
+// Body is a text/template executed with a responseData.
+type httpResponse struct {
+	Code    int               `json:"code"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+
+	tmpl *template.Template
+}
+
+// responseData is the data httpResponse bodies are rendered with.  The json
+// template function renders it (or any field) as json.
+type responseData struct {
+	Service string `json:"service"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// probeErrorReasonHeader carries GrpcProbeError.Reason on error responses.
+const probeErrorReasonHeader = "X-Probe-Error-Reason"
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// statusMap maps health check outcomes to http responses: serving statuses
+// (eg "NOT_SERVING") under "status" and probe errors (eg
+// "StatusConnectionFailure") under "errors".
+type statusMap struct {
+	Status map[string]*httpResponse `json:"status"`
+	Errors map[string]*httpResponse `json:"errors"`
+}
+
+// defaultStatusMap is the documented behavior: 200 if the service is SERVING,
+// 503 if the health check failed and 404 if the service is not registered.
+func defaultStatusMap() *statusMap {
+	return &statusMap{
+		Status: map[string]*httpResponse{
+			healthpb.HealthCheckResponse_SERVING.String():         {Code: http.StatusOK, Body: "{{.Service}} {{.Status}}"},
+			healthpb.HealthCheckResponse_NOT_SERVING.String():     {Code: http.StatusServiceUnavailable, Body: "{{.Service}} {{.Status}}"},
+			healthpb.HealthCheckResponse_UNKNOWN.String():         {Code: http.StatusServiceUnavailable, Body: "{{.Service}} {{.Status}}"},
+			healthpb.HealthCheckResponse_SERVICE_UNKNOWN.String(): {Code: http.StatusNotFound, Body: "{{.Service}} {{.Status}}"},
+		},
+		Errors: map[string]*httpResponse{
+			probe.StatusName(probe.StatusConnectionFailure): {Code: http.StatusBadGateway, Body: "{{.Error}} {{.Reason}}{{with .Detail}}: {{.}}{{end}}"},
+			probe.StatusName(probe.StatusRPCFailure):        {Code: http.StatusBadGateway, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusUnimplemented):     {Code: http.StatusNotImplemented, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusServiceNotFound):   {Code: http.StatusNotFound, Body: "{{.Service}} ServiceNotFound"},
+			probe.StatusName(probe.StatusUnhealthy):         {Code: http.StatusServiceUnavailable, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusStale):             {Code: http.StatusServiceUnavailable, Body: "{{.Service}} {{.Status}}"},
+			probe.StatusName(probe.StatusUnavailable):       {Code: http.StatusServiceUnavailable, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusUnauthenticated):   {Code: http.StatusBadGateway, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusPermissionDenied):  {Code: http.StatusBadGateway, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusResourceExhausted): {Code: http.StatusTooManyRequests, Body: "{{.Error}}", Headers: map[string]string{"Retry-After": "1"}},
+			probe.StatusName(probe.StatusCanceled):          {Code: http.StatusServiceUnavailable, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusServerError):       {Code: http.StatusBadGateway, Body: "{{.Error}}"},
+			probe.StatusName(probe.StatusDNSFailure):        {Code: http.StatusBadGateway, Body: "{{.Error}} {{.Reason}}{{with .Detail}}: {{.}}{{end}}"},
+			probe.StatusName(probe.StatusTCPFailure):        {Code: http.StatusBadGateway, Body: "{{.Error}} {{.Reason}}{{with .Detail}}: {{.}}{{end}}"},
+			probe.StatusName(probe.StatusTLSFailure):        {Code: http.StatusBadGateway, Body: "{{.Error}} {{.Reason}}{{with .Detail}}: {{.}}{{end}}"},
+			probe.StatusName(probe.StatusTLSPinMismatch):    {Code: http.StatusBadGateway, Body: "{{.Error}} {{.Reason}}{{with .Detail}}: {{.}}{{end}}"},
+		},
+	}
+}
+
+// loadStatusMap returns the default status map with the entries of the json
+// file at path (if any) overlaid onto it.  Fields left out of an entry keep
+// their default; headers are merged.
+func loadStatusMap(path string) (*statusMap, error) {
+	m := defaultStatusMap()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read status map %s: %v", path, err)
+		}
+		var override statusMap
+		if err := json.Unmarshal(data, &override); err != nil {
+			return nil, fmt.Errorf("failed to parse status map %s: %v", path, err)
+		}
+		for k, r := range override.Status {
+			if _, ok := healthpb.HealthCheckResponse_ServingStatus_value[k]; !ok {
+				return nil, fmt.Errorf("unknown serving status %q in status map", k)
+			}
+			m.Status[k] = overlay(m.Status[k], r)
+		}
+		for k, r := range override.Errors {
+			if !slices.Contains(probe.StatusNames(), k) {
+				return nil, fmt.Errorf("unknown probe error %q in status map (must be one of %v)", k, probe.StatusNames())
+			}
+			m.Errors[k] = overlay(m.Errors[k], r)
+		}
+	}
+
+	for _, set := range []map[string]*httpResponse{m.Status, m.Errors} {
+		for k, r := range set {
+			if r.Code < 100 || r.Code > 599 {
+				return nil, fmt.Errorf("invalid http status %d for %s in status map", r.Code, k)
+			}
+			t, err := template.New(k).Funcs(templateFuncs).Parse(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body for %s in status map: %v", k, err)
+			}
+			r.tmpl = t
+		}
+	}
+	return m, nil
+}
+
+func overlay(base, r *httpResponse) *httpResponse {
+	out := &httpResponse{Code: r.Code, Body: r.Body, Headers: map[string]string{}}
+	if base != nil {
+		if out.Code == 0 {
+			out.Code = base.Code
+		}
+		if out.Body == "" {
+			out.Body = base.Body
+		}
+		for h, v := range base.Headers {
+			out.Headers[h] = v
+		}
+	}
+	for h, v := range r.Headers {
+		out.Headers[h] = v
+	}
+	return out
+}
+
+// write renders r with data.  Non-2xx responses are written like
+// http.Error, unless the mapping sets its own Content-Type.
+func (r *httpResponse) write(w http.ResponseWriter, data responseData) {
+	r.writeWithHeaders(w, data, nil)
+}
+
+// writeWithHeaders is write with extra headers that take precedence over
+// the mapped ones.
+func (r *httpResponse) writeWithHeaders(w http.ResponseWriter, data responseData, extra map[string]string) {
+	var body bytes.Buffer
+	if err := r.tmpl.Execute(&body, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for h, v := range r.Headers {
+		w.Header().Set(h, v)
+	}
+	for h, v := range extra {
+		w.Header().Set(h, v)
+	}
+	if (r.Code >= 200 && r.Code < 300) || w.Header().Get("Content-Type") != "" {
+		w.WriteHeader(r.Code)
+		w.Write(body.Bytes())
+		return
+	}
+	http.Error(w, body.String(), r.Code)
+}
+
+// writeJSON writes v as the json body of r, keeping r's status code and
+// headers.
+func (r *httpResponse) writeJSON(w http.ResponseWriter, v any, extra map[string]string) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for h, v := range r.Headers {
+		w.Header().Set(h, v)
+	}
+	for h, v := range extra {
+		w.Header().Set(h, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.Code)
+	w.Write(body)
+}
+
+// statusResponse returns the response mapped to a serving status.
+func (m *statusMap) statusResponse(st healthpb.HealthCheckResponse_ServingStatus) *httpResponse {
+	r, ok := m.Status[st.String()]
+	if !ok {
+		r = m.Status[healthpb.HealthCheckResponse_UNKNOWN.String()]
+	}
+	return r
+}
+
+// errorResponse returns the response mapped to a *probe.GrpcProbeError
+// along with the headers derived from the error itself.  r is nil if the
+// error is not mapped.
+func (m *statusMap) errorResponse(pe *probe.GrpcProbeError) (r *httpResponse, extra map[string]string) {
+	extra = map[string]string{}
+	if pe.Reason != "" {
+		extra[probeErrorReasonHeader] = pe.Reason
+	}
+	if pe.RetryAfter > 0 {
+		// Retry-After is in whole seconds; round a server pushback up
+		extra["Retry-After"] = strconv.Itoa(int(math.Ceil(pe.RetryAfter.Seconds())))
+	}
+	return m.Errors[probe.StatusName(pe.Code)], extra
+}
+
+// writeStatus writes the response mapped to a serving status.
+func (m *statusMap) writeStatus(w http.ResponseWriter, serviceName string, st healthpb.HealthCheckResponse_ServingStatus) {
+	m.statusResponse(st).write(w, responseData{Service: serviceName, Status: st.String()})
+}
+
+// writeError writes the response mapped to a *probe.GrpcProbeError.  st is
+// the status reported alongside the error.
+func (m *statusMap) writeError(w http.ResponseWriter, serviceName string, st healthpb.HealthCheckResponse_ServingStatus, pe *probe.GrpcProbeError) {
+	data := responseData{
+		Service: serviceName,
+		Status:  st.String(),
+		Error:   pe.Error(),
+		Reason:  pe.Reason,
+	}
+	if cfg.flHTTPErrorDetail {
+		data.Detail = pe.Detail()
+	}
+	r, extra := m.errorResponse(pe)
+	if r == nil {
+		http.Error(w, pe.Error(), http.StatusBadGateway)
+		return
+	}
+	r.writeWithHeaders(w, data, extra)
+}
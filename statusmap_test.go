@@ -0,0 +1,151 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/salrashid123/grpc_health_proxy/probe"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestLoadStatusMapDefault(t *testing.T) {
+	m, err := loadStatusMap("")
+	if err != nil {
+		t.Fatalf("loadStatusMap() error = %v", err)
+	}
+	for st, want := range map[healthpb.HealthCheckResponse_ServingStatus]int{
+		healthpb.HealthCheckResponse_SERVING:         http.StatusOK,
+		healthpb.HealthCheckResponse_NOT_SERVING:     http.StatusServiceUnavailable,
+		healthpb.HealthCheckResponse_UNKNOWN:         http.StatusServiceUnavailable,
+		healthpb.HealthCheckResponse_SERVICE_UNKNOWN: http.StatusNotFound,
+	} {
+		if got := m.statusResponse(st).Code; got != want {
+			t.Errorf("status %v = %d, want %d", st, got, want)
+		}
+	}
+	for _, name := range probe.StatusNames() {
+		if m.Errors[name] == nil {
+			t.Errorf("probe error %s is not mapped", name)
+		}
+	}
+}
+
+func TestLoadStatusMapOverride(t *testing.T) {
+	m, err := loadStatusMap(writeFile(t, "map.json", `{
+		"status": {"NOT_SERVING": {"code": 500, "headers": {"X-Down": "1"}}},
+		"errors": {"StatusResourceExhausted": {"code": 503, "body": "{{.Service}} overloaded"}}
+	}`))
+	if err != nil {
+		t.Fatalf("loadStatusMap() error = %v", err)
+	}
+	down := m.Status["NOT_SERVING"]
+	if down.Code != 500 || down.Body != "{{.Service}} {{.Status}}" || down.Headers["X-Down"] != "1" {
+		t.Errorf("NOT_SERVING = %+v, want code 500 with the default body and the X-Down header", down)
+	}
+	busy := m.Errors["StatusResourceExhausted"]
+	if busy.Code != 503 || busy.Headers["Retry-After"] != "1" {
+		t.Errorf("StatusResourceExhausted = %+v, want code 503 keeping the default headers", busy)
+	}
+	if m.Status["SERVING"].Code != http.StatusOK {
+		t.Errorf("SERVING = %+v, want the default", m.Status["SERVING"])
+	}
+}
+
+func TestLoadStatusMapErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"malformed", `{"status": `, "failed to parse"},
+		{"unknown status", `{"status": {"DOWN": {"code": 500}}}`, "unknown serving status"},
+		{"unknown error", `{"errors": {"StatusBroken": {"code": 500}}}`, "unknown probe error"},
+		{"bad code", `{"status": {"SERVING": {"code": 20}}}`, "invalid http status"},
+		{"bad template", `{"status": {"SERVING": {"body": "{{.Service"}}}`, "invalid body"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadStatusMap(writeFile(t, "map.json", tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("loadStatusMap() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+	if _, err := loadStatusMap("/nonexistent/map.json"); err == nil {
+		t.Errorf("loadStatusMap() of a missing file succeeded")
+	}
+}
+
+func TestStatusMapWrite(t *testing.T) {
+	m, err := loadStatusMap(writeFile(t, "map.json", `{
+		"status": {"SERVING": {"code": 204, "body": "ok"}},
+		"errors": {"StatusUnavailable": {"code": 503, "body": "{{json .}}", "headers": {"Content-Type": "application/json"}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	m.writeStatus(w, "echo", healthpb.HealthCheckResponse_SERVING)
+	if w.Code != 204 {
+		t.Errorf("writeStatus(SERVING) = %d, want 204", w.Code)
+	}
+	w = httptest.NewRecorder()
+	m.writeStatus(w, "echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	if w.Code != http.StatusServiceUnavailable || strings.TrimSpace(w.Body.String()) != "echo NOT_SERVING" {
+		t.Errorf("writeStatus(NOT_SERVING) = %d %q", w.Code, w.Body.String())
+	}
+
+	pe := probe.NewGrpcProbeError(probe.StatusUnavailable, "StatusUnavailable")
+	pe.Reason = probe.ReasonRPC
+	pe.RetryAfter = 1500 * time.Millisecond
+	w = httptest.NewRecorder()
+	m.writeError(w, "echo", healthpb.HealthCheckResponse_UNKNOWN, pe)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("writeError() = %d, want 503", w.Code)
+	}
+	if got := w.Body.String(); got != `{"service":"echo","status":"UNKNOWN","error":"StatusUnavailable","reason":"rpc"}` {
+		t.Errorf("writeError() body = %s", got)
+	}
+	if got := w.Header().Get(probeErrorReasonHeader); got != probe.ReasonRPC {
+		t.Errorf("%s = %q, want %q", probeErrorReasonHeader, got, probe.ReasonRPC)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want the pushback rounded up to 2", got)
+	}
+}
+
+func TestStatusMapWriteTransportFailure(t *testing.T) {
+	m, err := loadStatusMap("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{probe.StatusConnectionFailure, probe.StatusDNSFailure, probe.StatusTCPFailure, probe.StatusTLSFailure, probe.StatusTLSPinMismatch} {
+		pe := probe.NewGrpcProbeError(code, probe.StatusName(code))
+		pe.Reason = "some_reason"
+		w := httptest.NewRecorder()
+		m.writeError(w, "echo", healthpb.HealthCheckResponse_UNKNOWN, pe)
+		if w.Code != http.StatusBadGateway || strings.TrimSpace(w.Body.String()) != probe.StatusName(code)+" some_reason" {
+			t.Errorf("writeError(%s) = %d %q, want 502 with the error and reason", pe, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("writeError(%s) Content-Type = %q, want plain text", pe, ct)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/salrashid123/grpc_health_proxy/probe"
+)
+
+// upstream is a named gRPC server fronted by the proxy.  The server given by
+// -grpcaddr is the default upstream; -targets-config adds more.
+type upstream struct {
+	name        string
+	serviceName string
+	prober      *probe.Prober
+	checker     probe.Checker
+	tracker     interface{ Tracks(string) bool }
+	groups      map[string]*probe.Group
+}
+
+// targetsConfig is the format of the -targets-config file.
+type targetsConfig struct {
+	Targets []targetConfig `json:"targets"`
+}
+
+// targetConfig describes one upstream.  Fields mirror the command line flags
+// of the same name; unset timeouts and user agent fall back to the flags.
+type targetConfig struct {
+	Name              string   `json:"name"`
+	Addr              string   `json:"grpcaddr"`
+	ServiceName       string   `json:"service_name"`
+	UserAgent         string   `json:"user_agent"`
+	ConnTimeout       string   `json:"connect_timeout"`
+	RPCTimeout        string   `json:"rpc_timeout"`
+	GrpcTLS           bool     `json:"grpctls"`
+	GrpcTLSNoVerify   bool     `json:"grpc_tls_no_verify"`
+	GrpcTLSCACert     string   `json:"grpc_ca_cert"`
+	GrpcTLSClientCert string   `json:"grpc_client_cert"`
+	GrpcTLSClientKey  string   `json:"grpc_client_key"`
+	GrpcSNIServerName string   `json:"grpc_sni_server_name"`
+	GrpcSPIFFEID      string   `json:"grpc_spiffe_id"`
+	GrpcURISAN        string   `json:"grpc_uri_san"`
+	GrpcSANRegex      string   `json:"grpc_san_regex"`
+	GrpcSPKIPins      []string `json:"grpc_spki_pins"`
+	GrpcSPKIPinsFile  string   `json:"grpc_spki_pins_file"`
+	GrpcCRL           []string `json:"grpc_crl"`
+	GrpcOCSP          bool     `json:"grpc_ocsp"`
+	GrpcOCSPResponder string   `json:"grpc_ocsp_responder"`
+	ServiceGroups     []string `json:"service_groups"`
+}
+
+var targetNameRegex = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// loadTargets reads the -targets-config file and builds an upstream for
+// every target in it.
+func loadTargets(path string) ([]*upstream, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read targets config %s: %v", path, err)
+	}
+	var tc targetsConfig
+	if err := json.Unmarshal(data, &tc); err != nil {
+		return nil, fmt.Errorf("failed to parse targets config %s: %v", path, err)
+	}
+
+	seen := map[string]bool{}
+	var ups []*upstream
+	for _, t := range tc.Targets {
+		if !targetNameRegex.MatchString(t.Name) {
+			return nil, fmt.Errorf("invalid target name %q", t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		seen[t.Name] = true
+		if !validOCSPResponder(t.GrpcOCSPResponder) {
+			return nil, fmt.Errorf("target %s: invalid grpc_ocsp_responder %q, must be http(s)", t.Name, t.GrpcOCSPResponder)
+		}
+
+		pc := probe.Config{
+			Name:               t.Name,
+			Addr:               t.Addr,
+			UserAgent:          cfg.flUserAgent,
+			ConnTimeout:        cfg.flConnTimeout,
+			RPCTimeout:         cfg.flRPCTimeout,
+			TLS:                t.GrpcTLS,
+			TLSNoVerify:        t.GrpcTLSNoVerify,
+			TLSCACert:          t.GrpcTLSCACert,
+			TLSClientCert:      t.GrpcTLSClientCert,
+			TLSClientKey:       t.GrpcTLSClientKey,
+			TLSServerName:      t.GrpcSNIServerName,
+			TLSSPIFFEID:        t.GrpcSPIFFEID,
+			TLSURISAN:          t.GrpcURISAN,
+			TLSSANRegex:        t.GrpcSANRegex,
+			TLSPins:            t.GrpcSPKIPins,
+			TLSPinsFile:        t.GrpcSPKIPinsFile,
+			Revocation:         revocationConfig(t.GrpcCRL, t.GrpcOCSP, t.GrpcOCSPResponder),
+			TLSReloadInterval:  cfg.flTLSReloadInterval,
+			Retry:              retryPolicy,
+			KnownServices:      append(configuredServices(), t.ServiceName),
+			KnownServicesRegex: servicesPolicy.allowRegex,
+			Logger:             logger,
+		}
+		if t.UserAgent != "" {
+			pc.UserAgent = t.UserAgent
+		}
+		if t.ConnTimeout != "" {
+			if pc.ConnTimeout, err = time.ParseDuration(t.ConnTimeout); err != nil {
+				return nil, fmt.Errorf("target %s: invalid connect_timeout: %v", t.Name, err)
+			}
+		}
+		if t.RPCTimeout != "" {
+			if pc.RPCTimeout, err = time.ParseDuration(t.RPCTimeout); err != nil {
+				return nil, fmt.Errorf("target %s: invalid rpc_timeout: %v", t.Name, err)
+			}
+		}
+
+		groups := map[string]*probe.Group{}
+		for _, spec := range t.ServiceGroups {
+			g, err := probe.ParseGroup(spec)
+			if err != nil {
+				return nil, fmt.Errorf("target %s: %v", t.Name, err)
+			}
+			groups[g.Name] = g
+			for _, m := range g.Members {
+				pc.KnownServices = append(pc.KnownServices, m.Service)
+			}
+		}
+
+		p, err := probe.NewProber(pc)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		ups = append(ups, &upstream{
+			name:        t.Name,
+			serviceName: t.ServiceName,
+			prober:      p,
+			checker:     p,
+			groups:      groups,
+		})
+	}
+	return ups, nil
+}
+
+// targetsHandler dispatches requests on -http-targets-path to the upstream
+// named by the {target} path variable.
+func targetsHandler(ups []*upstream) http.HandlerFunc {
+	byName := map[string]*upstream{}
+	for _, u := range ups {
+		byName[u.name] = u
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["target"]
+		u, ok := byName[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s TargetNotFound", name), http.StatusNotFound)
+			return
+		}
+		u.healthHandler(w, r)
+	}
+}
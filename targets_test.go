@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// writeFile writes data to a file in the test's temporary directory.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTargets(t *testing.T) {
+	ups, err := loadTargets(writeFile(t, "targets.json", `{"targets": [
+		{"name": "a", "grpcaddr": "localhost:50051", "service_name": "echo", "connect_timeout": "3s"},
+		{"name": "b.internal", "grpcaddr": "localhost:50052", "service_groups": ["g=all:x,y"]}
+	]}`))
+	if err != nil {
+		t.Fatalf("loadTargets() error = %v", err)
+	}
+	defer func() {
+		for _, u := range ups {
+			u.prober.Close()
+		}
+	}()
+	if len(ups) != 2 || ups[0].name != "a" || ups[1].name != "b.internal" {
+		t.Fatalf("loadTargets() = %v, want targets a and b.internal", ups)
+	}
+	if ups[0].serviceName != "echo" || ups[0].prober.Name() != "a" {
+		t.Errorf("target a = %+v, want service echo and prober named a", ups[0])
+	}
+	if g := ups[1].groups["g"]; g == nil || len(g.Members) != 2 {
+		t.Errorf("target b.internal groups = %v, want group g of two services", ups[1].groups)
+	}
+}
+
+func TestLoadTargetsErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{"malformed", `{"targets": [`, "failed to parse"},
+		{"bad name", `{"targets": [{"name": "a/b", "grpcaddr": "localhost:1"}]}`, "invalid target name"},
+		{"empty name", `{"targets": [{"grpcaddr": "localhost:1"}]}`, "invalid target name"},
+		{"duplicate", `{"targets": [{"name": "a", "grpcaddr": "localhost:1"}, {"name": "a", "grpcaddr": "localhost:2"}]}`, "duplicate target name"},
+		{"bad timeout", `{"targets": [{"name": "a", "grpcaddr": "localhost:1", "rpc_timeout": "soon"}]}`, "invalid rpc_timeout"},
+		{"no address", `{"targets": [{"name": "a"}]}`, "address not specified"},
+		{"bad ocsp responder", `{"targets": [{"name": "a", "grpcaddr": "localhost:1", "grpctls": true, "grpc_ocsp_responder": "ldap://ocsp.example.com"}]}`, "invalid grpc_ocsp_responder"},
+		{"bad group", `{"targets": [{"name": "a", "grpcaddr": "localhost:1", "service_groups": ["g"]}]}`, "target a"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadTargets(writeFile(t, "targets.json", tc.config))
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("loadTargets() error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTargetsHandler(t *testing.T) {
+	hs, addr := startHealthServer(t)
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	hs.SetServingStatus("ok", healthpb.HealthCheckResponse_SERVING)
+	r := mux.NewRouter()
+	r.Path("/targets/{target}/healthz").HandlerFunc(targetsHandler([]*upstream{newTestUpstream(t, "a", addr)}))
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/targets/a/healthz?serviceName=echo", http.StatusServiceUnavailable},
+		{"/targets/a/healthz?serviceName=ok", http.StatusOK},
+		{"/targets/b/healthz", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != tc.want {
+			t.Errorf("GET %s = %d %q, want %d", tc.target, w.Code, w.Body.String(), tc.want)
+		}
+	}
+}